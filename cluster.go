@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+)
+
+// clusterServers returns the servers tagged as members of the named
+// cluster together with the cluster id found in their metadata. Servers
+// that merely share a name with a configured host are never returned.
+func clusterServers(all []compute.ServerDetail, name string) ([]compute.ServerDetail, string, error) {
+
+	var members []compute.ServerDetail
+	id := ""
+
+	for _, v := range all {
+
+		if v.MetaData[MetaCluster] != name || v.MetaData[MetaClusterID] == "" {
+			continue
+		}
+
+		if id != "" && id != v.MetaData[MetaClusterID] {
+			return nil, "", fmt.Errorf("Multiple clusters named %s found (%s, %s)", name, id, v.MetaData[MetaClusterID])
+		}
+
+		id = v.MetaData[MetaClusterID]
+		members = append(members, v)
+	}
+
+	return members, id, nil
+}
+
+// clusterMetadata returns the Nova metadata that marks a server as a
+// member of this cluster.
+func clusterMetadata(role string) map[string]string {
+
+	return map[string]string{
+		MetaCluster:   config.Name,
+		MetaClusterID: clusterID,
+		MetaRole:      role,
+		MetaVersion:   version,
+	}
+}
+
+// newClusterID returns a random (version 4) UUID.
+func newClusterID() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func nodeRole(node configNode) string {
+
+	if node.IsMaster {
+		return "master"
+	}
+	return "node"
+}
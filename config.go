@@ -0,0 +1,800 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// configContainer is the cluster configuration the tasks work with, one
+// entry per host. Its yaml tags describe the legacy file format, which
+// listed every host; the current format is clusterConfig.
+type configContainer struct {
+	Name             string                `yaml:"name"`
+	Nodes            map[string]configNode `yaml:"hosts"`
+	SSHKey           string                `yaml:"sshkey"`
+	Network          string                `yaml:"network"`
+	Subnet           string                `yaml:"subnet,omitempty"`
+	ExternalCIDR     string                `yaml:"external-cidr,omitempty"`
+	ExposeAPI        bool                  `yaml:"expose-api,omitempty"`
+	CreateNetwork    *networkSection       `yaml:"create-network,omitempty"`
+	FloatingIP       *floatingIPSection    `yaml:"floating-ip,omitempty"`
+	Etcd             *etcdSection          `yaml:"etcd,omitempty"`
+	Kubernetes       *kubernetesSection    `yaml:"kubernetes,omitempty"`
+	Mirror           string                `yaml:"mirror,omitempty"`
+	Kubeconfig       string                `yaml:"kubeconfig,omitempty"`
+	AvailabilityZone string                `yaml:"availabilityZone"`
+	OrderedNodeKeys  []string              `yaml:"-"`
+	Legacy           bool                  `yaml:"-"`
+	Paths            map[string]string     `yaml:"-"`
+}
+
+// configNode is a host. IP is the configured address, empty when Neutron
+// assigns one; FixedIP is the address the port of the host actually has.
+type configNode struct {
+	IP               string `yaml:"ip,omitempty"`
+	IsMaster         bool   `yaml:"ismaster"`
+	VMImage          string `yaml:"vm-image"`
+	VMSize           string `yaml:"vm-size"`
+	ImageID          string `yaml:"-"`
+	FlavorID         string `yaml:"-"`
+	AvailabilityZone string `yaml:"-"`
+	FixedIP          string `yaml:"-"`
+	ServerID         string `yaml:"-"`
+	FloatingIP       string `yaml:"-"`
+}
+
+// clusterConfig is the configuration file format. The hosts are not listed,
+// they are generated from the master and node templates.
+type clusterConfig struct {
+	Cluster   clusterSection   `yaml:"cluster"`
+	Templates templateSections `yaml:"templates"`
+}
+
+type clusterSection struct {
+	Name          string             `yaml:"name"`
+	SSHKey        string             `yaml:"sshkey"`
+	Network       string             `yaml:"network"`
+	Subnet        string             `yaml:"subnet,omitempty"`
+	MasterIP      string             `yaml:"master-ip,omitempty"`
+	ExternalCIDR  string             `yaml:"external-cidr,omitempty"`
+	ExposeAPI     bool               `yaml:"expose-api,omitempty"`
+	CreateNetwork *networkSection    `yaml:"create-network,omitempty"`
+	FloatingIP    *floatingIPSection `yaml:"floating-ip,omitempty"`
+	Etcd          *etcdSection       `yaml:"etcd,omitempty"`
+	Kubernetes    *kubernetesSection `yaml:"kubernetes,omitempty"`
+	Mirror        string             `yaml:"mirror,omitempty"`
+	Kubeconfig    string             `yaml:"kubeconfig,omitempty"`
+}
+
+// networkSection describes the network install creates when the configured
+// network does not exist: a subnet with the CIDR and allocation pool and a
+// router from the subnet to the external network. The external network
+// defaults to the first usable one.
+type networkSection struct {
+	CIDR            string `yaml:"cidr"`
+	PoolStart       string `yaml:"pool-start,omitempty"`
+	PoolEnd         string `yaml:"pool-end,omitempty"`
+	ExternalNetwork string `yaml:"external-network,omitempty"`
+}
+
+// floatingIPSection controls the public addresses of the cluster. Pool is
+// the pool new addresses are allocated from, the default pool when empty.
+// Address is an address of the tenant the master is given instead of a
+// new one. Workers gives every worker an address too, and Release makes
+// uninstall and remove release the addresses the tool allocated.
+type floatingIPSection struct {
+	Pool    string `yaml:"pool,omitempty"`
+	Address string `yaml:"address,omitempty"`
+	Workers bool   `yaml:"workers,omitempty"`
+	Release bool   `yaml:"release,omitempty"`
+}
+
+// etcdSection controls how etcd forms its cluster. Discovery is static,
+// the default, public for discovery.etcd.io or the URL of a self-hosted
+// discovery service that hands out tokens like https://discovery.etcd.io/new.
+// In static mode the master and the workers listed in Members run etcd
+// members, every other host runs an etcd proxy.
+type etcdSection struct {
+	Discovery string   `yaml:"discovery,omitempty"`
+	Members   []string `yaml:"members,omitempty"`
+}
+
+// kubernetesSection selects the Kubernetes release the hosts run and where
+// its binaries are downloaded from, <base-url>/<version>/bin/linux/amd64.
+// Version is a release like v1.2.4 or a release line like v1.2, which
+// stands for the newest release of the line the tool knows. SHA256 adds
+// digests of artifacts to those the tool knows for the release, a release
+// with artifacts of unknown digest is refused unless SkipVerify is set.
+type kubernetesSection struct {
+	Version    string            `yaml:"version,omitempty"`
+	BaseURL    string            `yaml:"base-url,omitempty"`
+	SHA256     map[string]string `yaml:"sha256,omitempty"`
+	SkipVerify bool              `yaml:"skip-verify,omitempty"`
+}
+
+type templateSections struct {
+	Master nodeTemplate `yaml:"master"`
+	Node   nodeTemplate `yaml:"node"`
+}
+
+// nodeTemplate describes the master or the worker nodes. The workers are
+// named <hostname>-1 to <hostname>-<count> leaving out the numbers listed
+// in exclude, worker n gets the n-th address after the master-ip unless
+// ips lists the addresses of the numbered workers in order. Without a
+// master-ip the addresses not listed in ips are assigned by DHCP. Extra
+// lists workers named outside the numbering that use the same template.
+type nodeTemplate struct {
+	Hostname         string      `yaml:"hostname,omitempty"`
+	Count            int         `yaml:"count,omitempty"`
+	Exclude          []int       `yaml:"exclude,omitempty,flow"`
+	IPs              []string    `yaml:"ips,omitempty"`
+	Extra            []extraHost `yaml:"extra,omitempty"`
+	ImageName        string      `yaml:"image-name,omitempty"`
+	ImageID          string      `yaml:"image-id,omitempty"`
+	FlavorName       string      `yaml:"flavor-name,omitempty"`
+	FlavorID         string      `yaml:"flavor-id,omitempty"`
+	AvailabilityZone string      `yaml:"availabilityZone"`
+}
+
+// extraHost is a worker of the node template that is not numbered, its
+// address is assigned by DHCP unless ip is set
+type extraHost struct {
+	Hostname string `yaml:"hostname"`
+	IP       string `yaml:"ip,omitempty"`
+}
+
+// readConfigFile reads either format, a legacy file is converted to the
+// hosts it lists and marked as Legacy.
+func readConfigFile(filename string) (configContainer, error) {
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return configContainer{}, err
+	}
+
+	legacy, err := isLegacyConfig(b)
+	if err != nil {
+		return configContainer{}, err
+	}
+
+	if legacy {
+		return readLegacyConfig(b)
+	}
+
+	var file clusterConfig
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return configContainer{}, err
+	}
+	return file.expand()
+}
+
+// isLegacyConfig tells the formats apart by their top level keys
+func isLegacyConfig(b []byte) (bool, error) {
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return false, err
+	}
+
+	_, hosts := keys["hosts"]
+	_, cluster := keys["cluster"]
+	if hosts && cluster {
+		return false, fmt.Errorf("both hosts and cluster sections found, remove the hosts section")
+	}
+	return hosts, nil
+}
+
+func readLegacyConfig(b []byte) (configContainer, error) {
+
+	var config configContainer
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return config, err
+	}
+
+	config.Legacy = true
+	if config.Name == "" {
+		config.Name = DefaultClusterName
+	}
+
+	config.Paths = map[string]string{
+		"sshkey":        "sshkey",
+		"network":       "network",
+		"subnet":        "subnet",
+		"external-cidr": "external-cidr",
+		"mirror":        "mirror",
+	}
+	config.setNetworkPaths("create-network")
+	config.setFloatingIPPaths("floating-ip")
+	config.setEtcdPaths("etcd")
+	config.setKubernetesPaths("kubernetes")
+	for k, v := range config.Nodes {
+		v.AvailabilityZone = config.AvailabilityZone
+		config.Nodes[k] = v
+
+		config.Paths[k+".role"] = "hosts." + k + ".ismaster"
+		config.Paths[k+".ip"] = "hosts." + k + ".ip"
+		config.Paths[k+".image"] = "hosts." + k + ".vm-image"
+		config.Paths[k+".flavor"] = "hosts." + k + ".vm-size"
+		config.Paths[k+".availabilityZone"] = "availabilityZone"
+	}
+	return config, nil
+}
+
+// writeConfigFile writes the configuration in the format it was read in
+func writeConfigFile(filename string, config configContainer) error {
+
+	var b []byte
+	var err error
+
+	if config.Legacy {
+		b, err = yaml.Marshal(&config)
+	} else {
+		var file clusterConfig
+		file, err = newClusterConfig(config)
+		if err != nil {
+			return err
+		}
+		b, err = yaml.Marshal(&file)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+func (config configContainer) Log() {
+	for k, v := range config.Nodes {
+		log.Printf("%-20s - %s %v\n", "config file", k, v)
+	}
+	log.Printf("%-20s - %s %s\n", "config file", "Name", config.Name)
+	log.Printf("%-20s - %s %s\n", "config file", "SSHKey", config.SSHKey)
+	log.Printf("%-20s - %s %s\n", "config file", "Network", config.Network)
+	if config.Subnet != "" {
+		log.Printf("%-20s - %s %s\n", "config file", "Subnet", config.Subnet)
+	}
+	if config.CreateNetwork != nil {
+		log.Printf("%-20s - %s %s\n", "config file", "CreateNetwork", config.CreateNetwork.CIDR)
+	}
+	log.Printf("%-20s - %s %s\n", "config file", "EtcdDiscovery", config.etcd().Discovery)
+	log.Printf("%-20s - %s %s\n", "config file", "Kubernetes", config.kubernetes().Version)
+	if config.Mirror != "" {
+		log.Printf("%-20s - %s %s\n", "config file", "Mirror", config.Mirror)
+	}
+	if config.Kubeconfig != "" {
+		log.Printf("%-20s - %s %s\n", "config file", "Kubeconfig", config.Kubeconfig)
+	}
+	if config.Legacy {
+		log.Printf("%-20s - %s\n", "config file", "legacy hosts format, run config migrate to convert it")
+	}
+}
+
+// externalCIDR returns the addresses the external security group opens
+// SSH and the API server to
+func (config configContainer) externalCIDR() string {
+
+	if config.ExternalCIDR == "" {
+		return DefaultExternalCIDR
+	}
+	return config.ExternalCIDR
+}
+
+// floatingIP returns the floating IP settings, the defaults when the
+// section is left out
+func (config configContainer) floatingIP() floatingIPSection {
+
+	if config.FloatingIP == nil {
+		return floatingIPSection{}
+	}
+	return *config.FloatingIP
+}
+
+// etcd returns the etcd settings, the defaults when the section is left out
+func (config configContainer) etcd() etcdSection {
+
+	if config.Etcd == nil {
+		return etcdSection{Discovery: EtcdDiscoveryStatic}
+	}
+	s := *config.Etcd
+	if s.Discovery == "" {
+		s.Discovery = EtcdDiscoveryStatic
+	}
+	return s
+}
+
+// kubernetes returns the Kubernetes release settings with the defaults
+// filled in, the version as configured
+func (config configContainer) kubernetes() kubernetesSection {
+
+	var s kubernetesSection
+	if config.Kubernetes != nil {
+		s = *config.Kubernetes
+	}
+	if s.Version == "" {
+		s.Version = DefaultKubeVersion
+	}
+	if s.BaseURL == "" {
+		s.BaseURL = DefaultKubeBaseURL
+	}
+	s.BaseURL = strings.TrimSuffix(s.BaseURL, "/")
+	return s
+}
+
+// isHTTPURL tells whether a setting is an absolute http or https URL
+func isHTTPURL(s string) bool {
+
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// migrateConfigTask rewrites a legacy configuration file in the template
+// format. The original file is kept with BackupSuffix appended.
+func migrateConfigTask(c *cli.Context) error {
+
+	filename := c.GlobalString(Config)
+
+	config, err := readConfigFile(filename)
+	if err != nil {
+		return newResourceError("read config", filename, err)
+	}
+	if !config.Legacy {
+		log.Printf("%-20s - %s %s\n", "migrate config", filename, "already in the current format")
+		return nil
+	}
+
+	log.Printf("%-20s - %s\n", "migrate config", filename)
+
+	file, err := newClusterConfig(config)
+	if err != nil {
+		return newResourceError("migrate config", filename, err)
+	}
+
+	// the generated hosts must be the ones listed in the legacy file
+	migrated, err := file.expand()
+	if err != nil {
+		return newResourceError("migrate config", filename, err)
+	}
+	for k, v := range config.Nodes {
+		if migrated.Nodes[k] != v {
+			return newResourceError("migrate config", filename, fmt.Errorf("host %s cannot be expressed by the templates", k))
+		}
+	}
+
+	b, err := yaml.Marshal(&file)
+	if err != nil {
+		return newResourceError("migrate config", filename, err)
+	}
+
+	original, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return newResourceError("read config", filename, err)
+	}
+	if err := ioutil.WriteFile(filename+BackupSuffix, original, 0644); err != nil {
+		return newResourceError("backup config", filename+BackupSuffix, err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return newResourceError("migrate config", filename, err)
+	}
+
+	log.Printf("%-20s - %s %s\n", "migrate config", filename, "COMPLETED")
+
+	return nil
+}
+
+// expand generates the hosts described by the templates
+func (f clusterConfig) expand() (configContainer, error) {
+
+	config := configContainer{
+		Name:          f.Cluster.Name,
+		SSHKey:        f.Cluster.SSHKey,
+		Network:       f.Cluster.Network,
+		Subnet:        f.Cluster.Subnet,
+		ExternalCIDR:  f.Cluster.ExternalCIDR,
+		ExposeAPI:     f.Cluster.ExposeAPI,
+		CreateNetwork: f.Cluster.CreateNetwork,
+		FloatingIP:    f.Cluster.FloatingIP,
+		Etcd:          f.Cluster.Etcd,
+		Kubernetes:    f.Cluster.Kubernetes,
+		Mirror:        f.Cluster.Mirror,
+		Kubeconfig:    f.Cluster.Kubeconfig,
+		Nodes:         make(map[string]configNode),
+		Paths: map[string]string{
+			"sshkey":        "cluster.sshkey",
+			"network":       "cluster.network",
+			"subnet":        "cluster.subnet",
+			"external-cidr": "cluster.external-cidr",
+			"mirror":        "cluster.mirror",
+		},
+	}
+	config.setNetworkPaths("cluster.create-network")
+	config.setFloatingIPPaths("cluster.floating-ip")
+	config.setEtcdPaths("cluster.etcd")
+	config.setKubernetesPaths("cluster.kubernetes")
+	if config.Name == "" {
+		config.Name = DefaultClusterName
+	}
+
+	var problems templateError
+
+	master := f.Templates.Master
+	if master.Count > 1 {
+		problems.add("templates.master.count", "must be 1, a cluster has exactly one master")
+	}
+	if len(master.IPs) > 0 {
+		problems.add("templates.master.ips", "is not supported, use cluster.master-ip")
+	}
+	if len(master.Exclude) > 0 || len(master.Extra) > 0 {
+		problems.add("templates.master", "exclude and extra are only supported in the node template")
+	}
+
+	masterAddress := f.Cluster.MasterIP
+	masterIP := net.ParseIP(masterAddress).To4()
+	if masterIP == nil && masterAddress != "" {
+		problems.add("cluster.master-ip", "%q is not an IPv4 address", masterAddress)
+		masterAddress = ""
+	}
+
+	workers := f.Templates.Node
+	if workers.Count < 0 {
+		problems.add("templates.node.count", "must not be negative")
+		workers.Count = 0
+	}
+	excluded := make(map[int]bool)
+	for i, n := range workers.Exclude {
+		if n < 1 || n > workers.Count || excluded[n] {
+			problems.add(fmt.Sprintf("templates.node.exclude[%d]", i), "%d is not a worker number from 1 to count or listed twice", n)
+			continue
+		}
+		excluded[n] = true
+	}
+	if numbered := workers.Count - len(excluded); len(workers.IPs) > numbered {
+		problems.add("templates.node.ips", "lists %d addresses for %d nodes", len(workers.IPs), numbered)
+	}
+
+	config.Nodes[masterHostname(f)] = master.node(masterAddress, true)
+	config.setPaths(masterHostname(f), "templates.master", master, "cluster.master-ip")
+
+	// the addresses follow the master-ip by number, so excluding a
+	// worker leaves the addresses of the others as they are
+	ip := masterIP
+	position := 0
+	for i := 1; i <= workers.Count; i++ {
+		address := ""
+		if ip != nil {
+			ip = nextIP(ip)
+			address = ip.String()
+		}
+		if excluded[i] {
+			continue
+		}
+		addressPath := "templates.node.count"
+		if position < len(workers.IPs) {
+			address = workers.IPs[position]
+			addressPath = fmt.Sprintf("templates.node.ips[%d]", position)
+		}
+		position++
+		name := fmt.Sprintf("%s-%d", nodeHostname(f), i)
+		config.Nodes[name] = workers.node(address, false)
+		config.setPaths(name, "templates.node", workers, addressPath)
+	}
+
+	for i, v := range workers.Extra {
+		path := fmt.Sprintf("templates.node.extra[%d]", i)
+		if _, ok := config.Nodes[v.Hostname]; ok || v.Hostname == "" {
+			problems.add(path, "hostname %q is empty or used by another host", v.Hostname)
+			continue
+		}
+		config.Nodes[v.Hostname] = workers.node(v.IP, false)
+		config.setPaths(v.Hostname, "templates.node", workers, path)
+	}
+
+	if len(problems) > 0 {
+		return config, problems
+	}
+	return config, nil
+}
+
+// templateError lists the problems found while expanding the templates.
+// The configuration is still expanded as far as they allow, so it can be
+// validated further.
+type templateError []configProblem
+
+func (e *templateError) add(path string, format string, args ...interface{}) {
+	*e = append(*e, configProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e templateError) Error() string {
+
+	messages := make([]string, len(e))
+	for i, p := range e {
+		messages[i] = p.Path + " " + p.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// setNetworkPaths records where the settings of the network to create are
+func (config *configContainer) setNetworkPaths(section string) {
+
+	config.Paths["create-network"] = section
+	for _, k := range []string{"cidr", "pool-start", "pool-end", "external-network"} {
+		config.Paths["create-network."+k] = section + "." + k
+	}
+}
+
+// setFloatingIPPaths records where the floating IP settings are
+func (config *configContainer) setFloatingIPPaths(section string) {
+
+	for _, k := range []string{"pool", "address"} {
+		config.Paths["floating-ip."+k] = section + "." + k
+	}
+}
+
+// setEtcdPaths records where the etcd settings are
+func (config *configContainer) setEtcdPaths(section string) {
+
+	for _, k := range []string{"discovery", "members"} {
+		config.Paths["etcd."+k] = section + "." + k
+	}
+}
+
+// setKubernetesPaths records where the Kubernetes release settings are
+func (config *configContainer) setKubernetesPaths(section string) {
+
+	for _, k := range []string{"version", "base-url", "sha256", "skip-verify"} {
+		config.Paths["kubernetes."+k] = section + "." + k
+	}
+}
+
+// setPaths records where in the file the settings of a generated host
+// come from, so problems can be reported at the right line
+func (config *configContainer) setPaths(name string, template string, t nodeTemplate, ipPath string) {
+
+	config.Paths[name+".role"] = template
+	config.Paths[name+".ip"] = ipPath
+	config.Paths[name+".image"] = template + ".image-name"
+	if t.ImageID != "" {
+		config.Paths[name+".image"] = template + ".image-id"
+	}
+	config.Paths[name+".flavor"] = template + ".flavor-name"
+	if t.FlavorID != "" {
+		config.Paths[name+".flavor"] = template + ".flavor-id"
+	}
+	config.Paths[name+".availabilityZone"] = template + ".availabilityZone"
+}
+
+func (t nodeTemplate) node(ip string, isMaster bool) configNode {
+	return configNode{
+		IP:               ip,
+		IsMaster:         isMaster,
+		VMImage:          t.ImageName,
+		ImageID:          t.ImageID,
+		VMSize:           t.FlavorName,
+		FlavorID:         t.FlavorID,
+		AvailabilityZone: t.AvailabilityZone,
+	}
+}
+
+// masterHostname returns the name of the master, <cluster>-master unless
+// the template names it
+func masterHostname(f clusterConfig) string {
+	if f.Templates.Master.Hostname != "" {
+		return f.Templates.Master.Hostname
+	}
+	return clusterName(f) + "-master"
+}
+
+// nodeHostname returns the prefix of the worker names, <cluster>-node
+// unless the template sets one
+func nodeHostname(f clusterConfig) string {
+	if f.Templates.Node.Hostname != "" {
+		return f.Templates.Node.Hostname
+	}
+	return clusterName(f) + "-node"
+}
+
+func clusterName(f clusterConfig) string {
+	if f.Cluster.Name != "" {
+		return f.Cluster.Name
+	}
+	return DefaultClusterName
+}
+
+// newClusterConfig converts hosts to the template format. It fails when
+// the hosts cannot be described by one master and one node template, for
+// example when the workers use different flavors.
+func newClusterConfig(config configContainer) (clusterConfig, error) {
+
+	f := clusterConfig{
+		Cluster: clusterSection{
+			Name:          config.Name,
+			SSHKey:        config.SSHKey,
+			Network:       config.Network,
+			Subnet:        config.Subnet,
+			ExternalCIDR:  config.ExternalCIDR,
+			ExposeAPI:     config.ExposeAPI,
+			CreateNetwork: config.CreateNetwork,
+			FloatingIP:    config.FloatingIP,
+			Etcd:          config.Etcd,
+			Kubernetes:    config.Kubernetes,
+			Mirror:        config.Mirror,
+			Kubeconfig:    config.Kubeconfig,
+		},
+	}
+
+	var problems []string
+	var masters, workers []string
+	for k, v := range config.Nodes {
+		if v.IsMaster {
+			masters = append(masters, k)
+		} else {
+			workers = append(workers, k)
+		}
+	}
+	sort.Strings(masters)
+
+	if len(masters) != 1 {
+		return f, fmt.Errorf("expected exactly one master, found %d %v", len(masters), masters)
+	}
+
+	master := config.Nodes[masters[0]]
+	f.Cluster.MasterIP = master.IP
+	f.Templates.Master = newNodeTemplate(master)
+	if masters[0] != clusterName(f)+"-master" {
+		f.Templates.Master.Hostname = masters[0]
+	}
+
+	if len(workers) == 0 {
+		f.Templates.Node = newNodeTemplate(master)
+		return f, nil
+	}
+
+	prefix, numbered, extra := splitWorkers(workers, clusterName(f)+"-node")
+
+	var numbers []int
+	for n := range numbered {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	// the first numbered worker sets the template, the first extra one
+	// when there are none
+	first := ""
+	if len(numbers) > 0 {
+		first = numbered[numbers[0]]
+	} else {
+		first = extra[0]
+	}
+	template := config.Nodes[first]
+
+	f.Templates.Node = newNodeTemplate(template)
+	if prefix != clusterName(f)+"-node" {
+		f.Templates.Node.Hostname = prefix
+	}
+	for _, k := range workers {
+		if !sameTemplate(config.Nodes[k], template) {
+			problems = append(problems, fmt.Sprintf("%s differs from %s in image, flavor or availability zone", k, first))
+		}
+	}
+
+	// workers are numbered up to the highest number, the gaps excluded
+	if len(numbers) > 0 {
+		f.Templates.Node.Count = numbers[len(numbers)-1]
+	}
+	for n := 1; n <= f.Templates.Node.Count; n++ {
+		if _, ok := numbered[n]; !ok {
+			f.Templates.Node.Exclude = append(f.Templates.Node.Exclude, n)
+		}
+	}
+
+	ips := make([]string, len(numbers))
+	sequential := true
+	dhcp := master.IP == ""
+	ip := net.ParseIP(master.IP).To4()
+	next := 1
+	for i, n := range numbers {
+		v := config.Nodes[numbered[n]]
+		ips[i] = v.IP
+		if v.IP != "" {
+			dhcp = false
+		}
+		for ; ip != nil && next <= n; next++ {
+			ip = nextIP(ip)
+		}
+		if ip == nil || ip.String() != v.IP {
+			sequential = false
+		}
+	}
+	// without a master-ip, a node missing from ips uses DHCP as well
+	if master.IP == "" {
+		for len(ips) > 0 && ips[len(ips)-1] == "" {
+			ips = ips[:len(ips)-1]
+		}
+	}
+	if !sequential && !dhcp {
+		f.Templates.Node.IPs = ips
+	}
+
+	for _, k := range extra {
+		f.Templates.Node.Extra = append(f.Templates.Node.Extra, extraHost{Hostname: k, IP: config.Nodes[k].IP})
+	}
+
+	if len(problems) > 0 {
+		return f, fmt.Errorf("hosts do not fit the templates: %s", strings.Join(problems, ", "))
+	}
+	return f, nil
+}
+
+// newNodeTemplate returns the template settings of a host. Hostname, count
+// and ips are left for the caller.
+func newNodeTemplate(node configNode) nodeTemplate {
+	return nodeTemplate{
+		ImageName:        node.VMImage,
+		ImageID:          node.ImageID,
+		FlavorName:       node.VMSize,
+		FlavorID:         node.FlavorID,
+		AvailabilityZone: node.AvailabilityZone,
+	}
+}
+
+// sameTemplate tells whether two hosts use the same image, flavor and
+// availability zone
+func sameTemplate(a configNode, b configNode) bool {
+	return a.VMImage == b.VMImage && a.ImageID == b.ImageID &&
+		a.VMSize == b.VMSize && a.FlavorID == b.FlavorID &&
+		a.AvailabilityZone == b.AvailabilityZone
+}
+
+// splitWorkers returns the workers named <prefix>-<number> by number and
+// the others sorted by name. The prefix shared by most workers is used,
+// the default one when it is among them.
+func splitWorkers(names []string, defaultPrefix string) (string, map[int]string, []string) {
+
+	prefixes := make(map[string]int)
+	for _, v := range names {
+		if prefix, _, ok := workerNumber(v); ok {
+			prefixes[prefix]++
+		}
+	}
+
+	prefix := defaultPrefix
+	for k, n := range prefixes {
+		if n > prefixes[prefix] || n == prefixes[prefix] && prefix != defaultPrefix && k < prefix {
+			prefix = k
+		}
+	}
+
+	numbered := make(map[int]string)
+	var extra []string
+	for _, v := range names {
+		if p, n, ok := workerNumber(v); ok && p == prefix {
+			numbered[n] = v
+			continue
+		}
+		extra = append(extra, v)
+	}
+	sort.Strings(extra)
+	return prefix, numbered, extra
+}
+
+// workerNumber splits a name like kube-node-3 into its prefix and number
+func workerNumber(name string) (string, int, bool) {
+
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil || n < 1 || name[i+1:] != strconv.Itoa(n) {
+		return "", 0, false
+	}
+	return name[:i], n, true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const legacyTestConfig = `name: test-cluster
+
+hosts:
+  kube-master:
+    ip: 192.168.1.140
+    ismaster: true
+    vm-image: CoreOS
+    vm-size: standard.medium
+  kube-node-1:
+    ip: 192.168.1.141
+    ismaster: false
+    vm-image: CoreOS
+    vm-size: standard.small
+  kube-node-2:
+    ip: 192.168.1.142
+    ismaster: false
+    vm-image: CoreOS
+    vm-size: standard.small
+
+sshkey: kube-key
+network: kube-net
+availabilityZone: az2
+`
+
+func TestReadConfigFileExpandsTemplates(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	config, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Legacy {
+		t.Errorf("expected the template format")
+	}
+	if config.Name != "test-cluster" || config.SSHKey != "kube-key" || config.Network != "kube-net" {
+		t.Errorf("unexpected cluster section %+v", config)
+	}
+
+	want := map[string]configNode{
+		"kube-master": {IP: "192.168.1.140", IsMaster: true, VMImage: "CoreOS", VMSize: "standard.medium", AvailabilityZone: "az2"},
+		"kube-node-1": {IP: "192.168.1.141", VMImage: "CoreOS", VMSize: "standard.small", AvailabilityZone: "az2"},
+		"kube-node-2": {IP: "192.168.1.142", VMImage: "CoreOS", VMSize: "standard.small", AvailabilityZone: "az2"},
+	}
+	if !reflect.DeepEqual(config.Nodes, want) {
+		t.Errorf("expected %v, got %v", want, config.Nodes)
+	}
+}
+
+func TestReadConfigFileDefaults(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(`cluster:
+  sshkey: kube-key
+  network: kube-net
+  master-ip: 10.0.0.10
+templates:
+  master:
+    image-id: image-1
+    flavor-id: "102"
+  node:
+    count: 2
+    ips: [10.0.0.50]
+    image-name: CoreOS
+    flavor-name: standard.small
+`)
+
+	config, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]configNode{
+		"kubernetes-master": {IP: "10.0.0.10", IsMaster: true, ImageID: "image-1", FlavorID: "102"},
+		"kubernetes-node-1": {IP: "10.0.0.50", VMImage: "CoreOS", VMSize: "standard.small"},
+		"kubernetes-node-2": {IP: "10.0.0.12", VMImage: "CoreOS", VMSize: "standard.small"},
+	}
+	if !reflect.DeepEqual(config.Nodes, want) {
+		t.Errorf("expected %v, got %v", want, config.Nodes)
+	}
+}
+
+func TestReadConfigFileDHCP(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "", 1))
+
+	config, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range config.Nodes {
+		if v.IP != "" {
+			t.Errorf("expected %s to get its address by DHCP, got %s", k, v.IP)
+		}
+	}
+
+	f, err := newClusterConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Cluster.MasterIP != "" || len(f.Templates.Node.IPs) != 0 {
+		t.Errorf("expected no addresses to be written, got %q and %v", f.Cluster.MasterIP, f.Templates.Node.IPs)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	for _, v := range []struct {
+		content string
+		want    string
+	}{
+		{"cluster:\n  master-ip: none\n", "is not an IPv4 address"},
+		{"cluster:\n  master-ip: 10.0.0.10\ntemplates:\n  node:\n    count: 1\n    ips: [10.0.0.11, 10.0.0.12]\n", "lists 2 addresses for 1 nodes"},
+		{"cluster:\n  master-ip: 10.0.0.10\ntemplates:\n  master:\n    count: 2\n", "exactly one master"},
+		{"cluster:\n  master-ip: 10.0.0.10\ntemplates:\n  node:\n    count: 2\n    exclude: [3]\n", "3 is not a worker number"},
+		{"cluster:\n  master-ip: 10.0.0.10\ntemplates:\n  node:\n    count: 1\n    extra:\n    - hostname: kubernetes-node-1\n", "used by another host"},
+		{"cluster:\n  master-ip: 10.0.0.10\nhosts:\n  kube-master:\n    ismaster: true\n", "both hosts and cluster"},
+	} {
+		env.writeConfig(v.content)
+		if _, err := readConfigFile(env.config); err == nil || !strings.Contains(err.Error(), v.want) {
+			t.Errorf("expected %q, got %v", v.want, err)
+		}
+	}
+}
+
+func TestReadLegacyConfigFile(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(legacyTestConfig)
+
+	legacy, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !legacy.Legacy {
+		t.Errorf("expected the legacy format")
+	}
+
+	env.writeConfig(testConfig)
+	current, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(legacy.Nodes, current.Nodes) {
+		t.Errorf("expected the legacy hosts %v to match the templates %v", legacy.Nodes, current.Nodes)
+	}
+}
+
+func TestNewClusterConfigRejectsDifferentWorkers(t *testing.T) {
+
+	config := configContainer{
+		Name: "test-cluster",
+		Nodes: map[string]configNode{
+			"kube-master": {IP: "192.168.1.140", IsMaster: true, VMSize: "standard.medium"},
+			"kube-node-1": {IP: "192.168.1.141", VMSize: "standard.small"},
+			"kube-node-2": {IP: "192.168.1.142", VMSize: "standard.medium"},
+		},
+	}
+	if _, err := newClusterConfig(config); err == nil || !strings.Contains(err.Error(), "kube-node-2 differs") {
+		t.Errorf("expected kube-node-2 to be rejected, got %v", err)
+	}
+}
+
+func TestNewClusterConfigGapsAndExtraHosts(t *testing.T) {
+
+	config := configContainer{
+		Name: "test-cluster",
+		Nodes: map[string]configNode{
+			"kube-master": {IP: "192.168.1.140", IsMaster: true, VMSize: "standard.medium"},
+			"kube-node-2": {IP: "192.168.1.142", VMSize: "standard.small"},
+			"kube-node-4": {IP: "192.168.1.144", VMSize: "standard.small"},
+			"gpu":         {VMSize: "standard.small"},
+			"extra":       {IP: "192.168.1.160", VMSize: "standard.small"},
+		},
+	}
+
+	f, err := newClusterConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := f.Templates.Node
+	if node.Count != 4 || !reflect.DeepEqual(node.Exclude, []int{1, 3}) || len(node.IPs) != 0 {
+		t.Errorf("expected workers up to 4 without 1 and 3 on sequential addresses, got %+v", node)
+	}
+	if want := []extraHost{{Hostname: "extra", IP: "192.168.1.160"}, {Hostname: "gpu"}}; !reflect.DeepEqual(node.Extra, want) {
+		t.Errorf("expected the extra hosts %v, got %v", want, node.Extra)
+	}
+
+	expanded, err := f.expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expanded.Nodes, config.Nodes) {
+		t.Errorf("expected the hosts %v, got %v", config.Nodes, expanded.Nodes)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(legacyTestConfig, "192.168.1.142", "192.168.1.150", 1))
+
+	legacy, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateConfigTask(env.context(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Legacy {
+		t.Errorf("expected the template format after migration")
+	}
+	if !reflect.DeepEqual(legacy.Nodes, migrated.Nodes) {
+		t.Errorf("expected %v, got %v", legacy.Nodes, migrated.Nodes)
+	}
+
+	b, err := ioutil.ReadFile(env.config + BackupSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "192.168.1.150") || !strings.Contains(string(b), "hosts:") {
+		t.Errorf("expected the legacy file in the backup, got:\n%s", b)
+	}
+
+	b, err = ioutil.ReadFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "- 192.168.1.150") {
+		t.Errorf("expected the worker addresses to be listed, got:\n%s", b)
+	}
+}
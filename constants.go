@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 //OpenStack well-defined command line names
 const (
 	AuthURL    = "os-auth-url"
@@ -41,8 +43,115 @@ const (
 	Install           = "install"
 	Status            = "status"
 	Uninstall         = "uninstall"
+	Recreate          = "recreate"
+	Add               = "add"
+	IP                = "ip"
+	Flavor            = "flavor"
+	VMImage           = "image"
+	Save              = "save"
+	Remove            = "remove"
+	Force             = "force"
+	Drain             = "drain"
+	NoRollback        = "no-rollback"
+	Parallelism       = "parallelism"
+	Timeout           = "timeout"
+	NodeTimeout       = "node-timeout"
+	RetryFailed       = "retry-failed"
+	Migrate           = "migrate"
+	Mirror            = "mirror"
+	Dir               = "dir"
+	Serve             = "serve"
+	Listen            = "listen"
+	Validate          = "validate"
+	Kubeconfig        = "kubeconfig"
+	BackupSuffix      = ".bak"
+)
+
+// StateFileSuffix is appended to the configuration file name, without its
+// extension, to name the hidden state file next to it
+const StateFileSuffix = "-state.json"
+
+// DefaultParallelism is the number of worker nodes created concurrently
+const DefaultParallelism = 4
+
+// DefaultTimeout bounds the time a command waits for all servers to
+// become ACTIVE, DefaultNodeTimeout the time it waits for a single server
+const (
+	DefaultTimeout     = 30 * time.Minute
+	DefaultNodeTimeout = 10 * time.Minute
+)
+
+// DefaultClusterName is used when the configuration file does not name the cluster
+const DefaultClusterName = "kubernetes"
+
+// Nova server metadata keys which identify the members of a cluster
+const (
+	MetaCluster   = "kubesetup-cluster"
+	MetaClusterID = "kubesetup-cluster-id"
+	MetaRole      = "kubesetup-role"
+	MetaVersion   = "kubesetup-version"
+)
+
+// KubeAPIPort is the insecure port of the Kubernetes API server on the
+// master, bound to localhost. KubeAPISecurePort is the TLS port everything
+// else reaches the API server on.
+const (
+	KubeAPIPort       = 8080
+	KubeAPISecurePort = 443
+)
+
+// ServiceClusterIPRange is the range the service IPs are taken from, the
+// API server is reached under the first address from within the pods
+const ServiceClusterIPRange = "10.100.0.0/16"
+
+// PKIDirSuffix is appended to the configuration file name, without its
+// extension, to name the hidden directory the cluster CA is kept in
+const PKIDirSuffix = "-pki"
+
+// Suffixes of the security groups of a cluster, <cluster>-internal opens
+// the ports between the members, <cluster>-external SSH and optionally the
+// API server to DefaultExternalCIDR unless external-cidr is set
+const (
+	SecurityGroupInternal = "internal"
+	SecurityGroupExternal = "external"
+	DefaultExternalCIDR   = "0.0.0.0/0"
+)
+
+// etcd discovery modes, static needs no discovery service and public uses
+// discoveryURL. Any other value is the URL of a self-hosted service.
+const (
+	EtcdDiscoveryStatic = "static"
+	EtcdDiscoveryPublic = "public"
+)
+
+// DefaultKubeVersion is the Kubernetes release installed unless the
+// configuration selects another, downloaded from DefaultKubeBaseURL
+const (
+	DefaultKubeVersion = "v1.0.1"
+	DefaultKubeBaseURL = "https://storage.googleapis.com/kubernetes-release/release"
 )
 
+// DefaultMirrorDir is where mirror stages the artifacts, DefaultMirrorListen
+// the address mirror --serve serves them on
+const (
+	DefaultMirrorDir    = "artifacts"
+	DefaultMirrorListen = ":8000"
+)
+
+// KubeRegisterURL is the kube-register release the master runs,
+// RegistryImage the image of the registry mirror on the master
+const (
+	KubeRegisterURL = "https://github.com/kelseyhightower/kube-register/releases/download/v0.0.3/kube-register-0.0.3-linux-amd64"
+	RegistryImage   = "quay.io/devops/docker-registry:latest"
+)
+
+// FetchUnverified is passed to /opt/bin/fetch instead of a digest for the
+// artifacts skip-verify lets the hosts download without a check
+const FetchUnverified = "unverified"
+
+// StatusMissing is reported for a node or port that does not exist in OpenStack
+const StatusMissing = "MISSING"
+
 // LogStringFormat1 and others are formats used to write to the log.
 const (
 	LogStringFormat1 string = "%-30s\n"
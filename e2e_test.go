@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+)
+
+// The end to end tests run the command line in a child process, since
+// log.Fatal exits. The child is this test binary, told by e2eArgsEnv to
+// run main with the given arguments instead of the tests.
+const (
+	e2eArgsEnv      = "KUBESETUP_E2E_ARGS"
+	e2eDiscoveryEnv = "KUBESETUP_E2E_DISCOVERY"
+)
+
+func TestMain(m *testing.M) {
+
+	kubeManifest = testKubeManifest()
+
+	if args := os.Getenv(e2eArgsEnv); args != "" {
+		runMain(args)
+	}
+	os.Exit(m.Run())
+}
+
+func runMain(encoded string) {
+
+	var args []string
+	if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+		panic(err)
+	}
+
+	discoveryURL = os.Getenv(e2eDiscoveryEnv)
+	pollInterval = 10 * time.Millisecond
+	maxPollInterval = 50 * time.Millisecond
+	pkiKeyBits = 1024
+
+	os.Args = append([]string{"hpcloud-kubesetup"}, args...)
+	main()
+	os.Exit(0)
+}
+
+type e2eEnv struct {
+	t      *testing.T
+	dir    string
+	config string
+	cloud  *mockOpenStack
+}
+
+func newE2EEnv(t *testing.T) *e2eEnv {
+
+	if testing.Short() {
+		t.Skip("end to end test")
+	}
+
+	dir, err := ioutil.TempDir("", "kubesetup-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &e2eEnv{t: t, dir: dir, config: filepath.Join(dir, "cluster.yml"), cloud: newMockOpenStack()}
+	if err := ioutil.WriteFile(env.config, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		env.cloud.Close()
+		os.RemoveAll(dir)
+	})
+
+	return env
+}
+
+// run executes the command line against the mock cloud and returns its
+// combined output and whether it exited successfully. The child is killed
+// after timeout.
+func (env *e2eEnv) run(timeout time.Duration, password string, args ...string) (string, bool) {
+
+	global := []string{
+		"--" + Config, env.config,
+		"--" + AuthURL, env.cloud.authURL(),
+		"--" + Username, mockUsername,
+		"--" + Password, password,
+		"--" + TenantName, mockTenant,
+	}
+
+	encoded, err := json.Marshal(append(global, args...))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^$")
+	cmd.Dir = env.dir
+	cmd.Env = append(os.Environ(),
+		e2eArgsEnv+"="+string(encoded),
+		e2eDiscoveryEnv+"="+env.cloud.URL+"/discovery/new",
+		"HOME="+env.dir,
+	)
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err == nil
+}
+
+func (env *e2eEnv) mustRun(args ...string) string {
+
+	out, ok := env.run(30*time.Second, mockPassword, args...)
+	if !ok {
+		env.t.Fatalf("%s failed:\n%s", strings.Join(args, " "), out)
+	}
+	return out
+}
+
+// indexOf returns the position of the first request starting with prefix
+func indexOf(requests []string, prefix string) int {
+
+	for i, v := range requests {
+		if strings.HasPrefix(v, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastIndexOf returns the position of the last request starting with prefix
+func lastIndexOf(requests []string, prefix string) int {
+
+	for i := len(requests) - 1; i >= 0; i-- {
+		if strings.HasPrefix(requests[i], prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestE2EInstallUninstall(t *testing.T) {
+
+	env := newE2EEnv(t)
+
+	env.mustRun(Install)
+
+	nodes := map[string]string{"kube-master": "192.168.1.140", "kube-node-1": "192.168.1.141", "kube-node-2": "192.168.1.142"}
+	for name, ip := range nodes {
+
+		found := env.cloud.serversNamed(name)
+		if len(found) != 1 {
+			t.Fatalf("expected one server %s, got %d", name, len(found))
+		}
+		if found[0].MetaData[MetaCluster] != "test-cluster" {
+			t.Errorf("server %s is not tagged: %v", name, found[0].MetaData)
+		}
+		if !strings.Contains(env.cloud.userDataOf(found[0].ID), ip) {
+			t.Errorf("server %s did not get its cloud-config", name)
+		}
+	}
+
+	master := env.cloud.serversNamed("kube-master")[0]
+	if _, floatingIP := serverAddresses(master); floatingIP == "" {
+		t.Errorf("master has no floating IP")
+	}
+
+	requests := env.cloud.requestLog()
+	if indexOf(requests, "POST /servers") < indexOf(requests, "POST /ports") {
+		t.Errorf("server created before its port: %v", requests)
+	}
+	if indexOf(requests, "POST /servers/server-") < indexOf(requests, "POST /servers") {
+		t.Errorf("server tagged before it was created: %v", requests)
+	}
+	if i := indexOf(requests, "POST /servers/"+master.ID+"/action"); i < lastIndexOf(requests, "GET /servers/server-") {
+		t.Errorf("floating IP associated before all servers were active: %v", requests)
+	}
+
+	out := env.mustRun(Status)
+	if strings.Contains(out, StatusMissing) {
+		t.Errorf("status reports missing nodes after install:\n%s", out)
+	}
+
+	env.mustRun(Uninstall)
+
+	if env.cloud.count("servers") != 0 || env.cloud.count("ports") != 0 {
+		t.Errorf("expected no servers and ports, got %d servers and %d ports", env.cloud.count("servers"), env.cloud.count("ports"))
+	}
+
+	requests = env.cloud.requestLog()
+	if lastIndexOf(requests, "DELETE /servers/") > indexOf(requests, "DELETE /ports/") {
+		t.Errorf("port deleted before its server: %v", requests)
+	}
+	if env.cloud.count("groups") != 0 {
+		t.Errorf("expected no security groups, got %d", env.cloud.count("groups"))
+	}
+	if indexOf(requests, "DELETE /security-groups/") < lastIndexOf(requests, "DELETE /ports/") {
+		t.Errorf("security group deleted before the ports using it: %v", requests)
+	}
+}
+
+func TestE2EInstallCreatesNetwork(t *testing.T) {
+
+	env := newE2EEnv(t)
+	if err := ioutil.WriteFile(env.config, []byte(createNetworkConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env.mustRun(Install)
+
+	if env.cloud.count("networks") != 3 || env.cloud.count("subnets") != 2 || env.cloud.count("routers") != 1 {
+		t.Fatalf("expected a network, subnet and router, got %d networks, %d subnets, %d routers",
+			env.cloud.count("networks"), env.cloud.count("subnets"), env.cloud.count("routers"))
+	}
+	requests := env.cloud.requestLog()
+	if indexOf(requests, "PUT /routers/") < indexOf(requests, "POST /routers") || indexOf(requests, "POST /ports") < indexOf(requests, "PUT /routers/") {
+		t.Errorf("subnet not attached to the router before the ports were created: %v", requests)
+	}
+
+	env.mustRun(Uninstall)
+
+	if env.cloud.count("networks") != 2 || env.cloud.count("subnets") != 1 || env.cloud.count("routers") != 0 || env.cloud.count("ports") != 0 {
+		t.Errorf("expected the network to be deleted, got %d networks, %d subnets, %d routers, %d ports",
+			env.cloud.count("networks"), env.cloud.count("subnets"), env.cloud.count("routers"), env.cloud.count("ports"))
+	}
+	requests = env.cloud.requestLog()
+	order := []string{"PUT /routers/", "DELETE /routers/", "DELETE /subnets/", "DELETE /networks/"}
+	for i := 1; i < len(order); i++ {
+		if indexOf(requests, order[i]) < lastIndexOf(requests, order[i-1]) {
+			t.Errorf("%s before %s: %v", order[i], order[i-1], requests)
+		}
+	}
+}
+
+func TestE2EInstallRollsBackNetwork(t *testing.T) {
+
+	env := newE2EEnv(t)
+	if err := ioutil.WriteFile(env.config, []byte(createNetworkConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env.cloud.failServer("kube-node-2", 500)
+
+	if out, ok := env.run(30*time.Second, mockPassword, Install); ok {
+		t.Fatalf("install succeeded although server creation failed:\n%s", out)
+	}
+	if env.cloud.count("networks") != 2 || env.cloud.count("subnets") != 1 || env.cloud.count("routers") != 0 || env.cloud.count("ports") != 0 {
+		t.Errorf("expected the network to be rolled back, got %d networks, %d subnets, %d routers, %d ports",
+			env.cloud.count("networks"), env.cloud.count("subnets"), env.cloud.count("routers"), env.cloud.count("ports"))
+	}
+}
+
+func TestE2EReleaseFloatingIPs(t *testing.T) {
+
+	env := newE2EEnv(t)
+	if err := ioutil.WriteFile(env.config, []byte(floatingIPConfig("    workers: true\n    release: true\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env.mustRun(Install)
+
+	if got := env.cloud.count("floatingIPs"); got != 3 {
+		t.Fatalf("expected a floating IP for every node, got %d", got)
+	}
+
+	env.mustRun(Uninstall)
+
+	if got := env.cloud.count("floatingIPs"); got != 0 {
+		t.Errorf("expected the floating IPs to be released, got %d", got)
+	}
+}
+
+func TestE2EInstallDHCP(t *testing.T) {
+
+	env := newE2EEnv(t)
+	dhcpConfig := strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "", 1)
+	if err := ioutil.WriteFile(env.config, []byte(dhcpConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env.mustRun(Install)
+
+	addresses := make(map[string]string)
+	for _, v := range env.cloud.portList() {
+		addresses[v.Name] = portIP(v)
+	}
+
+	masterIP := addresses["kube-master"]
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+
+		found := env.cloud.serversNamed(name)
+		if len(found) != 1 {
+			t.Fatalf("expected one server %s, got %d", name, len(found))
+		}
+		userData := env.cloud.userDataOf(found[0].ID)
+		if addresses[name] == "" || !strings.Contains(userData, addresses[name]) {
+			t.Errorf("server %s did not get its assigned address %q", name, addresses[name])
+		}
+		if !strings.Contains(userData, "http://"+masterIP+":2380") {
+			t.Errorf("server %s does not point at the master %s", name, masterIP)
+		}
+	}
+}
+
+func TestE2EInvalidCredentials(t *testing.T) {
+
+	env := newE2EEnv(t)
+
+	out, ok := env.run(30*time.Second, "wrong", Install)
+	if ok {
+		t.Fatalf("install succeeded with invalid credentials:\n%s", out)
+	}
+	if len(env.cloud.requestLog()) != 0 {
+		t.Errorf("services called without a token: %v", env.cloud.requestLog())
+	}
+}
+
+func TestE2EInstallFailsOnServerError(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.fail("POST", "/servers", 500)
+
+	out, ok := env.run(30*time.Second, mockPassword, Install)
+	if ok {
+		t.Fatalf("install succeeded although server creation failed:\n%s", out)
+	}
+	if !strings.Contains(out, "create server kube-master (HTTP 500)") {
+		t.Errorf("expected the failing server and status in the output:\n%s", out)
+	}
+	if env.cloud.count("servers") != 0 || env.cloud.count("ports") != 0 {
+		t.Errorf("expected no servers and ports, got %d servers and %d ports", env.cloud.count("servers"), env.cloud.count("ports"))
+	}
+}
+
+func TestE2EInstallRefusedByQuota(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.update(func() { env.cloud.limits.AbsoluteLimits.MaxTotalRAMSize = 4096 })
+
+	out, ok := env.run(30*time.Second, mockPassword, Install)
+	if ok {
+		t.Fatalf("install succeeded although the quota is exceeded:\n%s", out)
+	}
+	if !strings.Contains(out, "not enough quota") || !strings.Contains(out, "exceeded") {
+		t.Errorf("expected the quota breakdown in the output:\n%s", out)
+	}
+	if indexOf(env.cloud.requestLog(), "POST") != -1 {
+		t.Errorf("expected nothing to be created, got %v", env.cloud.requestLog())
+	}
+}
+
+func TestE2EInstallRollsBackOnFailure(t *testing.T) {
+
+	env := newE2EEnv(t)
+	// the master and its port exist by the time kube-node-2 fails
+	env.cloud.failServer("kube-node-2", 500)
+
+	out, ok := env.run(30*time.Second, mockPassword, Install)
+	if ok {
+		t.Fatalf("install succeeded although server creation failed:\n%s", out)
+	}
+	if !strings.Contains(out, "create server kube-node-2 (HTTP 500)") {
+		t.Errorf("expected the failing server and status in the output:\n%s", out)
+	}
+	if env.cloud.count("servers") != 0 || env.cloud.count("ports") != 0 {
+		t.Errorf("expected no servers and ports, got %d servers and %d ports", env.cloud.count("servers"), env.cloud.count("ports"))
+	}
+	if env.cloud.count("groups") != 0 {
+		t.Errorf("expected the security groups to be rolled back, got %d", env.cloud.count("groups"))
+	}
+}
+
+func TestE2EInstallNoRollback(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.failServer("kube-node-2", 500)
+
+	out, ok := env.run(30*time.Second, mockPassword, Install, "--"+NoRollback)
+	if ok {
+		t.Fatalf("install succeeded although server creation failed:\n%s", out)
+	}
+	if env.cloud.count("servers") != 2 {
+		t.Errorf("expected the created nodes to be kept, got %d servers", env.cloud.count("servers"))
+	}
+	if env.cloud.count("floatingIPs") != 1 {
+		t.Errorf("expected the floating IP of the master to be kept, got %d", env.cloud.count("floatingIPs"))
+	}
+}
+
+func TestE2EInstallRollbackKeepsExistingNodes(t *testing.T) {
+
+	env := newE2EEnv(t)
+
+	env.mustRun(Install)
+	master := env.cloud.serversNamed("kube-master")[0]
+
+	// kube-node-2 disappeared, its recreation fails
+	lost := env.cloud.serversNamed("kube-node-2")[0]
+	env.cloud.update(func() {
+		env.cloud.deleteServer(lost)
+		for id, v := range env.cloud.ports {
+			if v.Name == "kube-node-2" {
+				delete(env.cloud.ports, id)
+			}
+		}
+	})
+	env.cloud.fail("POST", "/servers", 500)
+
+	if out, ok := env.run(30*time.Second, mockPassword, Install); ok {
+		t.Fatalf("install succeeded although server creation failed:\n%s", out)
+	}
+	if env.cloud.count("servers") != 2 || env.cloud.count("ports") != 2 {
+		t.Errorf("expected the existing nodes to be kept, got %d servers and %d ports", env.cloud.count("servers"), env.cloud.count("ports"))
+	}
+	if _, floatingIP := serverAddresses(env.cloud.serversNamed("kube-master")[0]); floatingIP == "" || env.cloud.serversNamed("kube-master")[0].ID != master.ID {
+		t.Errorf("existing master was touched by the rollback")
+	}
+}
+
+func TestE2EUninstallIgnoresMissingServers(t *testing.T) {
+
+	env := newE2EEnv(t)
+
+	env.mustRun(Install)
+	env.cloud.fail("DELETE", "/servers/", 404)
+
+	env.mustRun(Uninstall)
+
+	if env.cloud.count("ports") != 0 {
+		t.Errorf("expected the ports to be deleted, got %d", env.cloud.count("ports"))
+	}
+}
+
+func TestE2EServerStuckInBuild(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.stickInBuild("kube-node-1")
+
+	out, ok := env.run(30*time.Second, mockPassword, Install, "--"+NodeTimeout, "300ms")
+	if ok {
+		t.Fatalf("install finished although a server never became active:\n%s", out)
+	}
+	if !strings.Contains(out, "wait for server kube-node-1: still BUILD after") {
+		t.Errorf("expected the timeout to name the node, got:\n%s", out)
+	}
+
+	for _, v := range env.cloud.requestLog() {
+		if strings.HasPrefix(v, "POST /servers/") && strings.HasSuffix(v, "/action") {
+			t.Errorf("floating IP associated before all servers were active")
+		}
+	}
+	if env.cloud.count("floatingIPs") != 0 {
+		t.Errorf("expected the floating IP reserved for the master to be rolled back, got %d", env.cloud.count("floatingIPs"))
+	}
+	if n := len(env.cloud.serversNamed("kube-node-1")); n != 0 {
+		t.Errorf("expected the stuck server to be rolled back, found %d", n)
+	}
+}
+
+func TestE2EServerStuckInBuildOverallTimeout(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.stickInBuild("kube-master")
+
+	out, ok := env.run(30*time.Second, mockPassword, Install, "--"+Timeout, "300ms", "--"+NodeTimeout, "1h")
+	if ok {
+		t.Fatalf("install finished although the master never became active:\n%s", out)
+	}
+	if !strings.Contains(out, "wait for server kube-master: still BUILD after") {
+		t.Errorf("expected the timeout to name the master, got:\n%s", out)
+	}
+}
+
+func TestE2EServerErrorFailsImmediately(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.failSpawn("kube-node-2", "No valid host was found.", 1)
+
+	start := time.Now()
+	out, ok := env.run(30*time.Second, mockPassword, Install)
+	if ok {
+		t.Fatalf("install succeeded although a server went to ERROR:\n%s", out)
+	}
+	if !strings.Contains(out, "wait for server kube-node-2: server in ERROR state: No valid host was found.") {
+		t.Errorf("expected the fault message, got:\n%s", out)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("install took %s to fail", elapsed)
+	}
+	if n := len(env.cloud.serversNamed("kube-node-2")); n != 0 {
+		t.Errorf("expected the failed server to be rolled back, found %d", n)
+	}
+}
+
+func TestE2ERetryFailed(t *testing.T) {
+
+	env := newE2EEnv(t)
+	env.cloud.failSpawn("kube-node-2", "No valid host was found.", 1)
+
+	out := env.mustRun(Install, "--"+RetryFailed)
+	if !strings.Contains(out, "retry server") {
+		t.Errorf("expected kube-node-2 to be recreated, got:\n%s", out)
+	}
+
+	found := env.cloud.serversNamed("kube-node-2")
+	if len(found) != 1 || found[0].Status != "ACTIVE" {
+		t.Fatalf("expected one ACTIVE kube-node-2, got %v", found)
+	}
+	state, err := readStateFile(statePath(env.config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := state.Nodes["kube-node-2"].ServerID; id != found[0].ID {
+		t.Errorf("expected server %s in the state, got %s", found[0].ID, id)
+	}
+	if n := env.cloud.count("ports"); n != 3 {
+		t.Errorf("expected the port to be reused, found %d ports", n)
+	}
+}
+
+func TestE2EMigrateLegacyConfig(t *testing.T) {
+
+	env := newE2EEnv(t)
+	if err := ioutil.WriteFile(env.config, []byte(legacyTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env.mustRun(Config, Migrate)
+
+	b, err := ioutil.ReadFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "templates:") || strings.Contains(string(b), "hosts:") {
+		t.Fatalf("expected the template format, got:\n%s", b)
+	}
+
+	env.mustRun(Install)
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+		if n := len(env.cloud.serversNamed(name)); n != 1 {
+			t.Errorf("expected one %s, found %d", name, n)
+		}
+	}
+}
+
+func TestE2EValidate(t *testing.T) {
+
+	env := newE2EEnv(t)
+
+	out := env.mustRun(Validate)
+	if !strings.Contains(out, env.config+": OK") {
+		t.Errorf("expected the config to be valid, got:\n%s", out)
+	}
+
+	env.cloud.update(func() {
+		delete(env.cloud.keypairs, "kube-key")
+		env.cloud.images = append(env.cloud.images, image.Response{ID: "image-2", Name: "CoreOS"})
+	})
+
+	out, ok := env.run(30*time.Second, mockPassword, Validate)
+	if ok {
+		t.Fatalf("validate succeeded with a missing keypair:\n%s", out)
+	}
+	for _, want := range []string{
+		"cluster.yml:3: cluster.sshkey: keypair kube-key not found",
+		"templates.master.image-name: image CoreOS is ambiguous, use the ID: image-1 (CoreOS), image-2 (CoreOS)",
+		"templates.node.image-name: image CoreOS is ambiguous",
+		"3 problems found",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+}
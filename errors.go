@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	misc "git.openstack.org/stackforge/golang-client.git/misc"
+)
+
+// resourceError is returned by the tasks when an operation on a resource
+// fails. Status is the HTTP status code when the error was returned by an
+// OpenStack API, zero otherwise.
+type resourceError struct {
+	Op       string
+	Resource string
+	Status   int
+	Err      error
+}
+
+func (e *resourceError) Error() string {
+
+	msg := e.Op
+	if e.Resource != "" {
+		msg += " " + e.Resource
+	}
+	if e.Status != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.Status)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *resourceError) Unwrap() error {
+	return e.Err
+}
+
+func newResourceError(op string, resource string, err error) error {
+	return &resourceError{Op: op, Resource: resource, Status: httpStatusCode(err), Err: err}
+}
+
+// httpStatusCode returns the HTTP status code carried by err, or zero
+func httpStatusCode(err error) int {
+
+	switch e := err.(type) {
+	case misc.HTTPStatus:
+		return e.StatusCode
+	case *misc.HTTPStatus:
+		return e.StatusCode
+	case *resourceError:
+		return e.Status
+	}
+	return 0
+}
+
+func noErrorOn404(err error) error {
+
+	if httpStatusCode(err) == 404 {
+		return nil
+	}
+	return err
+}
+
+// exitOnError logs the error and terminates the process. It is only called
+// by the command actions, the tasks return their errors.
+func exitOnError(err error) {
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+	}
+}
+
+// nodeError is the failure of a single node
+type nodeError struct {
+	Name string
+	Err  error
+}
+
+// nodeErrors collects the failures of the nodes provisioned concurrently,
+// its message is the summary printed at the end of a run.
+type nodeErrors []nodeError
+
+func (e nodeErrors) Error() string {
+
+	msg := "1 node failed"
+	if len(e) != 1 {
+		msg = fmt.Sprintf("%d nodes failed", len(e))
+	}
+	for _, v := range e {
+		msg += fmt.Sprintf("\n%-20s - %s %s", "", v.Name, v.Err.Error())
+	}
+	return msg
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	misc "git.openstack.org/stackforge/golang-client.git/misc"
+)
+
+func TestResourceError(t *testing.T) {
+
+	err := newResourceError("create port", "kube-node-1", misc.HTTPStatus{StatusCode: 409, Message: "IP address in use"})
+
+	if got := httpStatusCode(err); got != 409 {
+		t.Errorf("expected status 409, got %d", got)
+	}
+	if got, want := err.Error(), "create port kube-node-1 (HTTP 409): IP address in use"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	err = newResourceError("read config", "kubesetup.yml", fmt.Errorf("no such file"))
+	if got, want := err.Error(), "read config kubesetup.yml: no such file"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestNoErrorOn404(t *testing.T) {
+
+	if err := noErrorOn404(misc.HTTPStatus{StatusCode: 404}); err != nil {
+		t.Errorf("expected 404 to be ignored, got %v", err)
+	}
+	if err := noErrorOn404(misc.HTTPStatus{StatusCode: 500}); err == nil {
+		t.Errorf("expected 500 to be returned")
+	}
+	if err := noErrorOn404(fmt.Errorf("connection refused")); err == nil {
+		t.Errorf("expected a non HTTP error to be returned")
+	}
+}
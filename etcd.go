@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/parnurzeal/gorequest"
+)
+
+// etcdMember is a worker that runs a full etcd member besides the master
+type etcdMember struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// etcdBootstrap is how etcd on a host finds the cluster: the discovery URL
+// or, without one, the static members besides the master
+type etcdBootstrap struct {
+	Discovery string
+	Members   []etcdMember
+}
+
+// stateEtcdBootstrap returns the bootstrap the cluster was installed with
+func stateEtcdBootstrap() etcdBootstrap {
+	return etcdBootstrap{Discovery: state.DiscoveryURL, Members: state.EtcdMembers}
+}
+
+// initialCluster returns the static initial-cluster setting, the master
+// followed by the members
+func (b etcdBootstrap) initialCluster(masterIP string) string {
+
+	peers := []string{"master=" + etcdPeerURL(masterIP)}
+	for _, m := range b.Members {
+		peers = append(peers, m.Name+"="+etcdPeerURL(m.IP))
+	}
+	return strings.Join(peers, ",")
+}
+
+// isMember tells whether a worker runs an etcd member
+func (b etcdBootstrap) isMember(name string) bool {
+
+	for _, m := range b.Members {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func etcdPeerURL(ip string) string {
+	return "http://" + ip + ":2380"
+}
+
+// checkEtcdSection checks the discovery mode and that the members are
+// distinct workers, which only static mode supports
+func checkEtcdSection(s etcdSection, nodes map[string]configNode) error {
+
+	if _, err := etcdDiscoveryService(s); err != nil {
+		return err
+	}
+	if len(s.Members) > 0 && s.Discovery != EtcdDiscoveryStatic {
+		return fmt.Errorf("members require discovery %s", EtcdDiscoveryStatic)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range s.Members {
+		node, ok := nodes[v]
+		switch {
+		case !ok:
+			return fmt.Errorf("member %s is not a host of the cluster", v)
+		case node.IsMaster:
+			return fmt.Errorf("member %s is the master, which is always a member", v)
+		case seen[v]:
+			return fmt.Errorf("member %s is listed twice", v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+// etcdDiscoveryService returns the service discovery tokens are requested
+// from, empty in static mode
+func etcdDiscoveryService(s etcdSection) (string, error) {
+
+	switch s.Discovery {
+	case EtcdDiscoveryStatic:
+		return "", nil
+	case EtcdDiscoveryPublic:
+		return discoveryURL, nil
+	}
+
+	if !isHTTPURL(s.Discovery) {
+		return "", fmt.Errorf("discovery %q is not %s, %s or an http(s) URL", s.Discovery, EtcdDiscoveryStatic, EtcdDiscoveryPublic)
+	}
+	return s.Discovery, nil
+}
+
+// discoveryURLTask gets the etcd discovery URL the cloud-configs are
+// rendered with, static mode needs none. A running cluster keeps the
+// bootstrap it was installed with, nodes joining it must use the same.
+func discoveryURLTask(c *cli.Context) error {
+
+	s := config.etcd()
+	if err := checkEtcdSection(s, config.Nodes); err != nil {
+		return newResourceError("configure etcd", config.Name, err)
+	}
+
+	if len(servers) > 0 {
+		return nil
+	}
+
+	service, _ := etcdDiscoveryService(s)
+	if service == "" {
+		log.Printf("%-20s - %s\n", "etcd bootstrap", EtcdDiscoveryStatic)
+		if state.DiscoveryURL == "" {
+			return nil
+		}
+		state.DiscoveryURL = ""
+		return saveState()
+	}
+
+	log.Printf("%-20s - %s\n", "etcd bootstrap", service)
+
+	// the master is the only member, the workers run proxies
+	discovery, err := getDiscoveryKey(service, 1)
+	if err != nil {
+		return newResourceError("get discovery key", service, err)
+	}
+
+	state.DiscoveryURL = discovery
+	return saveState()
+}
+
+// etcdMembers resolves the addresses of the static etcd members and
+// records them in the state. The ports of members without one are created
+// ahead of the master, whose cloud-config lists their addresses.
+func etcdMembers() ([]etcdMember, error) {
+
+	var members []etcdMember
+
+	if state.DiscoveryURL == "" {
+		for _, name := range config.etcd().Members {
+			ip, err := etcdMemberIP(name)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, etcdMember{Name: name, IP: ip})
+		}
+	}
+
+	clusterMutex.Lock()
+	state.EtcdMembers = members
+	err := writeState()
+	clusterMutex.Unlock()
+
+	return members, err
+}
+
+// etcdMemberIP returns the address of a member, creating its port when
+// neither a port nor a server exists
+func etcdMemberIP(name string) (string, error) {
+
+	if port, ok := findPort(name); ok {
+		return portIP(port), nil
+	}
+	if server, ok := findServer(name); ok {
+		fixedIP, _ := serverAddresses(server)
+		return fixedIP, nil
+	}
+
+	port, err := createPort(name, nodeConfig(name))
+	if err != nil {
+		return "", err
+	}
+	ports = append(ports, port)
+
+	if portIP(port) == "" {
+		return "", newResourceError("get port address", name, fmt.Errorf("port %s has no fixed IP", port.ID))
+	}
+	return portIP(port), nil
+}
+
+/*
+CoreOS Cluster Discovery ID
+See https://coreos.com/docs/cluster-management/setup/cluster-discovery/
+for details
+*/
+func getDiscoveryKey(service string, size int) (string, error) {
+
+	req := gorequest.New()
+
+	resp, body, errs := req.Get(service).
+		Query("size="+strconv.Itoa(size)).
+		Set("Content-Type", "text/plain").
+		Set("Accept", "text/plain").
+		End()
+
+	if errs != nil {
+		return "", errs[len(errs)-1]
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s returned %s", service, resp.Status)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	misc "git.openstack.org/stackforge/golang-client.git/misc"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+)
+
+// fakeProvider is an in-memory Provider. Servers start in BUILD and turn
+// ACTIVE the first time their details are requested.
+type fakeProvider struct {
+	mutex sync.Mutex
+
+	nextID      int
+	keypairs    map[string]compute.KeyPairResponse
+	networks    []network.Response
+	subnets     []network.SubnetResponse
+	ports       map[string]network.PortResponse
+	groups      map[string]network.SecurityGroup
+	routers     map[string]network.Router
+	servers     map[string]compute.ServerDetail
+	faults      map[string]string
+	flavors     []compute.Flavor
+	zones       []compute.AvailabilityZone
+	limits      compute.Limits
+	floatingIPs map[string]compute.FloatingIP
+	images      []image.Response
+
+	// lookupErr fails the image, flavor and availability zone lookups
+	lookupErr error
+}
+
+func newFakeProvider() *fakeProvider {
+
+	return &fakeProvider{
+		keypairs: map[string]compute.KeyPairResponse{
+			"kube-key": {Name: "kube-key", PublicKey: "ssh-rsa AAAA kube"},
+		},
+		networks: []network.Response{
+			{ID: "net-1", Name: "kube-net", Subnets: []string{"subnet-1"}},
+			{ID: "ext-net-1", Name: "ext-net", Status: "ACTIVE", Subnets: []string{"ext-subnet-1"}, RouterExternal: true, AdminStateUp: true},
+		},
+		subnets: []network.SubnetResponse{
+			{
+				ID:              "subnet-1",
+				NetworkID:       "net-1",
+				CIDR:            "192.168.1.0/24",
+				AllocationPools: []network.AllocationPool{{Start: "192.168.1.2", End: "192.168.1.254"}},
+			},
+		},
+		ports:   make(map[string]network.PortResponse),
+		groups:  make(map[string]network.SecurityGroup),
+		routers: make(map[string]network.Router),
+		servers: make(map[string]compute.ServerDetail),
+		faults:  make(map[string]string),
+		flavors: []compute.Flavor{
+			{ID: "101", Name: "standard.small"},
+			{ID: "102", Name: "standard.medium"},
+		},
+		zones:       []compute.AvailabilityZone{{ZoneName: "az2"}},
+		limits:      testLimits(),
+		floatingIPs: make(map[string]compute.FloatingIP),
+		images:      []image.Response{{ID: "image-1", Name: "CoreOS"}},
+	}
+}
+
+func (p *fakeProvider) newID(prefix string) string {
+	p.nextID++
+	return fmt.Sprintf("%s-%d", prefix, p.nextID)
+}
+
+func notFound(kind string, id string) error {
+	return misc.HTTPStatus{StatusCode: 404, Message: fmt.Sprintf("%s %s not found", kind, id)}
+}
+
+func (p *fakeProvider) KeyPair(name string) (compute.KeyPairResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	k, ok := p.keypairs[name]
+	if !ok {
+		return k, notFound("keypair", name)
+	}
+	return k, nil
+}
+
+func (p *fakeProvider) QueryNetworks(q network.QueryParameters) ([]network.Response, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []network.Response
+	for _, v := range p.networks {
+		if (q.Name == "" || v.Name == q.Name) && (!q.RouterExternal || v.RouterExternal) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) Network(id string) (network.Response, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, v := range p.networks {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+	return network.Response{}, notFound("network", id)
+}
+
+func (p *fakeProvider) Subnets() ([]network.SubnetResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]network.SubnetResponse(nil), p.subnets...), nil
+}
+
+func (p *fakeProvider) CreateNetwork(parameters networkParameters) (network.Response, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := network.Response{ID: p.newID("neutron-net"), Name: parameters.Name, Status: "ACTIVE", AdminStateUp: parameters.AdminStateUp}
+	p.networks = append(p.networks, n)
+	return n, nil
+}
+
+func (p *fakeProvider) DeleteNetwork(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, v := range p.ports {
+		if v.NetworkID == id {
+			return misc.HTTPStatus{StatusCode: 409, Message: "network " + id + " in use"}
+		}
+	}
+	for i, v := range p.networks {
+		if v.ID == id {
+			p.networks = append(p.networks[:i], p.networks[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("network", id)
+}
+
+func (p *fakeProvider) CreateSubnet(parameters subnetParameters) (network.SubnetResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, v := range p.networks {
+		if v.ID == parameters.NetworkID {
+			s := newSubnet(p.newID("neutron-subnet"), parameters)
+			p.subnets = append(p.subnets, s)
+			p.networks[i].Subnets = append(v.Subnets, s.ID)
+			return s, nil
+		}
+	}
+	return network.SubnetResponse{}, notFound("network", parameters.NetworkID)
+}
+
+func (p *fakeProvider) DeleteSubnet(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if subnetInUse(id, p.ports) {
+		return misc.HTTPStatus{StatusCode: 409, Message: "subnet " + id + " in use"}
+	}
+	for i, v := range p.subnets {
+		if v.ID == id {
+			p.subnets = append(p.subnets[:i], p.subnets[i+1:]...)
+			for j, n := range p.networks {
+				p.networks[j].Subnets = others(n.Subnets, id)
+			}
+			return nil
+		}
+	}
+	return notFound("subnet", id)
+}
+
+func (p *fakeProvider) CreateRouter(externalNetworkID string) (network.Router, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, v := range p.networks {
+		if v.ID == externalNetworkID && v.RouterExternal {
+			r := network.Router{ID: p.newID("router"), Status: "ACTIVE", AdminStateUp: true, ExternalGatewayInfo: network.ExternalGatewayInfo{NetworkID: v.ID}}
+			p.routers[r.ID] = r
+			return r, nil
+		}
+	}
+	return network.Router{}, notFound("external network", externalNetworkID)
+}
+
+func (p *fakeProvider) DeleteRouter(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.routers[id]; !ok {
+		return notFound("router", id)
+	}
+	if routerInUse(id, p.ports) {
+		return misc.HTTPStatus{StatusCode: 409, Message: "router " + id + " still has ports"}
+	}
+	delete(p.routers, id)
+	return nil
+}
+
+func (p *fakeProvider) AddRouterInterface(routerID string, subnetID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.routers[routerID]; !ok {
+		return notFound("router", routerID)
+	}
+	for _, v := range p.subnets {
+		if v.ID == subnetID {
+			port := routerInterfacePort(p.newID("port"), routerID, v)
+			p.ports[port.ID] = port
+			return nil
+		}
+	}
+	return notFound("subnet", subnetID)
+}
+
+func (p *fakeProvider) RemoveRouterInterface(routerID string, subnetID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for k, v := range p.ports {
+		if v.DeviceID == routerID && len(v.FixedIPs) > 0 && v.FixedIPs[0].SubnetID == subnetID {
+			delete(p.ports, k)
+			return nil
+		}
+	}
+	return notFound("router interface", routerID)
+}
+
+func (p *fakeProvider) Ports() ([]network.PortResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []network.PortResponse
+	for _, v := range p.ports {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) CreatePort(parameters portParameters) (network.PortResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, v := range p.ports {
+		for _, ip := range v.FixedIPs {
+			for _, requested := range parameters.FixedIPs {
+				if ip.IPAddress == requested.IPAddress {
+					return network.PortResponse{}, misc.HTTPStatus{StatusCode: 409, Message: "IP address in use " + ip.IPAddress}
+				}
+			}
+		}
+	}
+
+	fixedIPs, ok := assignAddresses(parameters.FixedIPs, p.subnets, p.ports)
+	if !ok {
+		return network.PortResponse{}, misc.HTTPStatus{StatusCode: 409, Message: "No more IP addresses available"}
+	}
+
+	port := network.PortResponse{
+		ID:             p.newID("port"),
+		Name:           parameters.Name,
+		Status:         "DOWN",
+		AdminStateUp:   parameters.AdminStateUp,
+		NetworkID:      parameters.NetworkID,
+		FixedIPs:       fixedIPs,
+		SecurityGroups: parameters.SecurityGroups,
+	}
+	p.ports[port.ID] = port
+	return port, nil
+}
+
+func (p *fakeProvider) DeletePort(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.ports[id]; !ok {
+		return notFound("port", id)
+	}
+	delete(p.ports, id)
+	return nil
+}
+
+func (p *fakeProvider) SecurityGroups() ([]network.SecurityGroup, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []network.SecurityGroup
+	for _, v := range p.groups {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) CreateSecurityGroup(parameters network.CreateSecurityGroupParameters) (network.SecurityGroup, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	group := network.SecurityGroup{ID: p.newID("secgroup"), Name: parameters.Name, Description: parameters.Description}
+	p.groups[group.ID] = group
+	return group, nil
+}
+
+func (p *fakeProvider) DeleteSecurityGroup(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.groups[id]; !ok {
+		return notFound("security group", id)
+	}
+	if securityGroupInUse(id, p.ports) {
+		return misc.HTTPStatus{StatusCode: 409, Message: "security group " + id + " in use"}
+	}
+	delete(p.groups, id)
+	return nil
+}
+
+func (p *fakeProvider) CreateSecurityGroupRule(parameters network.CreateSecurityGroupRuleParameters) (network.SecurityGroupRule, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	group, ok := p.groups[parameters.SecurityGroupID]
+	if !ok {
+		return network.SecurityGroupRule{}, notFound("security group", parameters.SecurityGroupID)
+	}
+	rule := newSecurityGroupRule(p.newID("rule"), parameters)
+	group.SecurityGroupRules = append(group.SecurityGroupRules, rule)
+	p.groups[group.ID] = group
+	return rule, nil
+}
+
+func (p *fakeProvider) ServerDetails() ([]compute.ServerDetail, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []compute.ServerDetail
+	for _, v := range p.servers {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) ServerDetail(id string) (compute.ServerDetail, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	server, ok := p.servers[id]
+	if !ok {
+		return server, notFound("server", id)
+	}
+
+	result := server
+	if server.Status == "BUILD" {
+		server.Status = "ACTIVE"
+		p.servers[id] = server
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) ServerFault(id string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.servers[id]; !ok {
+		return "", notFound("server", id)
+	}
+	return p.faults[id], nil
+}
+
+func (p *fakeProvider) CreateServer(parameters compute.ServerCreationParameters) (compute.CreateServerResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	server := compute.ServerDetail{
+		ID:        p.newID("server"),
+		Name:      parameters.Name,
+		Status:    "BUILD",
+		Flavor:    compute.Flavor{ID: parameters.FlavorRef},
+		Image:     compute.ImageWrapper{Image: &compute.Image{ID: parameters.ImageRef}},
+		Addresses: make(map[string][]compute.Address),
+		MetaData:  make(map[string]string),
+		KeyName:   parameters.KeyPairName,
+	}
+	for k, v := range parameters.Metadata {
+		server.MetaData[k] = v
+	}
+
+	for _, n := range parameters.Networks {
+		port, ok := p.ports[n.Port]
+		if !ok {
+			return compute.CreateServerResponse{}, notFound("port", n.Port)
+		}
+		port.DeviceID = server.ID
+		port.DeviceOwner = "compute:nova"
+		if parameters.AvailabilityZone != nil {
+			port.DeviceOwner = "compute:" + *parameters.AvailabilityZone
+		}
+		port.Status = "ACTIVE"
+		p.ports[port.ID] = port
+
+		for _, ip := range port.FixedIPs {
+			server.Addresses[port.NetworkID] = append(server.Addresses[port.NetworkID], compute.Address{Addr: ip.IPAddress, Version: 4, Type: "fixed"})
+		}
+	}
+
+	p.servers[server.ID] = server
+	return compute.CreateServerResponse{ID: server.ID, AdminPass: "secret"}, nil
+}
+
+func (p *fakeProvider) DeleteServer(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.servers[id]; !ok {
+		return notFound("server", id)
+	}
+	delete(p.servers, id)
+
+	for k, v := range p.floatingIPs {
+		if v.InstanceID == id {
+			v.InstanceID = ""
+			v.FixedIP = ""
+			p.floatingIPs[k] = v
+		}
+	}
+	return nil
+}
+
+func (p *fakeProvider) SetServerMetadata(id string, metadata map[string]string) (map[string]string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	server, ok := p.servers[id]
+	if !ok {
+		return nil, notFound("server", id)
+	}
+	for k, v := range metadata {
+		server.MetaData[k] = v
+	}
+	return server.MetaData, nil
+}
+
+func (p *fakeProvider) ServerAction(id string, action string, key string, value string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	server, ok := p.servers[id]
+	if !ok {
+		return notFound("server", id)
+	}
+
+	switch action {
+	case "addFloatingIp":
+		for k, v := range p.floatingIPs {
+			if v.IP != value {
+				continue
+			}
+			if v.InstanceID != "" {
+				return misc.HTTPStatus{StatusCode: 400, Message: "floating IP in use " + value}
+			}
+			v.InstanceID = id
+			p.floatingIPs[k] = v
+			for n := range server.Addresses {
+				server.Addresses[n] = append(server.Addresses[n], compute.Address{Addr: value, Version: 4, Type: "floating"})
+				break
+			}
+			return nil
+		}
+		return notFound("floating IP", value)
+	case "removeFloatingIp":
+		for k, v := range p.floatingIPs {
+			if v.IP == value && v.InstanceID == id {
+				v.InstanceID = ""
+				p.floatingIPs[k] = v
+			}
+		}
+		for n, addresses := range server.Addresses {
+			var kept []compute.Address
+			for _, a := range addresses {
+				if a.Addr != value {
+					kept = append(kept, a)
+				}
+			}
+			server.Addresses[n] = kept
+		}
+		return nil
+	}
+	return misc.HTTPStatus{StatusCode: 400, Message: "unsupported action " + action}
+}
+
+func (p *fakeProvider) Flavors() ([]compute.Flavor, error) {
+	return p.flavors, p.lookupErr
+}
+
+func (p *fakeProvider) FlavorsDetail() ([]compute.FlavorDetail, error) {
+	return testFlavorsDetail(p.flavors), nil
+}
+
+// Limits reports the servers and floating IPs of the fake as used
+func (p *fakeProvider) Limits() (compute.Limits, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	limits := p.limits
+	details := testFlavorsDetail(p.flavors)
+	for _, v := range p.servers {
+		for _, f := range details {
+			if f.ID == v.Flavor.ID {
+				limits.AbsoluteLimits.TotalCoresUsed += int(f.VCPUs.Int64)
+				limits.AbsoluteLimits.TotalRAMUsed += int(f.RAM.Int64)
+			}
+		}
+		limits.AbsoluteLimits.TotalInstancesUsed++
+	}
+	limits.AbsoluteLimits.TotalFloatingIpsUsed += len(p.floatingIPs)
+	return limits, nil
+}
+
+// assignAddresses fills in the fixed IPs requested without an address with
+// the first address of the allocation pools of their subnet no port uses,
+// the way Neutron's DHCP does. It returns false when a pool is exhausted.
+func assignAddresses(requested []fixedIP, subnets []network.SubnetResponse, ports map[string]network.PortResponse) ([]network.FixedIP, bool) {
+
+	used := make(map[string]bool)
+	for _, v := range ports {
+		for _, ip := range v.FixedIPs {
+			used[ip.IPAddress] = true
+		}
+	}
+
+	var fixedIPs []network.FixedIP
+	for _, v := range requested {
+		if v.IPAddress != "" {
+			fixedIPs = append(fixedIPs, network.FixedIP{SubnetID: v.SubnetID, IPAddress: v.IPAddress})
+			continue
+		}
+
+		address := ""
+		for _, subnet := range subnets {
+			if subnet.ID != v.SubnetID {
+				continue
+			}
+			for _, pool := range subnet.AllocationPools {
+				end := net.ParseIP(pool.End).To4()
+				for ip := net.ParseIP(pool.Start).To4(); address == "" && bytes.Compare(ip, end) <= 0; ip = nextIP(ip) {
+					if !used[ip.String()] {
+						address = ip.String()
+					}
+				}
+			}
+		}
+		if address == "" {
+			return nil, false
+		}
+		used[address] = true
+		fixedIPs = append(fixedIPs, network.FixedIP{SubnetID: v.SubnetID, IPAddress: address})
+	}
+	return fixedIPs, true
+}
+
+// newSubnet returns the subnet Neutron creates for parameters. The gateway
+// is the first address of the CIDR, the allocation pool defaults to the
+// addresses following it.
+func newSubnet(id string, parameters subnetParameters) network.SubnetResponse {
+
+	_, cidr, _ := net.ParseCIDR(parameters.CIDR)
+	gateway := nextIP(cidr.IP.To4())
+
+	pools := parameters.AllocationPools
+	if len(pools) == 0 {
+		last := make(net.IP, len(gateway))
+		for i := range last {
+			last[i] = cidr.IP.To4()[i] | ^cidr.Mask[i]
+		}
+		last[len(last)-1]--
+		pools = []network.AllocationPool{{Start: nextIP(gateway).String(), End: last.String()}}
+	}
+
+	return network.SubnetResponse{
+		ID:              id,
+		Name:            parameters.Name,
+		NetworkID:       parameters.NetworkID,
+		IPVersion:       parameters.IPVersion,
+		CIDR:            cidr.String(),
+		GatewayIP:       gateway.String(),
+		AllocationPools: pools,
+		EnableDHCP:      true,
+	}
+}
+
+// routerInterfacePort returns the port Neutron creates on the gateway
+// address of a subnet attached to a router
+func routerInterfacePort(id string, routerID string, s network.SubnetResponse) network.PortResponse {
+	return network.PortResponse{
+		ID:          id,
+		Status:      "ACTIVE",
+		NetworkID:   s.NetworkID,
+		DeviceID:    routerID,
+		DeviceOwner: "network:router_interface",
+		FixedIPs:    []network.FixedIP{{SubnetID: s.ID, IPAddress: s.GatewayIP}},
+	}
+}
+
+func subnetInUse(id string, ports map[string]network.PortResponse) bool {
+
+	for _, v := range ports {
+		for _, ip := range v.FixedIPs {
+			if ip.SubnetID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func routerInUse(id string, ports map[string]network.PortResponse) bool {
+
+	for _, v := range ports {
+		if v.DeviceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// newSecurityGroupRule returns the rule Neutron creates for parameters
+func newSecurityGroupRule(id string, parameters network.CreateSecurityGroupRuleParameters) network.SecurityGroupRule {
+	return network.SecurityGroupRule{
+		ID:              id,
+		Direction:       parameters.Direction,
+		IPProtocol:      parameters.IPProtocol,
+		EtherType:       "IPv4",
+		PortRangeMin:    parameters.PortRangeMin,
+		PortRangeMax:    parameters.PortRangeMax,
+		SecurityGroupID: parameters.SecurityGroupID,
+		RemoteGroupID:   parameters.RemoteGroupID,
+		RemoteIPPrefix:  parameters.RemoteIPPrefix,
+	}
+}
+
+// securityGroupInUse tells whether a port is in the security group, which
+// Neutron then refuses to delete
+func securityGroupInUse(id string, ports map[string]network.PortResponse) bool {
+
+	for _, v := range ports {
+		for _, g := range v.SecurityGroups {
+			if g == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testLimits returns the absolute limits of an empty test tenant
+func testLimits() compute.Limits {
+	return compute.Limits{AbsoluteLimits: compute.AbsoluteLimits{
+		MaxTotalInstances:   10,
+		MaxTotalCores:       20,
+		MaxTotalRAMSize:     51200,
+		MaxTotalFloatingIps: 5,
+	}}
+}
+
+// testFlavorsDetail sizes the test flavors, small has 1 vCPU and 2 GB of
+// RAM, every other flavor twice as much
+func testFlavorsDetail(flavors []compute.Flavor) []compute.FlavorDetail {
+
+	var result []compute.FlavorDetail
+	for _, v := range flavors {
+		cores, ram := int64(2), int64(4096)
+		if v.Name == "standard.small" {
+			cores, ram = 1, 2048
+		}
+		result = append(result, compute.FlavorDetail{
+			ID:    v.ID,
+			Name:  v.Name,
+			VCPUs: misc.Int64Wrapper{Int64: cores, Valid: true},
+			RAM:   misc.Int64Wrapper{Int64: ram, Valid: true},
+		})
+	}
+	return result
+}
+
+func (p *fakeProvider) AvailabilityZones() ([]compute.AvailabilityZone, error) {
+	return p.zones, p.lookupErr
+}
+
+func (p *fakeProvider) FloatingIPs() ([]compute.FloatingIP, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []compute.FloatingIP
+	for _, v := range p.floatingIPs {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (p *fakeProvider) CreateFloatingIP(pool string) (compute.FloatingIP, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if pool == "" {
+		pool = "Ext-Net"
+	}
+
+	ip := net.IPv4(15, 125, 106, byte(100+len(p.floatingIPs))).String()
+	fip := compute.FloatingIP{ID: p.newID("fip"), IP: ip, Pool: pool}
+	p.floatingIPs[fip.ID] = fip
+	return fip, nil
+}
+
+func (p *fakeProvider) DeleteFloatingIP(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	fip, ok := p.floatingIPs[id]
+	if !ok {
+		return notFound("floating IP", id)
+	}
+	delete(p.floatingIPs, id)
+
+	for k, v := range p.servers {
+		for n, addresses := range v.Addresses {
+			var kept []compute.Address
+			for _, a := range addresses {
+				if a.Addr != fip.IP {
+					kept = append(kept, a)
+				}
+			}
+			v.Addresses[n] = kept
+		}
+		p.servers[k] = v
+	}
+	return nil
+}
+
+func (p *fakeProvider) Images() ([]image.Response, error) {
+	return p.images, p.lookupErr
+}
+
+// addForeignServer adds a server that does not belong to any cluster, like
+// a colleague's VM in a shared tenant.
+func (p *fakeProvider) addForeignServer(name string, ip string) compute.ServerDetail {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	port := network.PortResponse{
+		ID:        p.newID("port"),
+		Name:      name,
+		Status:    "ACTIVE",
+		NetworkID: "net-1",
+		FixedIPs:  []network.FixedIP{{SubnetID: "subnet-1", IPAddress: ip}},
+	}
+
+	server := compute.ServerDetail{
+		ID:        p.newID("server"),
+		Name:      name,
+		Status:    "ACTIVE",
+		Flavor:    compute.Flavor{ID: "101"},
+		Image:     compute.ImageWrapper{Image: &compute.Image{ID: "image-1"}},
+		Addresses: map[string][]compute.Address{"kube-net": {{Addr: ip, Version: 4, Type: "fixed"}}},
+		MetaData:  make(map[string]string),
+	}
+
+	port.DeviceID = server.ID
+	p.ports[port.ID] = port
+	p.servers[server.ID] = server
+	return server
+}
+
+func (p *fakeProvider) serversNamed(name string) []compute.ServerDetail {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []compute.ServerDetail
+	for _, v := range p.servers {
+		if v.Name == name {
+			result = append(result, v)
+		}
+	}
+	return result
+}
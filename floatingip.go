@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+// assignIPAddressTask gives the master, and with floating-ip.workers every
+// worker, a floating IP unless its server has one. The master gets the
+// configured address, any other node the address recorded in the state or
+// a new one allocated from the pool. Unassigned addresses of the tenant are
+// never taken, they may be kept by someone else.
+func assignIPAddressTask(c *cli.Context) error {
+
+	floatingIPs, err := provider.FloatingIPs()
+	if err != nil {
+		return newResourceError("get floating IPs", "", err)
+	}
+
+	for _, k := range config.OrderedNodeKeys {
+
+		v := config.Nodes[k]
+
+		if !needsFloatingIP(v) {
+			continue
+		}
+
+		if v.FloatingIP != "" {
+
+			log.Printf("%-20s - %s %s\n", "public IP exists", k, v.FloatingIP)
+
+			for _, fp := range floatingIPs {
+				if fp.IP == v.FloatingIP && state.Nodes[k].FloatingIPID != fp.ID {
+					err := updateNode(k, func(n *nodeState) {
+						n.FloatingIPID = fp.ID
+						n.FloatingIP = fp.IP
+						n.FloatingIPAllocated = false
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if err := assignFloatingIP(k, v, floatingIPs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// assignFloatingIP associates the server of a node with the address it is
+// given by nodeFloatingIP and records the address in the state
+func assignFloatingIP(name string, node configNode, floatingIPs []compute.FloatingIP) error {
+
+	fp, allocated, err := nodeFloatingIP(name, node, floatingIPs)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "associate IP", name, fp.IP)
+
+	err = provider.ServerAction(node.ServerID, "addFloatingIp", "address", fp.IP)
+	if err != nil {
+		return newResourceError("associate floating IP", fp.IP, err)
+	}
+	created.record(journalFloatingIPAssociation, node.ServerID, fp.IP)
+
+	err = updateNode(name, func(n *nodeState) {
+		n.FloatingIPID = fp.ID
+		n.FloatingIP = fp.IP
+		n.FloatingIPAllocated = allocated
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "associate IP", name, "COMPLETED")
+
+	return nil
+}
+
+// reserveFloatingIP records the address the master will be associated with
+// in the state before its server is created, so the certificate of the API
+// server covers it. assignIPAddressTask associates it later.
+func reserveFloatingIP(name string) error {
+
+	node := nodeConfig(name)
+	if server, ok := findServer(name); ok {
+		if _, floatingIP := serverAddresses(server); floatingIP != "" {
+			return nil
+		}
+		node.ServerID = server.ID
+	}
+
+	floatingIPs, err := provider.FloatingIPs()
+	if err != nil {
+		return newResourceError("get floating IPs", "", err)
+	}
+
+	fp, allocated, err := nodeFloatingIP(name, node, floatingIPs)
+	if err != nil {
+		return err
+	}
+
+	return updateNode(name, func(n *nodeState) {
+		n.FloatingIPID = fp.ID
+		n.FloatingIP = fp.IP
+		n.FloatingIPAllocated = allocated
+	})
+}
+
+// needsFloatingIP tells whether a node gets a public address
+func needsFloatingIP(node configNode) bool {
+	return node.IsMaster || config.floatingIP().Workers
+}
+
+// nodeFloatingIP returns the address a node without one is associated
+// with and whether the tool allocated it
+func nodeFloatingIP(name string, node configNode, floatingIPs []compute.FloatingIP) (compute.FloatingIP, bool, error) {
+
+	if address := config.floatingIP().Address; node.IsMaster && address != "" {
+		fp, err := configuredFloatingIP(address, node.ServerID, floatingIPs)
+		return fp, false, err
+	}
+
+	// an address allocated for the node before, for example for a server
+	// that was recreated
+	recorded := state.Nodes[name]
+	for _, fp := range floatingIPs {
+		if fp.ID == recorded.FloatingIPID && fp.InstanceID == "" {
+			log.Printf("%-20s - %s %s\n", "reuse public IP", name, fp.IP)
+			return fp, recorded.FloatingIPAllocated, nil
+		}
+	}
+
+	// an address kept when a node of the cluster was removed
+	if fp, ok := takeKeptFloatingIP(floatingIPs); ok {
+		log.Printf("%-20s - %s %s\n", "reuse public IP", name, fp.IP)
+		return fp, true, nil
+	}
+
+	pool := config.floatingIP().Pool
+
+	log.Printf("%-20s - %s %s\n", "create public IP", name, pool)
+
+	fp, err := provider.CreateFloatingIP(pool)
+	if err != nil {
+		return fp, false, newResourceError("create floating IP", pool, err)
+	}
+	created.record(journalFloatingIP, fp.ID, fp.IP)
+
+	log.Printf("%-20s - %s %s %s\n", "create public IP", name, fp.IP, "COMPLETED")
+
+	return fp, true, nil
+}
+
+// configuredFloatingIP returns the floating IP of the tenant with the
+// configured address, which must not be associated with another server
+func configuredFloatingIP(address string, serverID string, floatingIPs []compute.FloatingIP) (compute.FloatingIP, error) {
+
+	for _, fp := range floatingIPs {
+		if fp.IP != address {
+			continue
+		}
+		if fp.InstanceID != "" && fp.InstanceID != serverID {
+			return fp, newResourceError("get floating IP", address, fmt.Errorf("associated with server %s", fp.InstanceID))
+		}
+		return fp, nil
+	}
+	return compute.FloatingIP{}, newResourceError("get floating IP", address, fmt.Errorf("not allocated to the tenant"))
+}
+
+// releaseFloatingIP releases the address of a node when the tool allocated
+// it and floating-ip.release is set, otherwise the address is kept in the
+// state for the next node that needs one
+func releaseFloatingIP(name string, n nodeState) error {
+
+	if n.FloatingIPID == "" || !n.FloatingIPAllocated {
+		return nil
+	}
+
+	if !config.floatingIP().Release {
+		log.Printf("%-20s - %s %s\n", "keep public IP", name, n.FloatingIP)
+		keepFloatingIP(n)
+		return nil
+	}
+
+	log.Printf("%-20s - %s %s\n", "release public IP", name, n.FloatingIP)
+
+	if err := noErrorOn404(provider.DeleteFloatingIP(n.FloatingIPID)); err != nil {
+		return newResourceError("release floating IP", n.FloatingIP, err)
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "release public IP", name, n.FloatingIP, "COMPLETED")
+
+	return nil
+}
+
+// keepFloatingIP records an address the tool allocated for reuse
+func keepFloatingIP(n nodeState) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	for _, v := range state.KeptFloatingIPs {
+		if v.ID == n.FloatingIPID {
+			return
+		}
+	}
+	state.KeptFloatingIPs = append(state.KeptFloatingIPs, keptFloatingIP{ID: n.FloatingIPID, IP: n.FloatingIP})
+}
+
+// takeKeptFloatingIP removes the first kept address that is still
+// unassigned from the state and returns it. Kept addresses that are gone
+// or were taken by someone else are forgotten.
+func takeKeptFloatingIP(floatingIPs []compute.FloatingIP) (compute.FloatingIP, bool) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	byID := make(map[string]compute.FloatingIP)
+	for _, v := range floatingIPs {
+		byID[v.ID] = v
+	}
+
+	for len(state.KeptFloatingIPs) > 0 {
+		kept := state.KeptFloatingIPs[0]
+		state.KeptFloatingIPs = state.KeptFloatingIPs[1:]
+		if fp, ok := byID[kept.ID]; ok && fp.InstanceID == "" {
+			return fp, true
+		}
+	}
+	state.KeptFloatingIPs = nil
+	return compute.FloatingIP{}, false
+}
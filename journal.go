@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Kinds of resources recorded in the journal
+const (
+	journalPort                  = "port"
+	journalServer                = "server"
+	journalFloatingIP            = "floating IP"
+	journalFloatingIPAssociation = "floating IP association"
+	journalSecurityGroup         = "security group"
+	journalNetwork               = "network"
+	journalSubnet                = "subnet"
+	journalRouter                = "router"
+	journalRouterInterface       = "router interface"
+)
+
+// journalEntry is a single resource created by the running command. For a
+// floating IP association ID is the server and Name the address, for a
+// router interface ID is the router and Name the subnet.
+type journalEntry struct {
+	Kind string
+	ID   string
+	Name string
+}
+
+// journal records the resources created by the running command so they
+// can be deleted again when a later step fails.
+type journal struct {
+	entries []journalEntry
+}
+
+// created is the journal of the running command
+var created journal
+
+func (j *journal) record(kind string, id string, name string) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	j.entries = append(j.entries, journalEntry{Kind: kind, ID: id, Name: name})
+}
+
+// rollback undoes the recorded resources in reverse order of creation. It
+// keeps going when a resource cannot be removed and returns the failures.
+func (j *journal) rollback() error {
+
+	var failed []string
+
+	for i := len(j.entries) - 1; i >= 0; i-- {
+
+		v := j.entries[i]
+
+		log.Printf("%-20s - %s %s\n", "rollback", v.Kind, v.Name)
+
+		var err error
+		switch v.Kind {
+		case journalFloatingIPAssociation:
+			err = provider.ServerAction(v.ID, "removeFloatingIp", "address", v.Name)
+		case journalFloatingIP:
+			err = provider.DeleteFloatingIP(v.ID)
+		case journalServer:
+			err = provider.DeleteServer(v.ID)
+		case journalPort:
+			err = provider.DeletePort(v.ID)
+		case journalSecurityGroup:
+			err = provider.DeleteSecurityGroup(v.ID)
+		case journalRouterInterface:
+			err = provider.RemoveRouterInterface(v.ID, v.Name)
+		case journalRouter:
+			err = provider.DeleteRouter(v.ID)
+		case journalSubnet:
+			err = provider.DeleteSubnet(v.ID)
+		case journalNetwork:
+			err = provider.DeleteNetwork(v.ID)
+		}
+
+		if err = noErrorOn404(err); err != nil {
+			log.Printf("%-20s - %s %s %s\n", "rollback", v.Kind, v.Name, err.Error())
+			failed = append(failed, v.Kind+" "+v.Name)
+			continue
+		}
+
+		switch v.Kind {
+		case journalFloatingIPAssociation:
+			state.forget(v.Name)
+		case journalRouterInterface:
+			state.Network.RouterInterface = false
+		default:
+			state.forget(v.ID)
+		}
+
+		log.Printf("%-20s - %s %s %s\n", "rollback", v.Kind, v.Name, "COMPLETED")
+	}
+
+	j.entries = nil
+
+	if err := saveState(); err != nil {
+		failed = append(failed, "state "+stateFile)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Rollback incomplete, failed to remove %v", failed)
+	}
+	return nil
+}
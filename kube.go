@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// kubeAPI is a minimal client for the Kubernetes API server on the master,
+// just enough to cordon and drain a node before it is removed.
+type kubeAPI struct {
+	URL    string
+	Client *http.Client
+}
+
+type kubePodList struct {
+	Items []kubePod `json:"items"`
+}
+
+type kubePod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+// newKubeAPI returns a client of the API server on its secure port, which
+// authenticates as the admin user of the cluster.
+func newKubeAPI(host string) (kubeAPI, error) {
+
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		return kubeAPI{}, err
+	}
+	return kubeAPI{
+		URL: fmt.Sprintf("https://%s:%d", host, KubeAPISecurePort),
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Cordon marks the node unschedulable so no new pods land on it.
+func (k kubeAPI) Cordon(nodeName string) error {
+
+	var node map[string]interface{}
+	if err := k.do("GET", "/api/v1/nodes/"+nodeName, nil, &node); err != nil {
+		return err
+	}
+
+	spec, ok := node["spec"].(map[string]interface{})
+	if !ok {
+		spec = make(map[string]interface{})
+		node["spec"] = spec
+	}
+	spec["unschedulable"] = true
+
+	return k.do("PUT", "/api/v1/nodes/"+nodeName, node, nil)
+}
+
+// Drain cordons the node and deletes every pod scheduled on it, except for
+// mirror pods which are owned by the kubelet itself.
+func (k kubeAPI) Drain(nodeName string) error {
+
+	if err := k.Cordon(nodeName); err != nil {
+		return err
+	}
+
+	var pods kubePodList
+	if err := k.do("GET", "/api/v1/pods", nil, &pods); err != nil {
+		return err
+	}
+
+	for _, p := range pods.Items {
+
+		if p.Spec.NodeName != nodeName {
+			continue
+		}
+		if _, ok := p.Metadata.Annotations["kubernetes.io/config.mirror"]; ok {
+			continue
+		}
+
+		log.Printf("%-20s - %s %s/%s\n", "delete pod", nodeName, p.Metadata.Namespace, p.Metadata.Name)
+
+		err := k.do("DELETE", "/api/v1/namespaces/"+p.Metadata.Namespace+"/pods/"+p.Metadata.Name, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteNode removes the node object from the API server.
+func (k kubeAPI) DeleteNode(nodeName string) error {
+	return k.do("DELETE", "/api/v1/nodes/"+nodeName, nil, nil)
+}
+
+func (k kubeAPI) do(method string, path string, in interface{}, out interface{}) error {
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, k.URL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, string(b))
+	}
+
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeconfigFile is a kubectl configuration file. It is kept as read, so
+// only the entries of the cluster are touched and everything else in the
+// file is written back as it was.
+type kubeconfigFile map[string]interface{}
+
+// kubeconfigPath returns the file the kubeconfig is written to, the
+// configured one or ~/.kube/config
+func kubeconfigPath() string {
+
+	if config.Kubeconfig != "" {
+		return config.Kubeconfig
+	}
+
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+// kubeconfigTask merges the cluster into the kubeconfig: the public
+// endpoint of the master and the CA as cluster, the admin credentials as
+// user and a context named after the cluster, which becomes the current
+// one unless the file already has one. It only uses the state and the key
+// pairs, so it can run at any time after install. The endpoint is only
+// reachable with expose-api, without it no kubeconfig is written.
+func kubeconfigTask(c *cli.Context) error {
+
+	filename := kubeconfigPath()
+
+	if !config.ExposeAPI {
+		return newResourceError("write kubeconfig", filename, fmt.Errorf("the API server is not reachable from outside the network, set expose-api: true in the cluster section and run install"))
+	}
+
+	server, err := kubeconfigServer()
+	if err != nil {
+		return newResourceError("write kubeconfig", filename, err)
+	}
+	pairs, err := readKeyPairs(pkiCA, pkiAdmin)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "write kubeconfig", filename, server)
+
+	kc, err := readKubeconfig(filename)
+	if err != nil {
+		return newResourceError("read kubeconfig", filename, err)
+	}
+
+	user := config.Name + "-" + pkiAdmin
+	entries := []struct {
+		list  string
+		name  string
+		key   string
+		value map[string]interface{}
+	}{
+		{"clusters", config.Name, "cluster", map[string]interface{}{
+			"server":                     server,
+			"certificate-authority-data": base64.StdEncoding.EncodeToString(pairs[pkiCA].CertPEM),
+		}},
+		{"users", user, "user", map[string]interface{}{
+			"client-certificate-data": base64.StdEncoding.EncodeToString(pairs[pkiAdmin].CertPEM),
+			"client-key-data":         base64.StdEncoding.EncodeToString(pairs[pkiAdmin].KeyPEM),
+		}},
+		{"contexts", config.Name, "context", map[string]interface{}{
+			"cluster": config.Name,
+			"user":    user,
+		}},
+	}
+	for _, v := range entries {
+		if err := kc.set(v.list, v.name, v.key, v.value); err != nil {
+			return newResourceError("write kubeconfig", filename, err)
+		}
+	}
+	if current, _ := kc["current-context"].(string); current == "" {
+		kc["current-context"] = config.Name
+	} else if current != config.Name {
+		log.Printf("%-20s - %s %s, %s %s\n", "write kubeconfig", "current context stays", current, "switch with kubectl config use-context", config.Name)
+	}
+
+	if err := writeKubeconfig(filename, kc); err != nil {
+		return newResourceError("write kubeconfig", filename, err)
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "write kubeconfig", filename, config.Name, "COMPLETED")
+
+	return nil
+}
+
+// kubeconfigServer returns the URL of the API server on the floating IP
+// of the master recorded in the state
+func kubeconfigServer() (string, error) {
+
+	for _, k := range config.OrderedNodeKeys {
+
+		if !config.Nodes[k].IsMaster {
+			continue
+		}
+
+		floatingIP := state.Nodes[k].FloatingIP
+		if floatingIP == "" {
+			return "", fmt.Errorf("master %s has no floating IP, run install to assign one", k)
+		}
+		return fmt.Sprintf("https://%s:%d", floatingIP, KubeAPISecurePort), nil
+	}
+	return "", fmt.Errorf("No master found in cluster %s", config.Name)
+}
+
+// set replaces the named entry of a list of clusters, users or contexts,
+// or appends it
+func (kc kubeconfigFile) set(list string, name string, key string, value map[string]interface{}) error {
+
+	entry := map[string]interface{}{"name": name, key: value}
+
+	entries, ok := kc[list].([]interface{})
+	if !ok && kc[list] != nil {
+		return fmt.Errorf("%s is not a list", list)
+	}
+	for i, v := range entries {
+		if m, ok := v.(map[interface{}]interface{}); ok && m["name"] == name {
+			entries[i] = entry
+			kc[list] = entries
+			return nil
+		}
+	}
+	kc[list] = append(entries, entry)
+	return nil
+}
+
+// readKubeconfig returns the kubeconfig in filename, or an empty one when
+// the file does not exist yet
+func readKubeconfig(filename string) (kubeconfigFile, error) {
+
+	kc := kubeconfigFile{}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return kc, err
+	}
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		return kc, err
+	}
+
+	if kc["apiVersion"] == nil {
+		kc["apiVersion"] = "v1"
+	}
+	if kc["kind"] == nil {
+		kc["kind"] = "Config"
+	}
+	return kc, nil
+}
+
+// writeKubeconfig replaces filename atomically and readable by the owner
+// only, it holds the admin credentials of the cluster
+func writeKubeconfig(filename string, kc kubeconfigFile) error {
+
+	b, err := yaml.Marshal(&kc)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
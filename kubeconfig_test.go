@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// testKubeconfig is the part of a kubeconfig the tests look at
+type testKubeconfig struct {
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+			CAData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			CertData string `yaml:"client-certificate-data"`
+			KeyData  string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	CurrentContext string                 `yaml:"current-context"`
+	Preferences    map[string]interface{} `yaml:"preferences"`
+}
+
+func (env *testEnv) kubeconfig(filename string) testKubeconfig {
+
+	var kc testKubeconfig
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(b, &kc); err != nil {
+		env.t.Fatal(err)
+	}
+	return kc
+}
+
+func decodeBase64(t *testing.T, s string) []byte {
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// exposedConfig is testConfig with the API server exposed, which the
+// kubeconfig needs
+func exposedConfig(settings string) string {
+	return strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  expose-api: true\n"+settings, 1)
+}
+
+func TestInstallWritesKubeconfig(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(exposedConfig(""))
+
+	installAction(env.context(env.command(Install)))
+
+	filename := filepath.Join(env.dir, ".kube", "config")
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected a kubeconfig readable by the owner only: %v %v", fi, err)
+	}
+
+	kc := env.kubeconfig(filename)
+	if kc.CurrentContext != "test-cluster" || len(kc.Contexts) != 1 || kc.Contexts[0].Name != "test-cluster" {
+		t.Fatalf("expected the context test-cluster, got %+v", kc)
+	}
+	if c := kc.Contexts[0].Context; c.Cluster != "test-cluster" || c.User != "test-cluster-admin" {
+		t.Errorf("context points at %s and %s", c.Cluster, c.User)
+	}
+
+	floatingIP := env.state().Nodes["kube-master"].FloatingIP
+	if len(kc.Clusters) != 1 || kc.Clusters[0].Cluster.Server != "https://"+floatingIP+":443" {
+		t.Fatalf("expected the cluster to be served on the floating IP %s, got %+v", floatingIP, kc.Clusters)
+	}
+
+	// the credentials are those of the admin, issued by the CA of the
+	// cluster, which also issued the certificate of the API server
+	if len(kc.Users) != 1 {
+		t.Fatalf("expected the admin user, got %+v", kc.Users)
+	}
+	admin, err := tls.X509KeyPair(decodeBase64(t, kc.Users[0].User.CertData), decodeBase64(t, kc.Users[0].User.KeyData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(admin.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := cert.Subject.Organization; len(o) != 1 || o[0] != "system:masters" {
+		t.Errorf("expected the admin certificate, got %v", cert.Subject)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(decodeBase64(t, kc.Clusters[0].Cluster.CAData)) {
+		t.Fatal("no CA in the kubeconfig")
+	}
+	apiServer, err := readKeyPair(pkiAPIServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiServer.Cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: floatingIP}); err != nil {
+		t.Errorf("API server cannot be verified with the kubeconfig: %v", err)
+	}
+}
+
+func TestKubeconfigMergesExisting(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(exposedConfig("  kubeconfig: clusters.yaml\n"))
+
+	existing := `apiVersion: v1
+kind: Config
+preferences:
+  colors: true
+clusters:
+- name: other
+  cluster:
+    server: https://10.0.0.1
+- name: test-cluster
+  cluster:
+    server: https://10.0.0.2
+users:
+- name: other-admin
+  user:
+    token: secret
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other-admin
+current-context: other
+`
+	if err := ioutil.WriteFile("clusters.yaml", []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	installAction(env.context(env.command(Install)))
+
+	if _, err := os.Stat(filepath.Join(env.dir, ".kube", "config")); !os.IsNotExist(err) {
+		t.Errorf("expected ~/.kube/config to be left alone, got %v", err)
+	}
+
+	kc := env.kubeconfig("clusters.yaml")
+	if len(kc.Clusters) != 2 || kc.Clusters[0].Name != "other" || kc.Clusters[0].Cluster.Server != "https://10.0.0.1" {
+		t.Errorf("expected the other cluster to be kept, got %+v", kc.Clusters)
+	}
+	if kc.Clusters[1].Cluster.Server == "https://10.0.0.2" {
+		t.Errorf("expected the entry of test-cluster to be replaced")
+	}
+	if len(kc.Users) != 2 || len(kc.Contexts) != 2 || kc.Preferences["colors"] != true {
+		t.Errorf("expected the other entries to be kept, got %+v", kc)
+	}
+	if kc.CurrentContext != "other" {
+		t.Errorf("expected the current context to be kept, got %s", kc.CurrentContext)
+	}
+
+	// the kubeconfig command writes it again from the state
+	if err := os.Remove("clusters.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	c := env.context(env.command(Kubeconfig))
+	if err := readClusterTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfigTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if kc := env.kubeconfig("clusters.yaml"); len(kc.Clusters) != 1 || kc.Clusters[0].Cluster.Server != "https://"+env.state().Nodes["kube-master"].FloatingIP+":443" {
+		t.Errorf("expected the kubeconfig to be written from the state, got %+v", kc)
+	}
+}
+
+func TestKubeconfigBeforeInstall(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(exposedConfig(""))
+
+	c := env.context(env.command(Kubeconfig))
+	if err := readClusterTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfigTask(c); err == nil || !strings.Contains(err.Error(), "has no floating IP") {
+		t.Errorf("expected an error naming the missing floating IP, got %v", err)
+	}
+}
+
+func TestKubeconfigNeedsExposedAPI(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	// install succeeds without a kubeconfig that could not reach the cluster
+	installAction(env.context(env.command(Install)))
+
+	filename := filepath.Join(env.dir, ".kube", "config")
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected no kubeconfig without expose-api, got %v", err)
+	}
+	if len(env.clusterServers()) != 3 {
+		t.Errorf("expected the cluster to be installed")
+	}
+
+	c := env.context(env.command(Kubeconfig))
+	if err := readClusterTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfigTask(c); err == nil || !strings.Contains(err.Error(), "expose-api: true") {
+		t.Errorf("expected an error naming expose-api, got %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected no kubeconfig to be written, got %v", err)
+	}
+}
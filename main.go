@@ -2,65 +2,74 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
-	"strings"
-	"time"
+	"strconv"
+	"text/tabwriter"
 
 	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
 	common "git.openstack.org/stackforge/golang-client.git/identity/common"
 	identity "git.openstack.org/stackforge/golang-client.git/identity/v2"
-	image "git.openstack.org/stackforge/golang-client.git/image/v1"
 	misc "git.openstack.org/stackforge/golang-client.git/misc"
 	requester "git.openstack.org/stackforge/golang-client.git/misc/requester"
 	network "git.openstack.org/stackforge/golang-client.git/network/v2"
 
 	"github.com/codegangsta/cli"
-	"github.com/parnurzeal/gorequest"
-
-	"gopkg.in/yaml.v2"
 )
 
 var version = "0.0.3"
 
+// discoveryURL is the public etcd discovery service, used to create a
+// discovery token with discovery: public
+var discoveryURL = "https://discovery.etcd.io/new"
+
 var (
-	computeService  compute.Service
-	networkService  network.Service
-	imageService    image.Service
-	config          configContainer
-	keypair         compute.KeyPairResponse
-	netwrk          network.Response
-	subnets         []network.SubnetResponse
-	servers         []compute.Server
-	ports           []network.PortResponse
-	flavorMap       map[string]string
+	provider  Provider
+	config    configContainer
+	keypair   compute.KeyPairResponse
+	netwrk    network.Response
+	subnet    network.SubnetResponse
+	subnets   []network.SubnetResponse
+	servers   []compute.ServerDetail
+	ports     []network.PortResponse
+	flavors   []compute.Flavor
+	clusterID string
 )
 
-type configContainer struct {
-	Nodes            map[string]configNode `yaml:"hosts"`
-	SSHKey           string                `yaml:"sshkey"`
-	Network          string                `yaml:"network"`
-	AvailabilityZone string                `yaml:"availabilityZone"`
-	OrderedNodeKeys  []string
+// nodeStatus is a single row of the status report
+type nodeStatus struct {
+	Name       string
+	Role       string
+	Status     string
+	FixedIP    string
+	FloatingIP string
+	Flavor     string
+	Image      string
+	Port       string
 }
 
-type configNode struct {
-	IP       string `yaml:"ip"`
-	IsMaster bool   `yaml:"ismaster"`
-	VMImage  string `yaml:"vm-image"`
-	VMSize   string `yaml:"vm-size"`
-	ServerID string
+func main() {
+
+	app := newApp()
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
-func main() {
+func newApp() *cli.App {
 
 	app := cli.NewApp()
 	app.Name = "hpcloud-kubesetup"
@@ -137,66 +146,286 @@ func main() {
 			Name:   Install,
 			Usage:  "Create Kubernetes cluster",
 			Action: installAction,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  Recreate,
+					Usage: "Delete and recreate all cluster nodes",
+				},
+				cli.BoolFlag{
+					Name:  NoRollback,
+					Usage: "Keep the resources created so far when install fails",
+				},
+				cli.IntFlag{
+					Name:  Parallelism,
+					Value: DefaultParallelism,
+					Usage: "Number of worker nodes created concurrently",
+				},
+				cli.DurationFlag{
+					Name:  Timeout,
+					Value: DefaultTimeout,
+					Usage: "Time to wait for all servers to become ACTIVE",
+				},
+				cli.DurationFlag{
+					Name:  NodeTimeout,
+					Value: DefaultNodeTimeout,
+					Usage: "Time to wait for a single server to become ACTIVE",
+				},
+				cli.BoolFlag{
+					Name:  RetryFailed,
+					Usage: "Delete and recreate a server that goes to ERROR while it is spawned",
+				},
+			},
 		},
-		/*
-			{
-				Name:   Status,
-				Usage:  "Status of Kubernetes cluster",
-				Action: statusAction,
+		{
+			Name:   Status,
+			Usage:  "Status of Kubernetes cluster",
+			Action: statusAction,
+		},
+		{
+			Name:   Validate,
+			Usage:  "Check the configuration file and the OpenStack resources it refers to",
+			Action: validateAction,
+		},
+		{
+			Name:   Add,
+			Usage:  "Add a node to an existing Kubernetes cluster",
+			Action: addAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  IP,
+					Usage: "IP address of the node, defaults to an address assigned by DHCP",
+				},
+				cli.StringFlag{
+					Name:  Flavor,
+					Usage: "Flavor of the node, defaults to the flavor of the existing nodes",
+				},
+				cli.StringFlag{
+					Name:  VMImage,
+					Usage: "Image of the node, defaults to the image of the existing nodes",
+				},
+				cli.BoolFlag{
+					Name:  Save,
+					Usage: "Write the new node back into the configuration file",
+				},
+				cli.DurationFlag{
+					Name:  NodeTimeout,
+					Value: DefaultNodeTimeout,
+					Usage: "Time to wait for the server to become ACTIVE",
+				},
 			},
-		*/
+		},
+		{
+			Name:   Remove,
+			Usage:  "Remove a node from the Kubernetes cluster",
+			Action: removeAction,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  Force,
+					Usage: "Allow removing the master node",
+				},
+				cli.BoolFlag{
+					Name:  Drain,
+					Usage: "Cordon and drain the node through the Kubernetes API server first",
+				},
+			},
+		},
 		{
 			Name:   Uninstall,
 			Usage:  "Remove Kubernetes cluster",
 			Action: uninstallAction,
 		},
+		{
+			Name:   Mirror,
+			Usage:  "Download every artifact the hosts need into a directory and optionally serve it",
+			Action: mirrorAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  Dir,
+					Value: DefaultMirrorDir,
+					Usage: "Directory the artifacts are downloaded to",
+				},
+				cli.BoolFlag{
+					Name:  Serve,
+					Usage: "Serve the directory over HTTP once the artifacts are downloaded",
+				},
+				cli.StringFlag{
+					Name:  Listen,
+					Value: DefaultMirrorListen,
+					Usage: "Address the directory is served on",
+				},
+			},
+		},
+		{
+			Name:   Kubeconfig,
+			Usage:  "Write the kubectl configuration of the cluster from the state",
+			Action: kubeconfigAction,
+		},
+		{
+			Name:  Config,
+			Usage: "Manage the configuration file",
+			Subcommands: []cli.Command{
+				{
+					Name:   Migrate,
+					Usage:  "Rewrite a configuration file in the legacy hosts format with cluster and template sections",
+					Action: migrateConfigAction,
+				},
+			},
+		},
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	os.Exit(1)
+	return app
 }
 
 func installAction(c *cli.Context) {
 
-	initTask(c)
-	uninstallTask(c)
-	createCloudConfigTask(c)
-	installTask(c)
-	statusTask(c)
-	assignIPAddressTask(c)
+	exitOnError(initTask(c))
+	exitOnError(kubernetesTask(c))
+
+	// with --recreate the quota is checked before anything is deleted,
+	// OpenStack may count the deleted servers for a while after uninstall
+	if c.Bool(Recreate) {
+		exitOnError(recreateQuotaTask(c))
+		exitOnError(uninstallTask(c))
+	} else {
+		exitOnError(quotaTask(c))
+	}
+
+	created = journal{}
+
+	err := runTasks(c, discoveryURLTask, pkiTask, networkTask, securityGroupTask, installTask, assignIPAddressTask)
+	if err != nil && !c.Bool(NoRollback) {
+		if rollbackErr := created.rollback(); rollbackErr != nil {
+			log.Printf("%-20s - %s\n", "rollback", rollbackErr.Error())
+		}
+	}
+	exitOnError(err)
+
+	if !config.ExposeAPI {
+		log.Printf("%-20s - %s\n", "write kubeconfig", "skipped, the API server is not exposed, set expose-api: true in the cluster section to use kubectl from outside the network")
+		return
+	}
+	exitOnError(kubeconfigTask(c))
 }
 
 func statusAction(c *cli.Context) {
 
-	initTask(c)
-	statusTask(c)
+	exitOnError(initTask(c))
+
+	healthy, err := statusTask(c)
+	exitOnError(err)
+	if !healthy {
+		os.Exit(1)
+	}
+}
+
+func addAction(c *cli.Context) {
+
+	exitOnError(initTask(c))
+	exitOnError(addTask(c))
+}
+
+func removeAction(c *cli.Context) {
+
+	exitOnError(initTask(c))
+	exitOnError(removeTask(c))
 }
 
 func uninstallAction(c *cli.Context) {
 
-	initTask(c)
-	uninstallTask(c)
+	exitOnError(initTask(c))
+	exitOnError(uninstallTask(c))
+}
+
+func validateAction(c *cli.Context) {
+
+	exitOnError(validateTask(c))
+}
+
+func mirrorAction(c *cli.Context) {
+
+	exitOnError(mirrorTask(c))
+}
+
+func kubeconfigAction(c *cli.Context) {
+
+	exitOnError(readClusterTask(c))
+	exitOnError(kubeconfigTask(c))
+}
+
+func migrateConfigAction(c *cli.Context) {
+
+	exitOnError(migrateConfigTask(c))
+}
+
+// runTasks runs the tasks in order and stops at the first error
+func runTasks(c *cli.Context, tasks ...func(*cli.Context) error) error {
+
+	for _, task := range tasks {
+		if err := task(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func initTask(c *cli.Context) error {
+
+	err := readClusterTask(c)
+	if err != nil {
+		return err
+	}
+
+	provider, err = newProvider(c)
+	if err != nil {
+		return err
+	}
+
+	return discoverTask(c)
 }
 
-func initTask(c *cli.Context) {
+// readClusterTask reads the configuration and the state of the cluster
+// without connecting to OpenStack
+func readClusterTask(c *cli.Context) error {
 
 	var err error
 
 	config, err = readConfigFile(c.GlobalString(Config))
 	if err != nil {
-		log.Fatal(err.Error())
+		return newResourceError("read config", c.GlobalString(Config), err)
 	}
 	for k := range config.Nodes {
 		config.OrderedNodeKeys = append(config.OrderedNodeKeys, k)
 	}
 	sort.Strings(config.OrderedNodeKeys)
 
+	if config.Name == "" {
+		config.Name = DefaultClusterName
+	}
+
 	config.Log()
 
+	stateFile = statePath(c.GlobalString(Config))
+	pkiDir = pkiPath(c.GlobalString(Config))
+	state, err = readStateFile(stateFile)
+	if err != nil {
+		return newResourceError("read state", stateFile, err)
+	}
+	if state.Name == "" {
+		state.Name = config.Name
+	}
+	if state.Name != config.Name {
+		return newResourceError("read state", stateFile, fmt.Errorf("state belongs to cluster %s", state.Name))
+	}
+	return nil
+}
+
+// newProvider returns the cloud provider the tasks run against
+var newProvider = openStackConnect
+
+// openStackConnect authenticates against Keystone and returns a Provider
+// for the OpenStack services of the tenant.
+func openStackConnect(c *cli.Context) (Provider, error) {
+
 	log.Printf("%-20s - %s\n", AuthURLEnv, c.GlobalString(AuthURL))
 	log.Printf("%-20s - %s\n", TenantIDEnv, c.GlobalString(TenantID))
 	log.Printf("%-20s - %s\n", TenantNameEnv, c.GlobalString(TenantName))
@@ -223,13 +452,13 @@ func initTask(c *cli.Context) {
 
 		pemData, err := ioutil.ReadFile(c.GlobalString(CACert))
 		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error:", "Unable to load CA Certificate file", c.GlobalString(CACert)))
+			return nil, newResourceError("load CA certificate file", c.GlobalString(CACert), err)
 		}
 
 		certPool := x509.NewCertPool()
 
 		if !certPool.AppendCertsFromPEM(pemData) {
-			log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error:", "Invalid CA Certificates in file", c.GlobalString(CACert)))
+			return nil, newResourceError("load CA certificate file", c.GlobalString(CACert), fmt.Errorf("Invalid CA Certificates"))
 		}
 
 		transport = &http.Transport{
@@ -254,328 +483,663 @@ func initTask(c *cli.Context) {
 
 	token, err := authenticator.GetToken()
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+		return nil, newResourceError("authenticate", c.GlobalString(AuthURL), err)
 	}
 	log.Printf("%-20s - %s\n", "token", token)
 
-	computeService = compute.NewService(&authenticator)
+	return newOpenStackProvider(&authenticator), nil
+}
 
-	networkService = network.NewService(&authenticator)
+// discoverTask looks up the OpenStack resources referenced by the
+// configuration and the servers and ports of the cluster.
+func discoverTask(c *cli.Context) error {
 
-	imageService = image.NewService(&authenticator)
+	var err error
 
-	keypair, err = computeService.KeyPair(config.SSHKey)
+	keypair, err = provider.KeyPair(config.SSHKey)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s %s\n", "error", "get keypair", config.SSHKey, err.Error()))
+		return newResourceError("get keypair", config.SSHKey, err)
 	}
 
-	var q = network.QueryParameters{Name: config.Network}
-	networks, err := networkService.QueryNetworks(q)
+	networks, err := provider.QueryNetworks(network.QueryParameters{})
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s %s\n", "error", "get network by name", config.Network, err.Error()))
+		return newResourceError("get networks", "", err)
 	}
-	if len(networks) == 0 {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "network not found", config.Network))
+	subnets, err = provider.Subnets()
+	if err != nil {
+		return newResourceError("get subnets", "", err)
 	}
-	if len(networks) > 1 {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "multiple networks found with identical name", config.Network))
+
+	found, err := resolveNetwork(config.Network, networks)
+	if _, missing := err.(*notFoundError); missing && config.CreateNetwork != nil {
+		// created by install
+		netwrk = network.Response{}
+		subnet = network.SubnetResponse{}
+		log.Printf("%-20s - %s %s\n", "network", config.Network, "not found")
+	} else if err != nil {
+		return newResourceError("get network", config.Network, err)
+	} else {
+
+		netwrk, err = provider.Network(found.ID)
+		if err != nil {
+			return newResourceError("get network by id", found.ID, err)
+		}
+		log.Printf("%-20s - %s\n", "network", netwrk.ID)
+
+		subnet = network.SubnetResponse{}
+		if len(netwrk.Subnets) > 0 || netwrk.ID != state.Network.NetworkID {
+			subnet, err = resolveSubnet(config.Subnet, netwrk, subnets)
+			if err != nil {
+				return newResourceError("get subnet", config.Subnet, err)
+			}
+			log.Printf("%-20s - %s %s\n", "subnet", subnet.ID, subnet.CIDR)
+		}
 	}
 
-	netwrk, err = networkService.Network(networks[0].ID)
+	ports, err = provider.Ports()
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s %s\n", "error", "getting network by id", networks[0].ID, err.Error()))
+		return newResourceError("get ports", "", err)
 	}
-	log.Printf("%-20s - %s\n", "network", netwrk.ID)
 
-	subnets, err = networkService.Subnets()
+	sort.Sort(PortByName(ports))
+
+	allServers, err := provider.ServerDetails()
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "get subnets", err.Error()))
+		return newResourceError("get servers", "", err)
 	}
 
-	ports, err = networkService.Ports()
+	servers, clusterID, err = clusterServers(allServers, config.Name)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "get ports", err.Error()))
+		return err
 	}
 
-	sort.Sort(PortByName(ports))
+	// servers recorded in the state are members even when they could not
+	// be tagged, servers which no longer exist are forgotten
+	for k, v := range state.Nodes {
 
-	servers, err = computeService.Servers()
-	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "get servers", err.Error()))
+		if v.ServerID == "" {
+			continue
+		}
+		if _, ok := findServerByID(v.ServerID); ok {
+			continue
+		}
+
+		found := false
+		for _, server := range allServers {
+			if server.ID == v.ServerID && server.Name == k {
+				servers = append(servers, server)
+				found = true
+			}
+		}
+		if !found {
+			state.forget(v.ServerID)
+		}
 	}
 
 	sort.Sort(ServerByName(servers))
 
-	availibityZones, err := computeService.AvailabilityZones()
-	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "get availabilityzones", err.Error()))
+	if clusterID == "" {
+		clusterID = state.ClusterID
 	}
-
-	azMap := make(map[string]string)
-	for _,p := range availibityZones {
-		azMap[strings.ToLower(p.ZoneName)] = p.ZoneName
+	if clusterID == "" {
+		clusterID, err = newClusterID()
+		if err != nil {
+			return err
+		}
+		log.Printf("%-20s - %s %s\n", "cluster", config.Name, "not found")
 	}
+	state.ClusterID = clusterID
+	log.Printf("%-20s - %s %s\n", "cluster", config.Name, clusterID)
 
-	if az, ok := azMap[strings.ToLower(config.AvailabilityZone)]; ok {
-		config.AvailabilityZone = az
-		} else {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "availibityZone not found", config.AvailabilityZone))
+	availibityZones, err := provider.AvailabilityZones()
+	if err != nil {
+		return newResourceError("get availabilityzones", "", err)
 	}
 
-	flavors, err := computeService.Flavors()
-	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "get flavors", err.Error()))
+	for _, k := range config.OrderedNodeKeys {
+		v := config.Nodes[k]
+		if v.AvailabilityZone == "" {
+			continue
+		}
+		az, err := resolveZone(v.AvailabilityZone, availibityZones)
+		if err != nil {
+			return newResourceError("get availabilityzone", v.AvailabilityZone, err)
+		}
+		v.AvailabilityZone = az
+		config.Nodes[k] = v
 	}
 
-	flavorMap = make(map[string]string)
-	for _, p := range flavors {
-		flavorMap[p.Name] = p.ID
+	flavors, err = provider.Flavors()
+	if err != nil {
+		return newResourceError("get flavors", "", err)
 	}
 
-	for _, p := range config.Nodes {
-		if _, ok := flavorMap[p.VMSize]; !ok {
-			log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error", "flavor not found", p.VMSize))
+	for _, k := range config.OrderedNodeKeys {
+		if _, err := nodeFlavorID(config.Nodes[k]); err != nil {
+			return err
 		}
 	}
 
+	return nil
 }
 
-func uninstallTask(c *cli.Context) {
+// uninstallTask deletes the servers tagged as members of the cluster, the
+// ports attached to them, the ports recorded in the state, the security
+// groups owned by the cluster and the network it created. Floating IPs the
+// tool allocated are released with floating-ip.release.
+func uninstallTask(c *cli.Context) error {
+
+	var remainingPorts []network.PortResponse
 
 	for _, v := range servers {
 
-		if _, ok := config.Nodes[v.Name]; ok {
+		log.Printf("%-20s - %s\n", "delete server", v.Name)
 
-			log.Printf("%-20s - %s\n", "delete server", v.Name)
+		err := provider.DeleteServer(v.ID)
+		if noErrorOn404(err) != nil {
+			return newResourceError("delete server", v.Name, err)
+		}
 
-			err := computeService.DeleteServer(v.ID)
-			if err != nil {
-				log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
-			}
+		log.Printf("%-20s - %s %s\n", "delete server", v.Name, "COMPLETED")
+	}
 
-			log.Printf("%-20s - %s %s\n", "delete server", v.Name, "COMPLETED")
-		}
+	owned := make(map[string]bool)
+	for _, v := range state.Nodes {
+		owned[v.PortID] = true
 	}
 
 	for _, v := range ports {
 
-		if _, ok := config.Nodes[v.Name]; ok {
+		if _, ok := findServerByID(v.DeviceID); !ok && !owned[v.ID] {
+			remainingPorts = append(remainingPorts, v)
+			continue
+		}
 
-			log.Printf("%-20s - %s\n", "delete port", v.Name)
+		log.Printf("%-20s - %s\n", "delete port", v.Name)
 
-			err := networkService.DeletePort(v.ID)
-			if noErrorOn404(err) != nil {
-				log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
-			}
+		err := provider.DeletePort(v.ID)
+		if noErrorOn404(err) != nil {
+			return newResourceError("delete port", v.Name, err)
+		}
 
-			log.Printf("%-20s - %s %s\n", "delete port", v.Name, "COMPLETED")
+		log.Printf("%-20s - %s %s\n", "delete port", v.Name, "COMPLETED")
+	}
+
+	var names []string
+	for k := range state.Nodes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if err := releaseFloatingIP(k, state.Nodes[k]); err != nil {
+			return err
 		}
 	}
+
+	servers = nil
+	ports = remainingPorts
+
+	if err := deleteSecurityGroups(); err != nil {
+		return err
+	}
+	if err := deleteNetwork(); err != nil {
+		return err
+	}
+
+	kept := state.KeptFloatingIPs
+	state = clusterState{Name: config.Name, Nodes: make(map[string]nodeState), KeptFloatingIPs: kept}
+	if err := removePKI(); err != nil {
+		return err
+	}
+
+	// the state outlives the cluster while it holds addresses to reuse
+	if len(kept) > 0 {
+		return saveState()
+	}
+	return removeStateFile()
 }
 
-func createCloudConfigTask(c *cli.Context) {
+func createNodeCloudConfig(name string, node configNode, masterIP string, etcd etcdBootstrap) error {
+
+	log.Printf("%-20s - %s\n", "create cloudconfig", name)
+
+	data := make(map[string]string)
 
-	nodeID := 0
+	data["filename"] = cloudConfigPath(name)
 
-	masterIP, err := getMasterIP(config.Nodes)
+	if node.IsMaster {
+		data["role"] = "master"
+	} else {
+		data["role"] = "node"
+	}
+
+	kube := config.kubernetes()
+	version, err := kubeVersion(kube)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s %s\n", "error:", "get master IP", err.Error()))
+		return newResourceError("create cloudconfig", name, err)
+	}
+	data["kubeversion"] = version
+	data["kubebaseurl"] = config.mirrorURL(kube.BaseURL)
+	data["kuberegister"] = config.mirrorURL(KubeRegisterURL)
+	data["registryimage"] = RegistryImage
+	digests := artifactDigests(kube, version)
+	for _, v := range kubeArtifacts() {
+		data[v+".sha256"] = digests[v]
+		if digests[v] == "" && kube.SkipVerify {
+			data[v+".sha256"] = FetchUnverified
+		}
+	}
+	if config.Mirror != "" {
+		data["registryarchive"] = config.mirrorImageURL(RegistryImage)
+	}
+
+	data["discovery"] = etcd.Discovery
+	data["initialcluster"] = etcd.initialCluster(masterIP)
+	if etcd.isMember(name) {
+		data["member"] = "true"
+	}
+	data["master"] = masterIP
+	data["apiport"] = strconv.Itoa(KubeAPISecurePort)
+	data["insecureapiport"] = strconv.Itoa(KubeAPIPort)
+	data["serviceiprange"] = ServiceClusterIPRange
+	data["hostname"] = name
+	data["ip"] = node.FixedIP
+	data["sshkey"] = keypair.PublicKey
+
+	pairs, err := nodeKeyPairs(name, node)
+	if err != nil {
+		return err
+	}
+	for k, v := range pairs {
+		data[k+".pem"] = indentPEM(v.CertPEM)
+		if k != pkiCA {
+			data[k+"-key.pem"] = indentPEM(v.KeyPEM)
+		}
 	}
 
-	discovery := getDiscoveryKey()
+	if err := createCloudConfig(data); err != nil {
+		return newResourceError("create cloudconfig", data["filename"], err)
+	}
 
-	for k, v := range config.Nodes {
+	log.Printf("%-20s - %s %s\n", "create cloudconfig", data["filename"], "COMPLETED")
 
-		log.Printf("%-20s - %s\n", "create cloudconfig", k)
+	return nil
+}
 
-		data := make(map[string]string)
+// installTask reconciles the servers and ports found by initTask with the
+// configured nodes and waits until every server is ACTIVE. The master is
+// provisioned first, the workers follow concurrently, at most
+// --parallelism at a time. The worker cloud-configs are rendered with the
+// address of the master's port, so they wait for it to exist.
+func installTask(c *cli.Context) error {
 
-		data["filename"] = k + ".yml"
+	parallelism := c.Int(Parallelism)
+	if parallelism < 1 {
+		return fmt.Errorf("--%s must be at least 1", Parallelism)
+	}
 
-		if v.IsMaster {
-			data["role"] = "master"
+	wait, err := newWaitPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	var masters, workers []string
+	for _, k := range config.OrderedNodeKeys {
+		if config.Nodes[k].IsMaster {
+			masters = append(masters, k)
 		} else {
-			data["role"] = "node"
+			workers = append(workers, k)
 		}
+	}
+	if len(masters) == 0 {
+		return newResourceError("get master IP", config.Name, fmt.Errorf("no master configured"))
+	}
 
-		data["discovery"] = discovery
-		data["master"] = masterIP
-		data["hostname"] = k
-		data["ip"] = v.IP
-		data["sshkey"] = keypair.PublicKey
-
-		nodeID = nodeID + 1
+	members, err := etcdMembers()
+	if err != nil {
+		return err
+	}
+	etcd := etcdBootstrap{Discovery: state.DiscoveryURL, Members: members}
 
-		createCloudConfig(data)
+	if err := reserveFloatingIP(masters[0]); err != nil {
+		return err
+	}
 
-		log.Printf("%-20s - %s %s\n", "create cloudconfig", data["filename"], "COMPLETED")
+	err = forEachNode(masters, 1, func(name string) error {
+		return installNode(name, "", etcd, wait)
+	})
+	if err != nil {
+		return err
 	}
+
+	masterIP := nodeConfig(masters[0]).FixedIP
+	log.Printf("%-20s - %s\n", "master", masterIP)
+
+	return forEachNode(workers, parallelism, func(name string) error {
+		return installNode(name, masterIP, etcd, wait)
+	})
 }
 
-func installTask(c *cli.Context) {
+// installNode creates the port and server of a node unless they exist,
+// existing nodes are left alone and any drift from the configuration is
+// reported. The cloud-config is rendered once the address of the port is
+// known, a master points at itself. It returns when the server is ACTIVE.
+func installNode(name string, masterIP string, etcd etcdBootstrap, wait waitPolicy) error {
 
-	for _, v := range config.OrderedNodeKeys {
+	node := nodeConfig(name)
 
-		log.Printf("%-20s - %s %s\n", "create port", v, config.Nodes[v].IP)
+	imageID, err := nodeImageID(node)
+	if err != nil {
+		return err
+	}
 
-		newPort := network.CreatePortParameters{}
-		newPort.Name = v
-		newPort.AdminStateUp = true
-		newPort.NetworkID = netwrk.ID
-		newPort.FixedIPs = []network.FixedIP{{IPAddress: config.Nodes[v].IP, SubnetID: netwrk.Subnets[0]}}
+	port, portFound := findPort(name)
+	server, serverFound := findServer(name)
 
-		port, err := networkService.CreatePort(newPort)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+	if serverFound {
+
+		log.Printf("%-20s - %s %s\n", "server exists", name, server.ID)
+
+		fixedIP, floatingIP := serverAddresses(server)
+		if portFound {
+			fixedIP = portIP(port)
 		}
 
-		log.Printf("%-20s - %s %s\n", "create port", port.ID, "COMPLETED")
+		if flavorID, err := nodeFlavorID(node); err == nil {
+			reportDrift(name, "flavor", flavorID, server.Flavor.ID)
+		}
+		if server.Image.Image != nil {
+			reportDrift(name, "image", imageID, server.Image.Image.ID)
+		}
+		if node.IP != "" {
+			reportDrift(name, "ip", node.IP, fixedIP)
+		}
 
-		log.Printf("%-20s - %s %s\n", "create server", v, config.Nodes[v].IP)
+		node.FixedIP = fixedIP
+		node.ServerID = server.ID
+		node.FloatingIP = floatingIP
+		setNodeConfig(name, node)
 
-		userdata, err := getUserData(v + ".yml")
-		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+		if err := renderNodeCloudConfig(name, node, masterIP, etcd); err != nil {
+			return err
+		}
+		if hash, err := cloudConfigHash(cloudConfigPath(name)); err == nil && nodeStateOf(name).CloudConfigHash != "" {
+			reportDrift(name, "cloudconfig", hash, nodeStateOf(name).CloudConfigHash)
 		}
 
-		imageQuery := image.QueryParameters{Name: config.Nodes[v].VMImage}
-		images, err := imageService.QueryImages(imageQuery)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+	} else {
+
+		if portFound {
+			log.Printf("%-20s - %s %s\n", "port exists", name, port.ID)
+		} else {
+			port, err = createPort(name, node)
+			if err != nil {
+				return err
+			}
 		}
-		log.Printf("%-20s - %s\n", "image", images[0].ID)
 
-		log.Printf("%-20s - %s\n", "flavor", flavorMap[config.Nodes[v].VMSize])
+		node.FixedIP = portIP(port)
+		if node.FixedIP == "" {
+			return newResourceError("get port address", name, fmt.Errorf("port %s has no fixed IP", port.ID))
+		}
+		setNodeConfig(name, node)
 
-		newServer := compute.ServerCreationParameters{}
-		newServer.Name = v
-		newServer.ImageRef = images[0].ID
-		newServer.FlavorRef = flavorMap[config.Nodes[v].VMSize]
-		newServer.KeyPairName = keypair.Name
-		newServer.UserData = &userdata
-		newServer.Networks = []compute.ServerNetworkParameters{{UUID: port.NetworkID, Port: port.ID}}
-		newServer.SecurityGroups = []compute.SecurityGroup{{Name: "default"}}
-		newServer.AvailabilityZone = &config.AvailabilityZone
+		if err := renderNodeCloudConfig(name, node, masterIP, etcd); err != nil {
+			return err
+		}
 
-		server, err := computeService.CreateServer(newServer)
+		node.ServerID, err = createServer(name, node, imageID, port)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+			return err
 		}
+		setNodeConfig(name, node)
+	}
 
-		log.Printf("%-20s - %s %s\n", "create server", "password", server.AdminPass)
-		log.Printf("%-20s - %s %s\n", "create server", server.ID, "COMPLETED")
+	err = wait.waitForServer(node.ServerID)
+	if _, failed := err.(*serverFailedError); failed && wait.RetryFailed && port.ID != "" {
+		log.Printf("%-20s - %s %s\n", "retry server", name, err.Error())
 
-		node := config.Nodes[v]
-		node.ServerID = server.ID
-		config.Nodes[v] = node
+		node.ServerID, err = recreateServer(name, node, imageID, port, wait)
+		if err != nil {
+			return err
+		}
+		setNodeConfig(name, node)
+
+		err = wait.waitForServer(node.ServerID)
 	}
+	if err != nil {
+		return newResourceError("wait for server", name, err)
+	}
+	return nil
 }
 
-func statusTask(c *cli.Context) {
+// nodeKeyPairs returns the key pairs written to a host: the CA and the
+// certificate of the API server on the master, the CA and the client
+// certificates of the kubelet and kube-proxy on a worker. Only the
+// certificate of the CA is written, never its key.
+func nodeKeyPairs(name string, node configNode) (map[string]keyPair, error) {
 
-	for _, v := range config.OrderedNodeKeys {
+	if !node.IsMaster {
+		return readKeyPairs(pkiCA, pkiKubelet, pkiKubeProxy)
+	}
 
-		prevStatus := ""
-		for {
-			server, err := computeService.ServerDetail(config.Nodes[v].ServerID)
+	pairs, err := readKeyPairs(pkiCA)
+	if err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
-			}
+	floatingIP := node.FloatingIP
+	if floatingIP == "" {
+		floatingIP = nodeStateOf(name).FloatingIP
+	}
+	pairs[pkiAPIServer], err = apiServerKeyPair(name, node.FixedIP, floatingIP)
+	return pairs, err
+}
 
-			if prevStatus != server.Status {
-				log.Printf("%-20s - %s %s\n", "server status", server.Name, server.Status)
-				prevStatus = server.Status
-			}
+// renderNodeCloudConfig renders the cloud-config of a node, a master is
+// pointed at its own address
+func renderNodeCloudConfig(name string, node configNode, masterIP string, etcd etcdBootstrap) error {
 
-			if server.Status == "ACTIVE" {
-				break
-			}
-			time.Sleep(1 * time.Second)
-		}
+	if node.IsMaster {
+		masterIP = node.FixedIP
 	}
+	return createNodeCloudConfig(name, node, masterIP, etcd)
 }
 
-func assignIPAddressTask(c *cli.Context) {
+// recreateServer deletes the server of a node that went to ERROR and boots
+// a new one on the same port.
+func recreateServer(name string, node configNode, imageID string, port network.PortResponse, wait waitPolicy) (string, error) {
+
+	log.Printf("%-20s - %s %s\n", "delete server", name, node.ServerID)
 
-	var unAssigned []compute.FloatingIP
-	floatingIPs, err := computeService.FloatingIPs()
+	if err := noErrorOn404(provider.DeleteServer(node.ServerID)); err != nil {
+		return "", newResourceError("delete server", name, err)
+	}
+	if err := wait.waitForServerDeletion(node.ServerID); err != nil {
+		return "", newResourceError("delete server", name, err)
+	}
+	if err := updateNode(name, func(n *nodeState) { n.ServerID = "" }); err != nil {
+		return "", err
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "delete server", name, node.ServerID, "COMPLETED")
+
+	return createServer(name, node, imageID, port)
+}
+
+// createPort creates the port of a node on the cluster subnet, with the
+// configured address or, when there is none, one assigned by DHCP. The
+// port is put into the security groups of the cluster.
+func createPort(name string, node configNode) (network.PortResponse, error) {
+
+	log.Printf("%-20s - %s %s\n", "create port", name, valueOrDHCP(node.IP))
+
+	newPort := portParameters{}
+	newPort.Name = name
+	newPort.AdminStateUp = true
+	newPort.NetworkID = netwrk.ID
+	newPort.FixedIPs = []fixedIP{{IPAddress: node.IP, SubnetID: subnet.ID}}
+	newPort.SecurityGroups = clusterSecurityGroups
+
+	port, err := provider.CreatePort(newPort)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
+		return port, newResourceError("create port", name, err)
 	}
+	created.record(journalPort, port.ID, name)
 
-	for _, v := range floatingIPs {
-		if len(v.InstanceID) == 0 {
-			unAssigned = append(unAssigned, v)
-		}
+	if err := updateNode(name, func(n *nodeState) { n.PortID = port.ID }); err != nil {
+		return port, err
 	}
 
-	for k, v := range config.Nodes {
+	log.Printf("%-20s - %s %s %s %s\n", "create port", name, port.ID, portIP(port), "COMPLETED")
 
-		if !v.IsMaster {
-			continue
-		}
+	return port, nil
+}
 
-		if len(unAssigned) == 0 {
+// createServer boots a server for the node on the given port, using the
+// cloud-config rendered by createCloudConfig, and returns the server id.
+func createServer(name string, node configNode, imageID string, port network.PortResponse) (string, error) {
 
-			log.Printf("%-20s - %s %s\n", "create public IP", "", "")
+	log.Printf("%-20s - %s %s\n", "create server", name, node.FixedIP)
 
-			var fp compute.FloatingIP
-			fp, err := computeService.CreateFloatingIPInDefaultPool()
-			if err != nil {
-				log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
-			}
-			unAssigned = append(unAssigned, fp)
+	userdata, err := getUserData(cloudConfigPath(name))
+	if err != nil {
+		return "", newResourceError("read cloudconfig", cloudConfigPath(name), err)
+	}
 
-			log.Printf("%-20s - %s %s\n", "create public IP", fp.IP, "COMPLETED")
+	log.Printf("%-20s - %s %s\n", "image", name, imageID)
 
-		}
+	flavorID, err := nodeFlavorID(node)
+	if err != nil {
+		return "", err
+	}
 
-		log.Printf("%-20s - %s %s\n", "associate IP", k, unAssigned[0].IP)
+	log.Printf("%-20s - %s %s\n", "flavor", name, flavorID)
+
+	newServer := compute.ServerCreationParameters{}
+	newServer.Name = name
+	newServer.ImageRef = imageID
+	newServer.FlavorRef = flavorID
+	newServer.KeyPairName = keypair.Name
+	newServer.UserData = &userdata
+	newServer.Networks = []compute.ServerNetworkParameters{{UUID: port.NetworkID, Port: port.ID}}
+	if node.AvailabilityZone != "" {
+		newServer.AvailabilityZone = &node.AvailabilityZone
+	}
 
-		err := computeService.ServerAction(v.ServerID, "addFloatingIp", "address", unAssigned[0].IP)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("%-20s - %s\n", "error:", err.Error()))
-		}
+	server, err := provider.CreateServer(newServer)
+	if err != nil {
+		return "", newResourceError("create server", name, err)
+	}
+	created.record(journalServer, server.ID, name)
 
-		log.Printf("%-20s - %s %s\n", "associate IP", k, "COMPLETED")
-		unAssigned = append(unAssigned[1:])
+	hash, err := cloudConfigHash(cloudConfigPath(name))
+	if err != nil {
+		return "", newResourceError("read cloudconfig", cloudConfigPath(name), err)
+	}
+	err = updateNode(name, func(n *nodeState) {
+		n.ServerID = server.ID
+		n.CloudConfigHash = hash
+	})
+	if err != nil {
+		return "", err
 	}
-}
 
-func readConfigFile(filename string) (config configContainer, err error) {
+	log.Printf("%-20s - %s %s %s\n", "create server", name, "password", server.AdminPass)
+	log.Printf("%-20s - %s %s %s\n", "create server", name, server.ID, "COMPLETED")
 
-	b, err := ioutil.ReadFile(filename)
+	_, err = provider.SetServerMetadata(server.ID, clusterMetadata(nodeRole(node)))
 	if err != nil {
-		return
+		return "", newResourceError("tag server", name, err)
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "tag server", name, config.Name, clusterID)
+
+	return server.ID, nil
+}
+
+// statusTask prints a per node report of the cluster as seen by Nova and
+// Neutron. It returns false when a node is missing or in ERROR.
+func statusTask(c *cli.Context) (bool, error) {
+
+	healthy := true
+
+	flavorNames := make(map[string]string)
+	for _, v := range flavors {
+		flavorNames[v.ID] = v.Name
 	}
 
-	err = yaml.Unmarshal(b, &config)
+	images, err := provider.Images()
 	if err != nil {
-		return
+		return false, newResourceError("get images", "", err)
 	}
 
-	err = nil
-	return
-}
+	imageNames := make(map[string]string)
+	for _, p := range images {
+		imageNames[p.ID] = p.Name
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tROLE\tSTATUS\tFIXED IP\tFLOATING IP\tFLAVOR\tIMAGE\tPORT")
+
+	for _, k := range nodeNames() {
+
+		row := nodeStatus{Name: k, Role: "node", Status: StatusMissing, Port: StatusMissing}
+		if config.Nodes[k].IsMaster {
+			row.Role = "master"
+		}
+
+		if port, ok := findPort(k); ok {
+			row.Port = port.Status
+		}
+
+		if server, ok := findServer(k); ok {
+
+			if role := server.MetaData[MetaRole]; role != "" {
+				row.Role = role
+			}
+			row.Status = server.Status
+			row.Flavor = flavorNames[server.Flavor.ID]
+			if row.Flavor == "" {
+				row.Flavor = server.Flavor.ID
+			}
+			if server.Image.Image != nil {
+				row.Image = imageNames[server.Image.Image.ID]
+				if row.Image == "" {
+					row.Image = server.Image.Image.ID
+				}
+			}
+			row.FixedIP, row.FloatingIP = serverAddresses(server)
+		}
+
+		if row.Status == StatusMissing || row.Status == "ERROR" {
+			healthy = false
+		}
 
-func (config configContainer) Log() {
-	for k, v := range config.Nodes {
-		log.Printf("%-20s - %s %v\n", "config file", k, v)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.Name, row.Role, row.Status, valueOrDash(row.FixedIP), valueOrDash(row.FloatingIP),
+			valueOrDash(row.Flavor), valueOrDash(row.Image), row.Port)
 	}
-	log.Printf("%-20s - %s %s\n", "config file", "SSHKey", config.SSHKey)
-	log.Printf("%-20s - %s %s\n", "config file", "Network", config.Network)
-	log.Printf("%-20s - %s %s\n", "config file", "AvailabilityZone", config.AvailabilityZone)
 
+	w.Flush()
+
+	return healthy, nil
 }
 
 func createCloudConfig(data map[string]string) error {
 
 	var b bytes.Buffer
-	f, err := os.Create(data["filename"])
+	if err := os.MkdirAll(filepath.Dir(data["filename"]), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(data["filename"], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
 
 	w := io.MultiWriter(f, &b)
 	if data["role"] == "master" {
@@ -590,8 +1154,7 @@ func createCloudConfig(data map[string]string) error {
 		}
 	}
 
-	f.Close()
-	return nil
+	return f.Close()
 }
 
 func getUserData(filename string) (encodedStr string, err error) {
@@ -606,48 +1169,158 @@ func getUserData(filename string) (encodedStr string, err error) {
 	return
 }
 
-func getMasterIP(nodeList map[string]configNode) (string, error) {
+// cloudConfigHash returns the SHA-256 of a rendered cloud-config file
+func cloudConfigHash(filename string) (string, error) {
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// nodeImageID returns the image id of the node, the configured id or the
+// image the configured name or id refers to
+func nodeImageID(node configNode) (string, error) {
+
+	if node.ImageID != "" {
+		return node.ImageID, nil
+	}
+
+	images, err := provider.Images()
+	if err != nil {
+		return "", newResourceError("get images", "", err)
+	}
+	id, err := resolveImage(node.VMImage, images)
+	if err != nil {
+		return "", newResourceError("get image", node.VMImage, err)
+	}
+	return id, nil
+}
 
-	for _, v := range nodeList {
-		if v.IsMaster {
-			return v.IP, nil
+// nodeFlavorID returns the flavor id of the node, the configured id or
+// the flavor the configured name or id refers to
+func nodeFlavorID(node configNode) (string, error) {
+
+	ref := node.VMSize
+	if node.FlavorID != "" {
+		ref = node.FlavorID
+	}
+	id, err := resolveFlavor(ref, flavors)
+	if err != nil {
+		return "", newResourceError("get flavor", ref, err)
+	}
+	if node.FlavorID != "" && id != node.FlavorID {
+		return "", newResourceError("get flavor", ref, &notFoundError{Kind: "flavor"})
+	}
+	return id, nil
+}
+
+// findServer returns the cluster member with the given name
+func findServer(name string) (compute.ServerDetail, bool) {
+
+	for _, v := range servers {
+		if v.Name == name {
+			return v, true
 		}
 	}
-	return "", fmt.Errorf("No master IP address found")
+	return compute.ServerDetail{}, false
 }
 
-/*
-	CoreOS Cluster Discovery ID
-	See https://coreos.com/docs/cluster-management/setup/cluster-discovery/
-	for details
-*/
-func getDiscoveryKey() string {
+func findServerByID(id string) (compute.ServerDetail, bool) {
 
-	req := gorequest.New()
+	for _, v := range servers {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return compute.ServerDetail{}, false
+}
 
-	_, body, errs := req.Get("https://discovery.etcd.io/new").
-		Set("Content-Type", "text/plain").
-		Set("Accept", "text/plain").
-		End()
+// findPort returns the port attached to the cluster member with the given
+// name. Ports are matched by the server owning them, never by name. When
+// the node has no server, the unattached port recorded in the state is
+// returned.
+func findPort(name string) (network.PortResponse, bool) {
 
-	if errs != nil {
-		err := errs[len(errs)-1]
-		log.Fatal(err.Error())
+	server, ok := findServer(name)
+	portID := nodeStateOf(name).PortID
+
+	for _, v := range ports {
+		if ok && v.DeviceID == server.ID {
+			return v, true
+		}
+		if !ok && v.DeviceID == "" && v.ID == portID {
+			return v, true
+		}
 	}
+	return network.PortResponse{}, false
+}
+
+// nodeNames returns the nodes in the configuration followed by the nodes
+// only found in the state, like those added without --save.
+func nodeNames() []string {
+
+	names := append([]string(nil), config.OrderedNodeKeys...)
 
-	return string(body)
+	var extra []string
+	for k := range state.Nodes {
+		if _, ok := config.Nodes[k]; !ok {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+
+	return append(names, extra...)
 }
 
-func noErrorOn404(err error) error {
+func portIP(port network.PortResponse) string {
 
-	if err != nil {
-		errStatusCode := err.(misc.HTTPStatus)
-		if errStatusCode.StatusCode != 404 {
-			// fmt.Println("error found in noerroron404", err)
-			return err
+	if len(port.FixedIPs) == 0 {
+		return ""
+	}
+	return port.FixedIPs[0].IPAddress
+}
+
+// serverAddresses returns the fixed and floating IP address of a server
+func serverAddresses(server compute.ServerDetail) (fixedIP string, floatingIP string) {
+
+	for _, addresses := range server.Addresses {
+		for _, a := range addresses {
+			switch a.Type {
+			case "fixed":
+				fixedIP = a.Addr
+			case "floating":
+				floatingIP = a.Addr
+			}
 		}
 	}
-	return nil
+	return
+}
+
+func reportDrift(name string, attribute string, expected string, actual string) {
+
+	if expected != actual {
+		log.Printf("%-20s - %s %s %s (expected %s)\n", "drift", name, attribute, actual, expected)
+	}
+}
+
+func valueOrDHCP(value string) string {
+
+	if value == "" {
+		return "DHCP"
+	}
+	return value
+}
+
+func valueOrDash(value string) string {
+
+	if value == "" {
+		return "-"
+	}
+	return value
 }
 
 // PortByName - sort functions for network ports by name
@@ -658,7 +1331,7 @@ func (a PortByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a PortByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 
 // ServerByName - sort functions for server by name
-type ServerByName []compute.Server
+type ServerByName []compute.ServerDetail
 
 func (a ServerByName) Len() int           { return len(a) }
 func (a ServerByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,1005 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+const testConfig = `cluster:
+  name: test-cluster
+  sshkey: kube-key
+  network: kube-net
+  master-ip: 192.168.1.140
+
+templates:
+  master:
+    hostname: kube-master
+    image-name: CoreOS
+    flavor-name: standard.medium
+    availabilityZone: az2
+  node:
+    hostname: kube-node
+    count: 2
+    image-name: CoreOS
+    flavor-name: standard.small
+    availabilityZone: az2
+`
+
+type testEnv struct {
+	t           *testing.T
+	dir         string
+	config      string
+	provider    *fakeProvider
+	discoveries int
+}
+
+// newTestEnv runs the tasks inside a temporary directory against an
+// in-memory provider, so no OpenStack endpoint or network is needed.
+func newTestEnv(t *testing.T) *testEnv {
+
+	dir, err := ioutil.TempDir("", "kubesetup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &testEnv{t: t, dir: dir, config: filepath.Join(dir, DefaultConfig), provider: newFakeProvider()}
+
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.discoveries++
+		fmt.Fprintf(w, "http://discovery.local/token-%d", env.discoveries)
+	}))
+	env.writeConfig(testConfig)
+
+	savedProvider, savedPoll, savedDiscovery := newProvider, pollInterval, discoveryURL
+	savedMaxPoll, savedKeyBits := maxPollInterval, pkiKeyBits
+	newProvider = func(c *cli.Context) (Provider, error) { return env.provider, nil }
+	pollInterval = time.Millisecond
+	maxPollInterval = 10 * time.Millisecond
+	discoveryURL = discovery.URL
+	pkiKeyBits = 1024
+	// install merges the cluster into ~/.kube/config
+	t.Setenv("HOME", dir)
+
+	t.Cleanup(func() {
+		newProvider, pollInterval, discoveryURL = savedProvider, savedPoll, savedDiscovery
+		maxPollInterval, pkiKeyBits = savedMaxPoll, savedKeyBits
+		discovery.Close()
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+	})
+
+	return env
+}
+
+func (env *testEnv) writeConfig(content string) {
+
+	if err := ioutil.WriteFile(env.config, []byte(content), 0644); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+// context returns a cli context for a command with the given local flags
+// and arguments.
+func (env *testEnv) context(flags []cli.Flag, args ...string) *cli.Context {
+
+	globalSet := flag.NewFlagSet("hpcloud-kubesetup", flag.ContinueOnError)
+	globalSet.String(Config, env.config, "")
+	globalSet.Bool(Debug, false, "")
+	globalSet.Bool(SkipSSLValidation, false, "")
+
+	set := flag.NewFlagSet("command", flag.ContinueOnError)
+	for _, f := range flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		env.t.Fatal(err)
+	}
+
+	return cli.NewContext(nil, set, globalSet)
+}
+
+func (env *testEnv) command(name string) []cli.Flag {
+
+	for _, v := range newApp().Commands {
+		if v.Name == name {
+			return v.Flags
+		}
+	}
+	env.t.Fatalf("command %s not found", name)
+	return nil
+}
+
+func (env *testEnv) clusterServers() []string {
+
+	all, _ := env.provider.ServerDetails()
+	members, _, _ := clusterServers(all, "test-cluster")
+
+	var names []string
+	for _, v := range members {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func TestInstall(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+
+	if got := len(env.clusterServers()); got != 3 {
+		t.Fatalf("expected 3 cluster servers, got %d", got)
+	}
+
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+
+		found := env.provider.serversNamed(name)
+		if len(found) != 1 {
+			t.Fatalf("expected one server %s, got %d", name, len(found))
+		}
+		if found[0].Status != "ACTIVE" {
+			t.Errorf("server %s is %s, expected ACTIVE", name, found[0].Status)
+		}
+		if found[0].MetaData[MetaCluster] != "test-cluster" || found[0].MetaData[MetaClusterID] == "" {
+			t.Errorf("server %s is not tagged: %v", name, found[0].MetaData)
+		}
+		if _, err := os.Stat(cloudConfigPath(name)); err != nil {
+			t.Errorf("cloud-config for %s not written: %v", name, err)
+		}
+	}
+
+	if role := env.provider.serversNamed("kube-master")[0].MetaData[MetaRole]; role != "master" {
+		t.Errorf("expected master role, got %s", role)
+	}
+}
+
+func TestInstallTwiceKeepsExistingNodes(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+	before := env.provider.serversNamed("kube-master")[0].ID
+
+	installAction(env.context(env.command(Install)))
+
+	if got := len(env.clusterServers()); got != 3 {
+		t.Fatalf("expected 3 cluster servers, got %d", got)
+	}
+	if after := env.provider.serversNamed("kube-master")[0].ID; after != before {
+		t.Errorf("master was recreated: %s != %s", after, before)
+	}
+	if got := len(env.provider.floatingIPs); got != 1 {
+		t.Errorf("expected 1 floating IP, got %d", got)
+	}
+}
+
+func TestInstallRecreate(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+	before := env.provider.serversNamed("kube-master")[0].ID
+
+	installAction(env.context(env.command(Install), "--"+Recreate))
+
+	if got := len(env.clusterServers()); got != 3 {
+		t.Fatalf("expected 3 cluster servers, got %d", got)
+	}
+	if after := env.provider.serversNamed("kube-master")[0].ID; after == before {
+		t.Errorf("master was not recreated")
+	}
+	if got := len(env.provider.ports); got != 3 {
+		t.Errorf("expected 3 ports, got %d", got)
+	}
+}
+
+func TestUninstallLeavesForeignServers(t *testing.T) {
+
+	env := newTestEnv(t)
+	foreign := env.provider.addForeignServer("kube-node-1", "192.168.1.50")
+
+	installAction(env.context(env.command(Install)))
+	uninstallAction(env.context(nil))
+
+	if got := len(env.clusterServers()); got != 0 {
+		t.Fatalf("expected no cluster servers, got %d", got)
+	}
+
+	remaining := env.provider.serversNamed("kube-node-1")
+	if len(remaining) != 1 || remaining[0].ID != foreign.ID {
+		t.Fatalf("foreign server was deleted: %v", remaining)
+	}
+	if got := len(env.provider.ports); got != 1 {
+		t.Errorf("expected only the foreign port to remain, got %d ports", got)
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	c := env.context(nil)
+	if err := initTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if healthy, _ := statusTask(c); healthy {
+		t.Errorf("expected an unhealthy status before install")
+	}
+
+	installAction(env.context(env.command(Install)))
+
+	c = env.context(nil)
+	if err := initTask(c); err != nil {
+		t.Fatal(err)
+	}
+	if healthy, _ := statusTask(c); !healthy {
+		t.Errorf("expected a healthy status after install")
+	}
+}
+
+func TestAssignIPAddressLeavesSpareIP(t *testing.T) {
+
+	env := newTestEnv(t)
+	spare, _ := env.provider.CreateFloatingIP("")
+
+	installAction(env.context(env.command(Install)))
+
+	if got := len(env.provider.floatingIPs); got != 2 {
+		t.Fatalf("expected a new floating IP to be allocated, got %d floating IPs", got)
+	}
+	if env.provider.floatingIPs[spare.ID].InstanceID != "" {
+		t.Errorf("the spare floating IP %s was taken", spare.IP)
+	}
+
+	uninstallAction(env.context(nil))
+
+	if got := len(env.provider.floatingIPs); got != 2 {
+		t.Errorf("expected the floating IPs to be kept without release, got %d", got)
+	}
+}
+
+// floatingIPConfig is testConfig with a floating-ip section
+func floatingIPConfig(section string) string {
+	return strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  floating-ip:\n"+section, 1)
+}
+
+func TestAssignIPAddressWorkersAndRelease(t *testing.T) {
+
+	env := newTestEnv(t)
+	spare, _ := env.provider.CreateFloatingIP("")
+	env.writeConfig(floatingIPConfig("    pool: public\n    workers: true\n    release: true\n"))
+
+	installAction(env.context(env.command(Install)))
+
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+		n := env.state().Nodes[name]
+		if !n.FloatingIPAllocated || env.provider.floatingIPs[n.FloatingIPID].Pool != "public" {
+			t.Errorf("expected %s to get an address allocated from the pool, got %+v", name, n)
+		}
+		if _, floatingIP := serverAddresses(env.provider.serversNamed(name)[0]); floatingIP != n.FloatingIP {
+			t.Errorf("expected %s to be associated with %s, got %s", name, n.FloatingIP, floatingIP)
+		}
+	}
+
+	uninstallAction(env.context(nil))
+
+	if len(env.provider.floatingIPs) != 1 || env.provider.floatingIPs[spare.ID].ID != spare.ID {
+		t.Errorf("expected only the spare floating IP to remain, got %v", env.provider.floatingIPs)
+	}
+}
+
+func TestAddAssignsFloatingIPToWorker(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(floatingIPConfig("    workers: true\n"))
+
+	installAction(env.context(env.command(Install)))
+
+	// the new worker needs a floating IP the tenant has no quota left for
+	env.provider.limits.AbsoluteLimits.MaxTotalFloatingIps = len(env.provider.floatingIPs)
+	err := runTasks(env.context(env.command(Add), "kube-node-3"), initTask, addTask)
+	if err == nil || !strings.Contains(err.Error(), "floatingIPs") {
+		t.Fatalf("expected the floating IP to exceed the quota, got %v", err)
+	}
+
+	env.provider.limits.AbsoluteLimits.MaxTotalFloatingIps = -1
+	if err := runTasks(env.context(env.command(Add), "kube-node-3"), initTask, addTask); err != nil {
+		t.Fatal(err)
+	}
+
+	n := env.state().Nodes["kube-node-3"]
+	if !n.FloatingIPAllocated || n.FloatingIP == "" {
+		t.Fatalf("expected kube-node-3 to get a floating IP, got %+v", n)
+	}
+	if _, floatingIP := serverAddresses(env.provider.serversNamed("kube-node-3")[0]); floatingIP != n.FloatingIP {
+		t.Errorf("expected kube-node-3 to be associated with %s, got %s", n.FloatingIP, floatingIP)
+	}
+}
+
+func TestAssignIPAddressConfiguredAddress(t *testing.T) {
+
+	env := newTestEnv(t)
+	reserved, _ := env.provider.CreateFloatingIP("")
+	env.writeConfig(floatingIPConfig("    address: " + reserved.IP + "\n    release: true\n"))
+
+	installAction(env.context(env.command(Install)))
+
+	if _, floatingIP := serverAddresses(env.provider.serversNamed("kube-master")[0]); floatingIP != reserved.IP {
+		t.Errorf("expected master to get %s, got %s", reserved.IP, floatingIP)
+	}
+	if got := len(env.provider.floatingIPs); got != 1 {
+		t.Errorf("expected no floating IP to be allocated, got %d", got)
+	}
+
+	uninstallAction(env.context(nil))
+
+	if _, ok := env.provider.floatingIPs[reserved.ID]; !ok {
+		t.Errorf("the configured floating IP %s was released", reserved.IP)
+	}
+}
+
+func TestAssignIPAddressRefusesAddressInUse(t *testing.T) {
+
+	env := newTestEnv(t)
+	foreign := env.provider.addForeignServer("other", "192.168.1.50")
+	taken, _ := env.provider.CreateFloatingIP("")
+	if err := env.provider.ServerAction(foreign.ID, "addFloatingIp", "address", taken.IP); err != nil {
+		t.Fatal(err)
+	}
+	env.writeConfig(floatingIPConfig("    address: " + taken.IP + "\n"))
+
+	c := env.context(env.command(Install))
+	err := runTasks(c, initTask, installTask, assignIPAddressTask)
+	if err == nil || !strings.Contains(err.Error(), "associated with server "+foreign.ID) {
+		t.Errorf("expected the address to be refused, got %v", err)
+	}
+}
+
+func (env *testEnv) state() clusterState {
+
+	s, err := readStateFile(filepath.Join(env.dir, ".kubesetup-state.json"))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return s
+}
+
+func TestInstallWritesState(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+
+	s := env.state()
+	if s.Name != "test-cluster" || s.ClusterID == "" || s.DiscoveryURL != "" || len(s.EtcdMembers) != 0 {
+		t.Errorf("unexpected cluster state: %+v", s)
+	}
+
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+
+		n := s.Nodes[name]
+		if n.ServerID != env.provider.serversNamed(name)[0].ID {
+			t.Errorf("server of %s not recorded: %+v", name, n)
+		}
+		if _, ok := env.provider.ports[n.PortID]; !ok {
+			t.Errorf("port of %s not recorded: %+v", name, n)
+		}
+		if hash, _ := cloudConfigHash(cloudConfigPath(name)); n.CloudConfigHash != hash {
+			t.Errorf("cloud-config hash of %s not recorded: %+v", name, n)
+		}
+	}
+
+	if n := s.Nodes["kube-master"]; n.FloatingIPID == "" || env.provider.floatingIPs[n.FloatingIPID].IP != n.FloatingIP {
+		t.Errorf("floating IP of master not recorded: %+v", n)
+	}
+
+	master := s.Nodes["kube-master"]
+
+	uninstallAction(env.context(nil))
+
+	// only the floating IP kept for the next install is left
+	s = env.state()
+	if len(s.Nodes) != 0 || len(s.KeptFloatingIPs) != 1 || s.KeptFloatingIPs[0].ID != master.FloatingIPID {
+		t.Errorf("expected the state to hold only the kept floating IP, got %+v", s)
+	}
+
+	env.writeConfig(floatingIPConfig("    release: true\n"))
+	installAction(env.context(env.command(Install)))
+	uninstallAction(env.context(nil))
+
+	if _, err := os.Stat(filepath.Join(env.dir, ".kubesetup-state.json")); !os.IsNotExist(err) {
+		t.Errorf("state file not removed by uninstall: %v", err)
+	}
+}
+
+func TestInstallReusesKeptFloatingIP(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	for i := 0; i < 3; i++ {
+		installAction(env.context(env.command(Install)))
+		uninstallAction(env.context(nil))
+	}
+
+	if len(env.provider.floatingIPs) != 1 {
+		t.Errorf("expected every install to reuse the kept floating IP, got %d", len(env.provider.floatingIPs))
+	}
+
+	// the kept address needs no quota
+	env.provider.limits.AbsoluteLimits.MaxTotalFloatingIps = 1
+	installAction(env.context(env.command(Install)))
+
+	if n := env.state().Nodes["kube-master"]; !n.FloatingIPAllocated || env.provider.floatingIPs[n.FloatingIPID].IP != n.FloatingIP {
+		t.Errorf("expected the master to get the kept floating IP, got %+v", n)
+	}
+	if len(env.state().KeptFloatingIPs) != 0 {
+		t.Errorf("expected the reused floating IP to leave the kept ones, got %+v", env.state().KeptFloatingIPs)
+	}
+}
+
+// etcdConfig is testConfig with the given etcd section
+func etcdConfig(section string) string {
+	return strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  etcd:\n"+section, 1)
+}
+
+// assertCloudConfig fails unless the cloud-config of a node contains every
+// line
+func (env *testEnv) assertCloudConfig(name string, lines ...string) {
+
+	b, err := ioutil.ReadFile(cloudConfigPath(name))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	for _, v := range lines {
+		if !strings.Contains(string(b), "\n"+v+"\n") {
+			env.t.Errorf("cloud-config of %s lacks %q", name, v)
+		}
+	}
+}
+
+func TestInstallStaticEtcd(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+
+	if env.discoveries != 0 {
+		t.Errorf("expected no discovery token in static mode, got %d", env.discoveries)
+	}
+	env.assertCloudConfig("kube-master", "    name: master", "    initial-cluster: master=http://192.168.1.140:2380")
+	env.assertCloudConfig("kube-node-1", "    initial-cluster: master=http://192.168.1.140:2380", "    proxy: on")
+}
+
+func TestInstallStaticEtcdMembers(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(etcdConfig("    members: [kube-node-2]\n"))
+
+	installAction(env.context(env.command(Install)))
+
+	initialCluster := "    initial-cluster: master=http://192.168.1.140:2380,kube-node-2=http://192.168.1.142:2380"
+	env.assertCloudConfig("kube-master", initialCluster)
+	env.assertCloudConfig("kube-node-2", "    name: kube-node-2", initialCluster, "    listen-peer-urls: http://192.168.1.142:2380,http://localhost:2380")
+	env.assertCloudConfig("kube-node-1", initialCluster, "    proxy: on")
+
+	members := env.state().EtcdMembers
+	if len(members) != 1 || members[0] != (etcdMember{Name: "kube-node-2", IP: "192.168.1.142"}) {
+		t.Errorf("expected kube-node-2 as etcd member in the state, got %+v", members)
+	}
+
+	err := runTasks(env.context(env.command(Remove), "kube-node-2"), initTask, removeTask)
+	if err == nil || !strings.Contains(err.Error(), "etcd member") {
+		t.Errorf("expected the removal of an etcd member to be refused, got %v", err)
+	}
+}
+
+func TestInstallSelfHostedDiscovery(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(etcdConfig("    discovery: " + discoveryURL + "\n"))
+	discoveryURL = "http://discovery.invalid/new"
+
+	installAction(env.context(env.command(Install)))
+
+	if env.discoveries != 1 {
+		t.Fatalf("expected a token from the self-hosted service, got %d", env.discoveries)
+	}
+	env.assertCloudConfig("kube-master", "    discovery: http://discovery.local/token-1")
+	env.assertCloudConfig("kube-node-1", "    discovery: http://discovery.local/token-1", "    proxy: on")
+}
+
+func TestInstallKubernetesRelease(t *testing.T) {
+
+	env := newTestEnv(t)
+	kubeletDigest := strings.Repeat("ab", 32)
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  kubernetes:\n    version: v1.2\n    base-url: http://mirror.local/kubernetes/\n    sha256:\n      kubelet: "+kubeletDigest+"\n", 1))
+
+	installAction(env.context(env.command(Install)))
+
+	env.assertCloudConfig("kube-master", "        ExecStartPre=/opt/bin/fetch http://mirror.local/kubernetes/v1.2.7/bin/linux/amd64/kube-apiserver /opt/bin/kube-apiserver "+kubeManifest["v1.2.7"]["kube-apiserver"])
+	env.assertCloudConfig("kube-node-1", "        ExecStartPre=/opt/bin/fetch http://mirror.local/kubernetes/v1.2.7/bin/linux/amd64/kubelet /opt/bin/kubelet "+kubeletDigest)
+
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  kubernetes:\n    version: v1.8.0\n", 1))
+
+	err := runTasks(env.context(env.command(Install)), initTask, kubernetesTask)
+	if err == nil || !strings.Contains(err.Error(), "--api-servers") {
+		t.Errorf("expected v1.8.0 to be refused, got %v", err)
+	}
+}
+
+func TestInstallReusesDiscoveryURL(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(etcdConfig("    discovery: public\n"))
+
+	installAction(env.context(env.command(Install)))
+	installAction(env.context(env.command(Install)))
+
+	if env.discoveries != 1 {
+		t.Errorf("expected a single discovery token, got %d", env.discoveries)
+	}
+
+	installAction(env.context(env.command(Install), "--"+Recreate))
+
+	if env.discoveries != 2 {
+		t.Errorf("expected a new discovery token for a recreated cluster, got %d", env.discoveries)
+	}
+}
+
+func TestUninstallDeletesPortsFromState(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+
+	// the server is deleted behind our back, its port is left over
+	lost := env.provider.serversNamed("kube-node-1")[0]
+	env.provider.DeleteServer(lost.ID)
+
+	uninstallAction(env.context(nil))
+
+	if got := len(env.provider.ports); got != 0 {
+		t.Errorf("expected all ports to be deleted, got %d", got)
+	}
+}
+
+func TestInstallDHCP(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "", 1))
+
+	installAction(env.context(env.command(Install)))
+
+	addresses := make(map[string]string)
+	for _, v := range env.provider.ports {
+		addresses[v.Name] = portIP(v)
+	}
+	if addresses["kube-master"] != "192.168.1.2" {
+		t.Fatalf("expected the master to get the first address of the pool, got %v", addresses)
+	}
+
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+
+		if addresses[name] == "" {
+			t.Fatalf("port of %s has no address", name)
+		}
+		b, err := ioutil.ReadFile(cloudConfigPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), addresses[name]) {
+			t.Errorf("cloud-config of %s does not use its address %s", name, addresses[name])
+		}
+		if !strings.Contains(string(b), "http://"+addresses["kube-master"]+":2380") {
+			t.Errorf("cloud-config of %s does not point at the master %s", name, addresses["kube-master"])
+		}
+	}
+}
+
+func TestInstallResolvesIDsAndSubnet(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.provider.networks[0].Subnets = append(env.provider.networks[0].Subnets, "subnet-2")
+	env.provider.subnets = append(env.provider.subnets, network.SubnetResponse{
+		ID:              "subnet-2",
+		Name:            "kube-subnet",
+		NetworkID:       "net-1",
+		CIDR:            "10.0.0.0/24",
+		AllocationPools: []network.AllocationPool{{Start: "10.0.0.10", End: "10.0.0.20"}},
+	})
+
+	config := strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  subnet: kube-subnet\n", 1)
+	config = strings.Replace(config, "network: kube-net", "network: net-1", 1)
+	config = strings.Replace(config, "image-name: CoreOS", "image-name: image-1", -1)
+	config = strings.Replace(config, "flavor-name: standard.small", "flavor-name: \"101\"", 1)
+	env.writeConfig(config)
+
+	installAction(env.context(env.command(Install)))
+
+	for _, v := range env.provider.ports {
+		if v.FixedIPs[0].SubnetID != "subnet-2" || !strings.HasPrefix(portIP(v), "10.0.0.") {
+			t.Errorf("port %s is not on the configured subnet: %v", v.Name, v.FixedIPs)
+		}
+	}
+	if got := env.provider.serversNamed("kube-node-1")[0].Flavor.ID; got != "101" {
+		t.Errorf("expected flavor 101, got %s", got)
+	}
+}
+
+func TestInstallRejectsAmbiguousNetwork(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.provider.networks = append(env.provider.networks, network.Response{ID: "net-2", Name: "kube-net", Subnets: []string{"subnet-1"}})
+
+	err := runTasks(env.context(env.command(Install)), initTask)
+	if err == nil || !strings.Contains(err.Error(), "ambiguous, use the ID: net-1 (kube-net), net-2 (kube-net)") {
+		t.Errorf("expected the candidates to be listed, got %v", err)
+	}
+}
+
+func TestInstallCreatesSecurityGroups(t *testing.T) {
+
+	env := newTestEnv(t)
+	foreign, _ := env.provider.CreateSecurityGroup(network.CreateSecurityGroupParameters{Name: "test-cluster-internal"})
+
+	installAction(env.context(env.command(Install)))
+
+	groups := make(map[string]network.SecurityGroup)
+	for _, v := range env.provider.groups {
+		if v.ID != foreign.ID {
+			groups[v.Name] = v
+		}
+	}
+	internal, external := groups["test-cluster-internal"], groups["test-cluster-external"]
+	if internal.ID == "" || external.ID == "" {
+		t.Fatalf("expected internal and external groups, got %v", groups)
+	}
+	if got := len(internal.SecurityGroupRules); got != len(internalRules) {
+		t.Errorf("expected %d internal rules, got %d", len(internalRules), got)
+	}
+	for _, v := range internal.SecurityGroupRules {
+		if stringValue(v.RemoteGroupID) != internal.ID {
+			t.Errorf("internal rule %d-%d is not limited to the group", *v.PortRangeMin, *v.PortRangeMax)
+		}
+	}
+	if got := len(external.SecurityGroupRules); got != 1 || *external.SecurityGroupRules[0].PortRangeMin != 22 ||
+		stringValue(external.SecurityGroupRules[0].RemoteIPPrefix) != DefaultExternalCIDR {
+		t.Errorf("expected only SSH from %s, got %d rules", DefaultExternalCIDR, got)
+	}
+
+	for _, v := range env.provider.ports {
+		if len(v.SecurityGroups) != 2 || v.SecurityGroups[0] != internal.ID || v.SecurityGroups[1] != external.ID {
+			t.Errorf("port %s has groups %v", v.Name, v.SecurityGroups)
+		}
+	}
+
+	installAction(env.context(env.command(Install)))
+	if got := len(env.provider.groups); got != 3 {
+		t.Errorf("expected a second install to reuse the groups, got %d groups", got)
+	}
+
+	uninstallAction(env.context(nil))
+
+	if len(env.provider.groups) != 1 || env.provider.groups[foreign.ID].ID != foreign.ID {
+		t.Errorf("expected only the foreign group to remain, got %v", env.provider.groups)
+	}
+}
+
+func TestInstallExposeAPI(t *testing.T) {
+
+	env := newTestEnv(t)
+	config := strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  external-cidr: 10.1.0.0/16\n  expose-api: true\n", 1)
+	env.writeConfig(config)
+
+	installAction(env.context(env.command(Install)))
+
+	ports := make(map[int]bool)
+	for _, v := range env.provider.groups {
+		if v.Name != "test-cluster-external" {
+			continue
+		}
+		for _, rule := range v.SecurityGroupRules {
+			if stringValue(rule.RemoteIPPrefix) != "10.1.0.0/16" {
+				t.Errorf("rule %d is open to %s", *rule.PortRangeMin, stringValue(rule.RemoteIPPrefix))
+			}
+			ports[*rule.PortRangeMin] = true
+		}
+	}
+	if !ports[22] || !ports[KubeAPISecurePort] || ports[KubeAPIPort] {
+		t.Errorf("expected SSH and the secure port of the API server to be exposed, got %v", ports)
+	}
+}
+
+func TestInstallSecuresAPIServer(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	installAction(env.context(env.command(Install)))
+
+	env.assertCloudConfig("kube-master",
+		"  - path: /etc/kubernetes/ssl/apiserver-key.pem",
+		"        --insecure-bind-address=127.0.0.1 \\",
+		"        --insecure-port=8080 \\",
+		"        --secure-port=443 \\",
+		"        --master=127.0.0.1:8080",
+		"        --client-ca-file=/etc/kubernetes/ssl/ca.pem \\")
+	env.assertCloudConfig("kube-node-1",
+		"  - path: /etc/kubernetes/ssl/kubelet-key.pem",
+		"        --api-servers=https://192.168.1.140:443 \\",
+		"        --kubeconfig=/etc/kubernetes/kubelet-kubeconfig.yaml \\",
+		"        --master=https://192.168.1.140:443 \\")
+
+	b, err := ioutil.ReadFile(cloudConfigPath("kube-node-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "apiserver-key.pem") || strings.Contains(string(b), "/ca-key.pem") {
+		t.Errorf("cloud-config of a worker holds a key it must not have")
+	}
+
+	// the certificate of the API server covers the floating IP the master
+	// was associated with
+	dir := filepath.Join(env.dir, ".kubesetup-pki")
+	pkiDir = dir
+	kp, err := readKeyPair(pkiAPIServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floatingIP := env.state().Nodes["kube-master"].FloatingIP
+	if floatingIP == "" || kp.Cert.VerifyHostname(floatingIP) != nil {
+		t.Errorf("certificate of the API server does not cover the floating IP %q", floatingIP)
+	}
+
+	// the cloud-configs hold private keys, they are readable by the owner
+	// only and kept with the key pairs
+	for _, name := range []string{"kube-master", "kube-node-1", "kube-node-2"} {
+		fi, err := os.Stat(filepath.Join(dir, name+".yml"))
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("expected the cloud-config of %s to be readable by the owner only: %v %v", name, fi, err)
+		}
+	}
+
+	err = runTasks(env.context(env.command(Remove), "kube-node-2"), initTask, removeTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "kube-node-2.yml")); !os.IsNotExist(err) {
+		t.Errorf("expected the cloud-config of the removed node to be deleted, got %v", err)
+	}
+
+	uninstallAction(env.context(nil))
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected the certificates and cloud-configs to be removed, got %v", err)
+	}
+}
+
+// createNetworkConfig is testConfig on a network install creates
+var createNetworkConfig = strings.Replace(testConfig, "  network: kube-net\n  master-ip: 192.168.1.140\n", `  network: new-net
+  create-network:
+    cidr: 10.10.0.0/24
+    pool-start: 10.10.0.100
+    pool-end: 10.10.0.200
+`, 1)
+
+func TestInstallCreatesNetwork(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(createNetworkConfig)
+
+	installAction(env.context(env.command(Install)))
+
+	n := env.state().Network
+	if n.NetworkID == "" || n.SubnetID == "" || n.RouterID == "" || !n.RouterInterface {
+		t.Fatalf("expected the network, subnet and router in the state, got %+v", n)
+	}
+	created, err := env.provider.Network(n.NetworkID)
+	if err != nil || created.Name != "new-net" || len(created.Subnets) != 1 || created.Subnets[0] != n.SubnetID {
+		t.Fatalf("network not created: %+v %v", created, err)
+	}
+	if router := env.provider.routers[n.RouterID]; router.ExternalGatewayInfo.NetworkID != "ext-net-1" {
+		t.Errorf("expected the router gateway on ext-net-1, got %+v", router)
+	}
+	for _, v := range env.provider.ports {
+		if v.DeviceID == n.RouterID {
+			continue
+		}
+		if v.NetworkID != n.NetworkID || v.FixedIPs[0].SubnetID != n.SubnetID || !strings.HasPrefix(portIP(v), "10.10.0.1") {
+			t.Errorf("port %s is not in the allocation pool of the new subnet: %v", v.Name, v.FixedIPs)
+		}
+	}
+
+	installAction(env.context(env.command(Install)))
+	if got := len(env.provider.networks); got != 3 {
+		t.Errorf("expected a second install to reuse the network, got %d networks", got)
+	}
+
+	uninstallAction(env.context(nil))
+
+	if len(env.provider.networks) != 2 || len(env.provider.subnets) != 1 || len(env.provider.routers) != 0 || len(env.provider.ports) != 0 {
+		t.Errorf("expected the created network to be deleted, got %d networks, %d subnets, %d routers, %d ports",
+			len(env.provider.networks), len(env.provider.subnets), len(env.provider.routers), len(env.provider.ports))
+	}
+}
+
+func TestInstallResumesNetwork(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(createNetworkConfig)
+
+	// a run interrupted after the subnet was created
+	c := env.context(env.command(Install))
+	if err := runTasks(c, initTask); err != nil {
+		t.Fatal(err)
+	}
+	if err := createNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	if err := createSubnet(); err != nil {
+		t.Fatal(err)
+	}
+
+	installAction(env.context(env.command(Install)))
+
+	if got := len(env.provider.networks); got != 3 {
+		t.Errorf("expected the network to be reused, got %d networks", got)
+	}
+	if got := len(env.provider.subnets); got != 2 {
+		t.Errorf("expected the subnet to be reused, got %d subnets", got)
+	}
+	if n := env.state().Network; n.RouterID == "" || !n.RouterInterface {
+		t.Errorf("expected the router to be created, got %+v", n)
+	}
+}
+
+func TestInstallLeavesExistingNetwork(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(createNetworkConfig, "new-net", "kube-net", 1))
+
+	installAction(env.context(env.command(Install)))
+	uninstallAction(env.context(nil))
+
+	if len(env.provider.networks) != 2 || len(env.provider.subnets) != 1 || len(env.provider.routers) != 0 {
+		t.Errorf("expected the existing network to be used as it is, got %d networks, %d subnets, %d routers",
+			len(env.provider.networks), len(env.provider.subnets), len(env.provider.routers))
+	}
+}
+
+func TestAddSave(t *testing.T) {
+
+	env := newTestEnv(t)
+	installAction(env.context(env.command(Install)))
+
+	err := runTasks(env.context(env.command(Add), "--"+Save, "kube-node-3"), initTask, addTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `""`) || strings.Contains(string(b), "-id:") {
+		t.Errorf("expected no empty settings in the saved configuration:\n%s", b)
+	}
+
+	saved, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, ok := saved.Nodes["kube-node-3"]
+	if !ok || len(saved.Nodes) != 4 {
+		t.Fatalf("expected kube-node-3 in the saved configuration, got %v", saved.Nodes)
+	}
+	fixedIP := ""
+	for _, v := range env.provider.ports {
+		if v.Name == "kube-node-3" {
+			fixedIP = portIP(v)
+		}
+	}
+	if node.IP == "" || node.IP != fixedIP {
+		t.Errorf("expected kube-node-3 to be saved with the address %s, got %q", fixedIP, node.IP)
+	}
+}
+
+func TestAddSaveExtraHost(t *testing.T) {
+
+	env := newTestEnv(t)
+	installAction(env.context(env.command(Install)))
+
+	err := runTasks(env.context(env.command(Add), "--"+Save, "extra"), initTask, addTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node, ok := saved.Nodes["extra"]; !ok || node.IP == "" || len(saved.Nodes) != 4 {
+		t.Fatalf("expected extra to be saved with its address, got %v", saved.Nodes)
+	}
+}
+
+func TestAddSaveRefusesOtherFlavor(t *testing.T) {
+
+	env := newTestEnv(t)
+	installAction(env.context(env.command(Install)))
+	before, _ := ioutil.ReadFile(env.config)
+	ports := len(env.provider.ports)
+
+	err := runTasks(env.context(env.command(Add), "--"+Save, "--"+Flavor, "standard.medium", "kube-node-3"), initTask, addTask)
+	if err == nil || !strings.Contains(err.Error(), "kube-node-3 differs") {
+		t.Fatalf("expected the flavor to be refused, got %v", err)
+	}
+	if len(env.provider.serversNamed("kube-node-3")) != 0 || len(env.provider.ports) != ports {
+		t.Errorf("expected nothing to be created for a node that cannot be saved")
+	}
+	if after, _ := ioutil.ReadFile(env.config); string(after) != string(before) {
+		t.Errorf("expected the configuration to be unchanged")
+	}
+}
+
+func TestRemoveUpdatesConfig(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(testConfig, "    count: 2\n", "    count: 3\n", 1))
+	installAction(env.context(env.command(Install)))
+
+	// removing a worker in the middle leaves a gap in the numbering
+	err := runTasks(env.context(env.command(Remove), "kube-node-2"), initTask, removeTask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env.provider.serversNamed("kube-node-2")) != 0 {
+		t.Errorf("expected kube-node-2 to be deleted")
+	}
+
+	b, err := ioutil.ReadFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "    count: 3\n    exclude: [2]\n") {
+		t.Errorf("expected kube-node-2 to be excluded from the node template:\n%s", b)
+	}
+
+	saved, err := readConfigFile(env.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.Nodes["kube-node-2"]; ok || len(saved.Nodes) != 3 {
+		t.Errorf("expected kube-node-2 to be removed from the configuration, got %v", saved.Nodes)
+	}
+	if saved.Nodes["kube-node-3"].IP != "192.168.1.143" {
+		t.Errorf("expected kube-node-3 to keep its address, got %v", saved.Nodes["kube-node-3"])
+	}
+
+	// the configuration still describes the running cluster
+	if err := runTasks(env.context(env.command(Install)), initTask, quotaTask); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(env.clusterServers()); got != 3 {
+		t.Errorf("expected 3 cluster servers, got %d", got)
+	}
+}
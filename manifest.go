@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// kubeManifest holds the SHA-256 digests of the artifacts per Kubernetes
+// release, kube-register included, as printed by scripts/kube-digests.sh
+// from the binaries of the release. Digests configured in kubernetes.sha256
+// are added to these and replace them.
+var kubeManifest = map[string]map[string]string{}
+
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// kubeArtifacts are the names of the artifacts the cloud-configs download
+func kubeArtifacts() []string {
+
+	names := append(append([]string(nil), kubeMasterBinaries...), kubeNodeBinaries...)
+	return append(names, "kube-register")
+}
+
+// artifactDigests returns the digest of every artifact of the release that
+// has one, the known ones and those configured in kubernetes.sha256
+func artifactDigests(s kubernetesSection, version string) map[string]string {
+
+	digests := make(map[string]string)
+	for k, v := range kubeManifest[version] {
+		digests[k] = v
+	}
+	for k, v := range s.SHA256 {
+		digests[k] = v
+	}
+	return digests
+}
+
+// unverifiedArtifacts returns the artifacts of the release without a digest
+func unverifiedArtifacts(s kubernetesSection, version string) []string {
+
+	digests := artifactDigests(s, version)
+
+	var names []string
+	for _, v := range kubeArtifacts() {
+		if digests[v] == "" {
+			names = append(names, v)
+		}
+	}
+	return names
+}
+
+// checkVerified refuses a release with artifacts that cannot be verified,
+// unless skip-verify allows downloading them without a check
+func checkVerified(s kubernetesSection, version string) error {
+
+	if s.SkipVerify {
+		return nil
+	}
+	if names := unverifiedArtifacts(s, version); len(names) > 0 {
+		return fmt.Errorf("no sha256 known for %s of %s, add them to the sha256 of the kubernetes section or set skip-verify: true", strings.Join(names, ", "), version)
+	}
+	return nil
+}
+
+// checkDigests checks that the configured digests are SHA-256 digests of
+// known artifacts
+func checkDigests(s kubernetesSection) error {
+
+	known := make(map[string]bool)
+	for _, v := range kubeArtifacts() {
+		known[v] = true
+	}
+
+	var names []string
+	for k := range s.SHA256 {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		if !known[k] {
+			return fmt.Errorf("sha256 lists %s, which is not an artifact of the cluster", k)
+		}
+		if !digestPattern.MatchString(s.SHA256[k]) {
+			return fmt.Errorf("sha256 of %s is not a SHA-256 digest", k)
+		}
+	}
+	return nil
+}
+
+// logUnverified logs the artifacts of a release that skip-verify lets the
+// hosts download without verification
+func logUnverified(s kubernetesSection, version string) {
+
+	if !s.SkipVerify {
+		return
+	}
+	for _, v := range unverifiedArtifacts(s, version) {
+		log.Printf("%-20s - %s %s %s\n", "no digest", version, v, "download is not verified, skip-verify is set")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testKubeManifest returns made-up digests for the releases the tests
+// install, releases without digests are refused
+func testKubeManifest() map[string]map[string]string {
+
+	versions := []string{DefaultKubeVersion}
+	for _, v := range kubeReleaseLines {
+		versions = append(versions, v)
+	}
+
+	manifest := make(map[string]map[string]string)
+	for _, version := range versions {
+		manifest[version] = make(map[string]string)
+		for _, v := range kubeArtifacts() {
+			sum := sha256.Sum256([]byte(version + "/" + v))
+			manifest[version][v] = hex.EncodeToString(sum[:])
+		}
+	}
+	return manifest
+}
+
+// fetchScript writes the fetch helper of the cloud-configs to dir
+func fetchScript(t *testing.T, dir string) string {
+
+	if _, err := os.Stat("/usr/bin/wget"); err != nil {
+		t.Skip("fetch needs /usr/bin/wget")
+	}
+
+	content := fetchFile[strings.Index(fetchFile, "#!/bin/bash"):]
+	content = strings.Replace(content, "\n      ", "\n", -1)
+
+	script := filepath.Join(dir, "fetch")
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestFetchVerifiesDigest(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kubesetup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := fetchScript(t, dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("kubelet"))
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte("kubelet"))
+	digest := hex.EncodeToString(sum[:])
+	binary := filepath.Join(dir, "kubelet")
+
+	fetch := func(digest string) error {
+		cmd := exec.Command("/bin/bash", script, server.URL+"/kubelet", binary, digest)
+		cmd.Env = append(os.Environ(), "FETCH_TRIES=1")
+		return cmd.Run()
+	}
+
+	if err := fetch(digest); err != nil {
+		t.Fatalf("expected a matching download to succeed, got %v", err)
+	}
+	if fi, err := os.Stat(binary); err != nil || fi.Mode()&0100 == 0 {
+		t.Fatalf("expected an executable binary, got %v %v", fi, err)
+	}
+
+	if err := fetch(strings.Repeat("0", 64)); err == nil {
+		t.Errorf("expected a download that does not match to fail")
+	}
+	if _, err := os.Stat(binary); !os.IsNotExist(err) {
+		t.Errorf("expected the binary that does not match to be removed, got %v", err)
+	}
+
+	// a binary without a digest is only downloaded when that is asked for
+	if err := fetch(""); err == nil {
+		t.Errorf("expected a download without a digest to fail")
+	}
+	if _, err := os.Stat(binary); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be downloaded without a digest, got %v", err)
+	}
+	if err := fetch(FetchUnverified); err != nil {
+		t.Errorf("expected an unverified download to succeed, got %v", err)
+	}
+}
+
+func TestCheckDigests(t *testing.T) {
+
+	for digests, want := range map[string]string{
+		"kubelet=" + strings.Repeat("ab", 32): "",
+		"kubelet=abc":                         "not a SHA-256 digest",
+		"etcd=" + strings.Repeat("ab", 32):    "not an artifact",
+	} {
+		kv := strings.SplitN(digests, "=", 2)
+		err := checkDigests(kubernetesSection{SHA256: map[string]string{kv[0]: kv[1]}})
+		if (want == "" && err != nil) || (want != "" && (err == nil || !strings.Contains(err.Error(), want))) {
+			t.Errorf("%s: expected %q, got %v", digests, want, err)
+		}
+	}
+}
+
+var fetchLine = regexp.MustCompile(`/opt/bin/fetch (\S+) (\S+)( \S+)?\n`)
+
+// fetchedDigests returns the digest every fetch line of the cloud-configs
+// passes, by the name of the file it downloads
+func (env *testEnv) fetchedDigests(names ...string) map[string]string {
+
+	fetched := make(map[string]string)
+	for _, name := range names {
+
+		b, err := ioutil.ReadFile(cloudConfigPath(name))
+		if err != nil {
+			env.t.Fatal(err)
+		}
+		for _, m := range fetchLine.FindAllStringSubmatch(string(b), -1) {
+			fetched[filepath.Base(m[2])] = strings.TrimSpace(m[3])
+		}
+	}
+	return fetched
+}
+
+func TestInstallVerifiesEveryArtifact(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	// a configured digest replaces the known one
+	kubelet := strings.Repeat("ab", 32)
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  kubernetes:\n    sha256:\n      kubelet: "+kubelet+"\n", 1))
+
+	installAction(env.context(env.command(Install)))
+
+	fetched := env.fetchedDigests("kube-master", "kube-node-1")
+	for _, v := range kubeArtifacts() {
+		want := kubeManifest[DefaultKubeVersion][v]
+		if v == "kubelet" {
+			want = kubelet
+		}
+		if got, ok := fetched[v]; !ok || got != want {
+			t.Errorf("expected %s to be downloaded with sha256 %s, got %q", v, want, got)
+		}
+	}
+}
+
+func TestInstallRefusesUnverifiedRelease(t *testing.T) {
+
+	env := newTestEnv(t)
+	unknown := strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  kubernetes:\n    version: v1.2.4\n", 1)
+	env.writeConfig(unknown)
+
+	c := env.context(env.command(Install))
+	if err := runTasks(c, initTask, kubernetesTask); err == nil || !strings.Contains(err.Error(), "no sha256 known for kubectl") {
+		t.Fatalf("expected a release without digests to be refused, got %v", err)
+	}
+
+	// skip-verify lets the hosts download the release without a check
+	env.writeConfig(strings.Replace(unknown, "    version: v1.2.4\n", "    version: v1.2.4\n    skip-verify: true\n", 1))
+	installAction(env.context(env.command(Install)))
+
+	fetched := env.fetchedDigests("kube-master", "kube-node-1")
+	for _, v := range kubeArtifacts() {
+		if got := fetched[v]; got != FetchUnverified {
+			t.Errorf("expected %s to be downloaded unverified, got %q", v, got)
+		}
+	}
+}
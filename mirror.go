@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// kubeMasterBinaries and kubeNodeBinaries are the Kubernetes binaries the
+// master and the workers download from <base-url>/<version>/bin/linux/amd64
+var (
+	kubeMasterBinaries = []string{"kubectl", "kube-apiserver", "kube-controller-manager", "kube-scheduler"}
+	kubeNodeBinaries   = []string{"kubelet", "kube-proxy"}
+)
+
+// mirrorClient downloads the artifacts, dockerCommand saves the images
+var (
+	mirrorClient  = http.DefaultClient
+	dockerCommand = "docker"
+)
+
+// kubeBinaryURL returns where a Kubernetes binary of a release is found
+func kubeBinaryURL(baseURL string, version string, binary string) string {
+	return baseURL + "/" + version + "/bin/linux/amd64/" + binary
+}
+
+// mirrorDownloads returns every URL the cloud-configs download from
+func mirrorDownloads(config configContainer) ([]string, error) {
+
+	kube := config.kubernetes()
+	version, err := kubeVersion(kube)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, v := range append(append([]string(nil), kubeMasterBinaries...), kubeNodeBinaries...) {
+		urls = append(urls, kubeBinaryURL(kube.BaseURL, version, v))
+	}
+	return append(urls, KubeRegisterURL), nil
+}
+
+// mirrorPath returns the path of a download within the mirror, the host
+// followed by the path of the URL
+func mirrorPath(download string) (string, error) {
+
+	u, err := url.Parse(download)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("%q is not a URL", download)
+	}
+	return path.Join(u.Host, path.Clean("/"+u.Path)), nil
+}
+
+// mirrorImagePath returns the path of the archive of an image within the
+// mirror
+func mirrorImagePath(image string) string {
+	return path.Join("images", strings.Replace(image, ":", "_", -1)+".tar")
+}
+
+// mirrorURL returns the URL the hosts download from, the mirror when one
+// is configured
+func (config configContainer) mirrorURL(download string) string {
+
+	if config.Mirror == "" {
+		return download
+	}
+	p, err := mirrorPath(download)
+	if err != nil {
+		return download
+	}
+	return strings.TrimSuffix(config.Mirror, "/") + "/" + p
+}
+
+// mirrorImageURL returns the URL of the archive of an image on the mirror
+func (config configContainer) mirrorImageURL(image string) string {
+	return strings.TrimSuffix(config.Mirror, "/") + "/" + mirrorImagePath(image)
+}
+
+// mirrorTask downloads every artifact the cloud-configs refer to into the
+// --dir directory, files that are there already are kept. The images are
+// saved with docker. With --serve the directory is served over HTTP on
+// --listen afterwards, the mirror setting points the hosts at it.
+func mirrorTask(c *cli.Context) error {
+
+	filename := c.GlobalString(Config)
+
+	config, err := readConfigFile(filename)
+	if err != nil {
+		return newResourceError("read config", filename, err)
+	}
+
+	downloads, err := mirrorDownloads(config)
+	if err != nil {
+		return newResourceError("configure kubernetes", config.Name, err)
+	}
+
+	dir := c.String(Dir)
+	for _, v := range downloads {
+		if err := mirrorDownload(dir, v); err != nil {
+			return newResourceError("mirror", v, err)
+		}
+	}
+	if err := mirrorImage(dir, RegistryImage); err != nil {
+		return newResourceError("mirror", RegistryImage, err)
+	}
+
+	if !c.Bool(Serve) {
+		return nil
+	}
+
+	log.Printf("%-20s - %s %s\n", "serve mirror", dir, c.String(Listen))
+
+	return http.ListenAndServe(c.String(Listen), mirrorHandler(dir))
+}
+
+// mirrorHandler serves the mirror directory
+func mirrorHandler(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+// mirrorDownload downloads a URL into the mirror unless it is there
+func mirrorDownload(dir string, download string) error {
+
+	p, err := mirrorPath(download)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, filepath.FromSlash(p))
+
+	if _, err := os.Stat(filename); err == nil {
+		log.Printf("%-20s - %s %s\n", "mirror exists", download, filename)
+		return nil
+	}
+
+	log.Printf("%-20s - %s\n", "mirror", download)
+
+	resp, err := mirrorClient.Get(download)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET returned %s", resp.Status)
+	}
+
+	err = writeMirrorFile(filename, func(f *os.File) error {
+		_, err := io.Copy(f, resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "mirror", filename, "COMPLETED")
+
+	return nil
+}
+
+// mirrorImage saves an image into the mirror unless it is there
+func mirrorImage(dir string, image string) error {
+
+	filename := filepath.Join(dir, filepath.FromSlash(mirrorImagePath(image)))
+
+	if _, err := os.Stat(filename); err == nil {
+		log.Printf("%-20s - %s %s\n", "mirror exists", image, filename)
+		return nil
+	}
+
+	log.Printf("%-20s - %s\n", "mirror image", image)
+
+	if out, err := exec.Command(dockerCommand, "pull", image).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker pull: %s %s", err, strings.TrimSpace(string(out)))
+	}
+
+	err := writeMirrorFile(filename, func(f *os.File) error {
+		var stderr bytes.Buffer
+		cmd := exec.Command(dockerCommand, "save", image)
+		cmd.Stdout = f
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("docker save: %s %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "mirror image", filename, "COMPLETED")
+
+	return nil
+}
+
+// writeMirrorFile writes a file of the mirror through a temporary file, so
+// an interrupted download is never taken for a complete one
+func writeMirrorFile(filename string, write func(*os.File) error) error {
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename + ".part")
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// roundTripFunc sends every request of mirrorClient to a stand-in server
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// standInUpstream serves every download from a local server, answering
+// with the path that was asked for
+func (env *testEnv) standInUpstream() {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	target, _ := url.Parse(upstream.URL)
+
+	savedClient, savedDocker := mirrorClient, dockerCommand
+	mirrorClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	dockerCommand = filepath.Join(env.dir, "docker")
+	if err := ioutil.WriteFile(dockerCommand, []byte("#!/bin/sh\n[ \"$1\" = save ] && echo \"image $2\"\nexit 0\n"), 0755); err != nil {
+		env.t.Fatal(err)
+	}
+
+	env.t.Cleanup(func() {
+		mirrorClient, dockerCommand = savedClient, savedDocker
+		upstream.Close()
+	})
+}
+
+var wgetURL = regexp.MustCompile(`(?:wget|fetch) [^\n]*?(https?://[^\s']+)`)
+
+func TestMirror(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.standInUpstream()
+
+	dir := filepath.Join(env.dir, "artifacts")
+	if err := mirrorTask(env.context(env.command(Mirror), "--"+Dir, dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kubelet"))
+	if err != nil || string(b) != "/kubernetes-release/release/v1.0.1/bin/linux/amd64/kubelet" {
+		t.Errorf("kubelet not mirrored: %q %v", b, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "images/quay.io/devops/docker-registry_latest.tar")); err != nil || string(b) != "image "+RegistryImage+"\n" {
+		t.Errorf("registry image not mirrored: %q %v", b, err)
+	}
+
+	mirror := httptest.NewServer(mirrorHandler(dir))
+	defer mirror.Close()
+
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  mirror: "+mirror.URL+"/\n", 1))
+	installAction(env.context(env.command(Install)))
+
+	// every download of the cloud-configs is served by the mirror
+	for _, name := range []string{"kube-master", "kube-node-1"} {
+
+		b, err := ioutil.ReadFile(cloudConfigPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches := wgetURL.FindAllStringSubmatch(string(b), -1)
+		if len(matches) == 0 {
+			t.Fatalf("no downloads found in the cloud-config of %s", name)
+		}
+		for _, m := range matches {
+			if !strings.HasPrefix(m[1], mirror.URL+"/") {
+				t.Errorf("%s downloads %s from outside the mirror", name, m[1])
+				continue
+			}
+			resp, err := http.Get(m[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s downloads %s, which is not mirrored: %s", name, m[1], resp.Status)
+			}
+		}
+	}
+	env.assertCloudConfig("kube-master", "        ExecStartPre=/usr/bin/bash -c '/usr/bin/wget -q -O - "+mirror.URL+"/images/quay.io/devops/docker-registry_latest.tar | /usr/bin/docker load'")
+}
+
+func TestMirrorKeepsDownloads(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.standInUpstream()
+
+	dir := filepath.Join(env.dir, "artifacts")
+	kubelet := filepath.Join(dir, "storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kubelet")
+
+	if err := writeMirrorFile(kubelet, func(f *os.File) error { _, err := f.WriteString("kept"); return err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirrorTask(env.context(env.command(Mirror), "--"+Dir, dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(kubelet); string(b) != "kept" {
+		t.Errorf("expected the mirrored kubelet to be kept, got %q", b)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+// networkTask creates the network of the cluster when create-network is
+// configured and the network does not exist: the network, a subnet with
+// the configured CIDR and allocation pool, and a router with a gateway to
+// the external network the subnet is attached to. Every resource is
+// recorded in the state as it is created, a run that was interrupted
+// creates only what is missing. An existing network that was not created
+// by the cluster is used as it is.
+func networkTask(c *cli.Context) error {
+
+	if config.CreateNetwork == nil {
+		return nil
+	}
+	if netwrk.ID != "" && netwrk.ID != state.Network.NetworkID {
+		return nil
+	}
+
+	if err := checkNetworkSection(*config.CreateNetwork); err != nil {
+		return newResourceError("create network", config.Network, err)
+	}
+
+	if netwrk.ID == "" {
+		if err := createNetwork(); err != nil {
+			return err
+		}
+	}
+	if subnet.ID == "" {
+		if err := createSubnet(); err != nil {
+			return err
+		}
+	}
+	if state.Network.RouterID == "" {
+		if err := createRouter(); err != nil {
+			return err
+		}
+	}
+	if !state.Network.RouterInterface {
+		return addRouterInterface()
+	}
+	return nil
+}
+
+// checkNetworkSection checks the CIDR and that the allocation pool is
+// complete and lies within it
+func checkNetworkSection(s networkSection) error {
+
+	_, cidr, err := net.ParseCIDR(s.CIDR)
+	if err != nil || cidr.IP.To4() == nil {
+		return fmt.Errorf("cidr %q is not an IPv4 CIDR", s.CIDR)
+	}
+	if (s.PoolStart == "") != (s.PoolEnd == "") {
+		return fmt.Errorf("pool-start and pool-end have to be set together")
+	}
+	for _, v := range []string{s.PoolStart, s.PoolEnd} {
+		if v != "" && !cidr.Contains(net.ParseIP(v)) {
+			return fmt.Errorf("allocation pool address %q is not in %s", v, cidr)
+		}
+	}
+	return nil
+}
+
+func createNetwork() error {
+
+	log.Printf("%-20s - %s\n", "create network", config.Network)
+
+	n, err := provider.CreateNetwork(networkParameters{Name: config.Network, AdminStateUp: true})
+	if err != nil {
+		return newResourceError("create network", config.Network, err)
+	}
+	created.record(journalNetwork, n.ID, config.Network)
+
+	clusterMutex.Lock()
+	state.Network.NetworkID = n.ID
+	err = writeState()
+	clusterMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	netwrk = n
+
+	log.Printf("%-20s - %s %s %s\n", "create network", config.Network, n.ID, "COMPLETED")
+
+	return nil
+}
+
+// createSubnet creates the subnet of the network, named after it
+func createSubnet() error {
+
+	name := config.Network + "-subnet"
+	log.Printf("%-20s - %s %s\n", "create subnet", name, config.CreateNetwork.CIDR)
+
+	parameters := subnetParameters{
+		Name:      name,
+		NetworkID: netwrk.ID,
+		IPVersion: network.IPV4,
+		CIDR:      config.CreateNetwork.CIDR,
+	}
+	if config.CreateNetwork.PoolStart != "" {
+		parameters.AllocationPools = []network.AllocationPool{{Start: config.CreateNetwork.PoolStart, End: config.CreateNetwork.PoolEnd}}
+	}
+
+	s, err := provider.CreateSubnet(parameters)
+	if err != nil {
+		return newResourceError("create subnet", name, err)
+	}
+	created.record(journalSubnet, s.ID, name)
+
+	clusterMutex.Lock()
+	state.Network.SubnetID = s.ID
+	err = writeState()
+	clusterMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	subnet = s
+	subnets = append(subnets, s)
+	netwrk.Subnets = append(netwrk.Subnets, s.ID)
+
+	log.Printf("%-20s - %s %s %s\n", "create subnet", name, s.ID, "COMPLETED")
+
+	return nil
+}
+
+// createRouter creates a router with its gateway on the external network
+func createRouter() error {
+
+	external, err := externalNetwork(config.CreateNetwork.ExternalNetwork)
+	if err != nil {
+		return newResourceError("get external network", config.CreateNetwork.ExternalNetwork, err)
+	}
+
+	log.Printf("%-20s - %s %s\n", "create router", "gateway", external.Name)
+
+	router, err := provider.CreateRouter(external.ID)
+	if err != nil {
+		return newResourceError("create router", external.Name, err)
+	}
+	created.record(journalRouter, router.ID, router.ID)
+
+	clusterMutex.Lock()
+	state.Network.RouterID = router.ID
+	err = writeState()
+	clusterMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s\n", "create router", router.ID, "COMPLETED")
+
+	return nil
+}
+
+// addRouterInterface attaches the subnet to the router
+func addRouterInterface() error {
+
+	routerID := state.Network.RouterID
+	log.Printf("%-20s - %s %s\n", "attach subnet", routerID, subnet.ID)
+
+	if err := provider.AddRouterInterface(routerID, subnet.ID); err != nil {
+		return newResourceError("attach subnet to router", routerID, err)
+	}
+	created.record(journalRouterInterface, routerID, subnet.ID)
+
+	clusterMutex.Lock()
+	state.Network.RouterInterface = true
+	err := writeState()
+	clusterMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "attach subnet", routerID, subnet.ID, "COMPLETED")
+
+	return nil
+}
+
+// externalNetwork returns the external network with the given id or name,
+// or without a reference the first one that is up and has a subnet
+func externalNetwork(ref string) (network.Response, error) {
+
+	networks, err := provider.QueryNetworks(network.QueryParameters{RouterExternal: true})
+	if err != nil {
+		return network.Response{}, err
+	}
+
+	var external []network.Response
+	for _, v := range networks {
+		if v.RouterExternal {
+			external = append(external, v)
+		}
+	}
+
+	if ref != "" {
+		return resolveNetwork(ref, external)
+	}
+	for _, v := range external {
+		if v.AdminStateUp && v.Status == "ACTIVE" && len(v.Subnets) > 0 {
+			return v, nil
+		}
+	}
+	return network.Response{}, &notFoundError{Kind: "usable external network"}
+}
+
+// deleteNetwork deletes the network, subnet and router the cluster created,
+// in reverse order of creation. It is called once the ports are gone.
+func deleteNetwork() error {
+
+	n := state.Network
+
+	if n.RouterInterface {
+		log.Printf("%-20s - %s %s\n", "detach subnet", n.RouterID, n.SubnetID)
+		if err := noErrorOn404(provider.RemoveRouterInterface(n.RouterID, n.SubnetID)); err != nil {
+			return newResourceError("detach subnet from router", n.RouterID, err)
+		}
+		log.Printf("%-20s - %s %s %s\n", "detach subnet", n.RouterID, n.SubnetID, "COMPLETED")
+	}
+
+	steps := []struct {
+		label  string
+		id     string
+		delete func(string) error
+	}{
+		{"delete router", n.RouterID, provider.DeleteRouter},
+		{"delete subnet", n.SubnetID, provider.DeleteSubnet},
+		{"delete network", n.NetworkID, provider.DeleteNetwork},
+	}
+	for _, v := range steps {
+
+		if v.id == "" {
+			continue
+		}
+
+		log.Printf("%-20s - %s\n", v.label, v.id)
+
+		if err := noErrorOn404(v.delete(v.id)); err != nil {
+			return newResourceError(v.label, v.id, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", v.label, v.id, "COMPLETED")
+	}
+
+	if n.NetworkID != "" {
+		netwrk = network.Response{}
+		subnet = network.SubnetResponse{}
+	}
+	return nil
+}
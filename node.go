@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/codegangsta/cli"
+)
+
+// addTask joins a new worker node to the running cluster. The master is
+// looked up in Nova, so the node is pointed at the address the master
+// actually has instead of the one in the configuration file. With
+// floating-ip.workers the node gets a floating IP like the others.
+func addTask(c *cli.Context) error {
+
+	name := c.Args().First()
+	if name == "" {
+		return fmt.Errorf("usage: add <name> [--ip] [--flavor] [--image] [--save]")
+	}
+
+	if len(servers) == 0 {
+		return newResourceError("get cluster", config.Name, fmt.Errorf("cluster not found"))
+	}
+
+	if _, ok := findServer(name); ok {
+		return newResourceError("create server", name, fmt.Errorf("server already exists"))
+	}
+
+	masterIP, err := lookupMasterIP()
+	if err != nil {
+		return newResourceError("get master IP", config.Name, err)
+	}
+	log.Printf("%-20s - %s\n", "master", masterIP)
+
+	node, ok := config.Nodes[name]
+	if !ok {
+		node = workerTemplate()
+		node.IP = ""
+	}
+	if node.IsMaster {
+		return newResourceError("add node", name, fmt.Errorf("cannot add a master node"))
+	}
+
+	if c.String(IP) != "" {
+		node.IP = c.String(IP)
+	}
+	if c.String(Flavor) != "" {
+		node.VMSize = c.String(Flavor)
+		node.FlavorID = ""
+	}
+	if c.String(VMImage) != "" {
+		node.VMImage = c.String(VMImage)
+		node.ImageID = ""
+	}
+
+	if c.Bool(Save) {
+		nodes := make(map[string]configNode)
+		for k, v := range config.Nodes {
+			nodes[k] = v
+		}
+		nodes[name] = node
+		if err := checkConfigUpdate(nodes); err != nil {
+			return newResourceError("update config", c.GlobalString(Config), err)
+		}
+	}
+
+	if err := checkKubernetes(config.kubernetes()); err != nil {
+		return newResourceError("configure kubernetes", config.Name, err)
+	}
+
+	if _, err := nodeFlavorID(node); err != nil {
+		return err
+	}
+
+	imageID, err := nodeImageID(node)
+	if err != nil {
+		return err
+	}
+
+	floatingIPs := 0
+	if needsFloatingIP(node) {
+		floatingIPs = 1
+	}
+	if err := checkQuota([]configNode{node}, floatingIPs, quotaRelease{}); err != nil {
+		return err
+	}
+
+	if err := ensureSecurityGroups(); err != nil {
+		return err
+	}
+
+	port, err := createPort(name, node)
+	if err != nil {
+		return err
+	}
+
+	node.FixedIP = portIP(port)
+	if node.FixedIP == "" {
+		return newResourceError("get port address", name, fmt.Errorf("port %s has no fixed IP", port.ID))
+	}
+
+	if err := createNodeCloudConfig(name, node, masterIP, stateEtcdBootstrap()); err != nil {
+		return err
+	}
+
+	node.ServerID, err = createServer(name, node, imageID, port)
+	if err != nil {
+		return err
+	}
+
+	wait := waitPolicy{NodeTimeout: c.Duration(NodeTimeout)}
+	if err := wait.waitForServer(node.ServerID); err != nil {
+		return newResourceError("wait for server", name, err)
+	}
+
+	if needsFloatingIP(node) {
+		all, err := provider.FloatingIPs()
+		if err != nil {
+			return newResourceError("get floating IPs", "", err)
+		}
+		if err := assignFloatingIP(name, node, all); err != nil {
+			return err
+		}
+	}
+
+	// a cluster with fixed addresses records the one the node was given,
+	// the templates have no way to describe a DHCP address among them
+	if node.IP == "" && masterConfigIP() != "" {
+		node.IP = node.FixedIP
+	}
+	config.Nodes[name] = node
+
+	if c.Bool(Save) {
+
+		log.Printf("%-20s - %s\n", "update config", c.GlobalString(Config))
+
+		if err := writeConfigFile(c.GlobalString(Config), config); err != nil {
+			return newResourceError("update config", c.GlobalString(Config), err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "update config", c.GlobalString(Config), "COMPLETED")
+	}
+
+	return nil
+}
+
+// lookupMasterIP returns the fixed IP address of the master server as
+// reported by Nova.
+func lookupMasterIP() (string, error) {
+
+	fixedIP, _, err := lookupMasterAddresses()
+	if err != nil {
+		return "", err
+	}
+	if fixedIP == "" {
+		return "", fmt.Errorf("Master server has no fixed IP address")
+	}
+	return fixedIP, nil
+}
+
+// lookupMasterAPIHost returns the address under which the API server on the
+// master is reachable from this machine, preferring the floating IP.
+func lookupMasterAPIHost() (string, error) {
+
+	fixedIP, floatingIP, err := lookupMasterAddresses()
+	if err != nil {
+		return "", err
+	}
+	if floatingIP != "" {
+		return floatingIP, nil
+	}
+	return fixedIP, nil
+}
+
+func lookupMasterAddresses() (fixedIP string, floatingIP string, err error) {
+
+	for _, v := range servers {
+
+		if v.MetaData[MetaRole] != "master" {
+			continue
+		}
+
+		fixedIP, floatingIP = serverAddresses(v)
+		return fixedIP, floatingIP, nil
+	}
+	return "", "", fmt.Errorf("No master found in cluster %s", config.Name)
+}
+
+// checkConfigUpdate tells whether the configuration can be written back
+// with the hosts in the format it was read in. A file with templates only
+// holds workers that share the node template.
+func checkConfigUpdate(nodes map[string]configNode) error {
+
+	if config.Legacy {
+		return nil
+	}
+
+	updated := config
+	updated.Nodes = nodes
+	_, err := newClusterConfig(updated)
+	return err
+}
+
+// masterConfigIP returns the configured address of the master, empty when
+// the cluster uses DHCP
+func masterConfigIP() string {
+
+	for _, v := range config.Nodes {
+		if v.IsMaster {
+			return v.IP
+		}
+	}
+	return ""
+}
+
+// workerTemplate returns the settings of the first worker node in the
+// configuration, or of the master when there are no workers.
+func workerTemplate() configNode {
+
+	var template configNode
+	for _, k := range config.OrderedNodeKeys {
+		if !config.Nodes[k].IsMaster {
+			return config.Nodes[k]
+		}
+		template = config.Nodes[k]
+	}
+	template.IsMaster = false
+	return template
+}
+
+func nextIP(ip net.IP) net.IP {
+
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// removeTask drains and deletes a single node, given by name or IP address,
+// and removes it from the configuration file.
+func removeTask(c *cli.Context) error {
+
+	arg := c.Args().First()
+	if arg == "" {
+		return fmt.Errorf("usage: remove <name|ip> [--force] [--drain]")
+	}
+
+	name := resolveNodeName(arg)
+	if name == "" {
+		return newResourceError("get node", arg, fmt.Errorf("node not found"))
+	}
+
+	node, inConfig := config.Nodes[name]
+	server, serverFound := findServer(name)
+	port, portFound := findPort(name)
+
+	if serverFound {
+		node.IsMaster = server.MetaData[MetaRole] == "master"
+	}
+
+	if node.IsMaster && !c.Bool(Force) {
+		return newResourceError("remove node", name, fmt.Errorf("refusing to remove master without --force"))
+	}
+	if stateEtcdBootstrap().isMember(name) && !c.Bool(Force) {
+		return newResourceError("remove node", name, fmt.Errorf("refusing to remove etcd member without --force"))
+	}
+
+	if inConfig {
+		nodes := make(map[string]configNode)
+		for k, v := range config.Nodes {
+			if k != name {
+				nodes[k] = v
+			}
+		}
+		if err := checkConfigUpdate(nodes); err != nil {
+			return newResourceError("remove node", name, fmt.Errorf("%s cannot be removed from %s: %s", name, c.GlobalString(Config), err))
+		}
+	}
+
+	if c.Bool(Drain) && !node.IsMaster {
+
+		nodeIP := node.IP
+		if portFound {
+			nodeIP = portIP(port)
+		}
+
+		apiHost, err := lookupMasterAPIHost()
+		if err != nil {
+			return newResourceError("get master", config.Name, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "drain node", name, nodeIP)
+
+		api, err := newKubeAPI(apiHost)
+		if err != nil {
+			return err
+		}
+		if err := api.Drain(nodeIP); err != nil {
+			return newResourceError("drain node", name, err)
+		}
+		if err := api.DeleteNode(nodeIP); err != nil {
+			return newResourceError("delete kubernetes node", nodeIP, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "drain node", name, "COMPLETED")
+	}
+
+	if serverFound {
+
+		log.Printf("%-20s - %s\n", "delete server", name)
+
+		err := provider.DeleteServer(server.ID)
+		if noErrorOn404(err) != nil {
+			return newResourceError("delete server", name, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "delete server", name, "COMPLETED")
+	}
+
+	if portFound {
+
+		log.Printf("%-20s - %s\n", "delete port", name)
+
+		err := provider.DeletePort(port.ID)
+		if noErrorOn404(err) != nil {
+			return newResourceError("delete port", name, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "delete port", name, "COMPLETED")
+	}
+
+	if err := releaseFloatingIP(name, state.Nodes[name]); err != nil {
+		return err
+	}
+
+	delete(state.Nodes, name)
+	if err := saveState(); err != nil {
+		return err
+	}
+	if err := removeCloudConfig(name); err != nil {
+		return err
+	}
+
+	if inConfig {
+
+		log.Printf("%-20s - %s\n", "update config", c.GlobalString(Config))
+
+		delete(config.Nodes, name)
+		if err := writeConfigFile(c.GlobalString(Config), config); err != nil {
+			return newResourceError("update config", c.GlobalString(Config), err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "update config", c.GlobalString(Config), "COMPLETED")
+	}
+
+	return nil
+}
+
+// resolveNodeName maps a node name or IP address to the node name, looking
+// at the configuration first and at the ports in OpenStack second.
+func resolveNodeName(arg string) string {
+
+	if _, ok := config.Nodes[arg]; ok {
+		return arg
+	}
+	if _, ok := findServer(arg); ok {
+		return arg
+	}
+	if _, ok := state.Nodes[arg]; ok {
+		return arg
+	}
+
+	for _, k := range config.OrderedNodeKeys {
+		if config.Nodes[k].IP == arg {
+			return k
+		}
+	}
+
+	for _, v := range ports {
+		if portIP(v) != arg {
+			continue
+		}
+		if server, ok := findServerByID(v.DeviceID); ok {
+			return server.Name
+		}
+	}
+	return ""
+}
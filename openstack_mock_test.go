@@ -0,0 +1,1058 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+)
+
+const (
+	mockUsername = "demo"
+	mockPassword = "secret"
+	mockTenant   = "demo"
+	mockToken    = "mock-token"
+)
+
+// mockOpenStack is a stand-in for the Keystone v2, Nova, Neutron and Glance
+// APIs served over HTTP, so the real command line can be driven end to end.
+// It also serves an etcd discovery endpoint at /discovery/new.
+type mockOpenStack struct {
+	*httptest.Server
+
+	mutex sync.Mutex
+
+	nextID      int
+	keypairs    map[string]compute.KeyPairResponse
+	networks    []network.Response
+	subnets     []network.SubnetResponse
+	ports       map[string]network.PortResponse
+	groups      map[string]network.SecurityGroup
+	routers     map[string]network.Router
+	servers     map[string]compute.ServerDetail
+	userData    map[string]string
+	flavors     []compute.Flavor
+	zones       []compute.AvailabilityZone
+	limits      compute.Limits
+	floatingIPs map[string]compute.FloatingIP
+	images      []image.Response
+
+	// failures maps "METHOD /path" prefixes, relative to the service
+	// root, to the status code returned instead of the real response.
+	failures map[string]int
+	// failServers maps server names to the status code returned when
+	// they are created.
+	failServers map[string]int
+	// stuck holds the names of servers that never leave BUILD.
+	stuck map[string]bool
+	// spawnFailures holds the names of servers that go to ERROR instead
+	// of ACTIVE, faults the fault messages of the failed servers by id.
+	spawnFailures map[string]spawnFailure
+	faults        map[string]string
+	// requests records every service request as "METHOD /path".
+	requests []string
+}
+
+func newMockOpenStack() *mockOpenStack {
+
+	m := &mockOpenStack{
+		keypairs: map[string]compute.KeyPairResponse{
+			"kube-key": {Name: "kube-key", PublicKey: "ssh-rsa AAAA kube"},
+		},
+		networks: []network.Response{
+			{ID: "net-1", Name: "kube-net", Status: "ACTIVE", Subnets: []string{"subnet-1"}},
+			{ID: "ext-net-1", Name: "ext-net", Status: "ACTIVE", Subnets: []string{"ext-subnet-1"}, RouterExternal: true, AdminStateUp: true},
+		},
+		subnets: []network.SubnetResponse{
+			{
+				ID:              "subnet-1",
+				NetworkID:       "net-1",
+				CIDR:            "192.168.1.0/24",
+				AllocationPools: []network.AllocationPool{{Start: "192.168.1.2", End: "192.168.1.254"}},
+			},
+		},
+		ports:    make(map[string]network.PortResponse),
+		groups:   make(map[string]network.SecurityGroup),
+		routers:  make(map[string]network.Router),
+		servers:  make(map[string]compute.ServerDetail),
+		userData: make(map[string]string),
+		flavors: []compute.Flavor{
+			{ID: "101", Name: "standard.small"},
+			{ID: "102", Name: "standard.medium"},
+		},
+		zones:       []compute.AvailabilityZone{{ZoneName: "az2", ZoneState: compute.ZoneState{Available: true}}},
+		limits:      testLimits(),
+		floatingIPs: make(map[string]compute.FloatingIP),
+		images:      []image.Response{{ID: "image-1", Name: "CoreOS"}},
+		failures:    make(map[string]int),
+		failServers: make(map[string]int),
+		stuck:       make(map[string]bool),
+
+		spawnFailures: make(map[string]spawnFailure),
+		faults:        make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/tokens", m.serveTokens)
+	mux.HandleFunc("/compute/", m.service("/compute", m.serveCompute))
+	mux.HandleFunc("/network/v2.0/", m.service("/network/v2.0", m.serveNetwork))
+	mux.HandleFunc("/image", m.serveImageVersions)
+	mux.HandleFunc("/image/v1.0/", m.service("/image/v1.0", m.serveImage))
+	mux.HandleFunc("/discovery/new", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "http://discovery.local/token")
+	})
+
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// authURL is the value for --os-auth-url
+func (m *mockOpenStack) authURL() string {
+	return m.URL + "/v2.0"
+}
+
+// fail makes every request whose method and service relative path start
+// with the given values return status.
+func (m *mockOpenStack) fail(method string, path string, status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.failures[method+" "+path] = status
+}
+
+// failServer makes the creation of the named server return status.
+func (m *mockOpenStack) failServer(name string, status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.failServers[name] = status
+}
+
+// stickInBuild keeps the named servers in BUILD forever.
+func (m *mockOpenStack) stickInBuild(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stuck[name] = true
+}
+
+// spawnFailure is the fault of the next Times servers created with a name
+type spawnFailure struct {
+	Message string
+	Times   int
+}
+
+// failSpawn makes the next times servers with the given name go to ERROR
+// with the fault message instead of becoming ACTIVE.
+func (m *mockOpenStack) failSpawn(name string, message string, times int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.spawnFailures[name] = spawnFailure{Message: message, Times: times}
+}
+
+// usedLimits returns the limits with the servers and floating IPs of the
+// mock counted as used
+func (m *mockOpenStack) usedLimits() compute.Limits {
+
+	limits := m.limits
+	details := testFlavorsDetail(m.flavors)
+	for _, v := range m.servers {
+		for _, f := range details {
+			if f.ID == v.Flavor.ID {
+				limits.AbsoluteLimits.TotalCoresUsed += int(f.VCPUs.Int64)
+				limits.AbsoluteLimits.TotalRAMUsed += int(f.RAM.Int64)
+			}
+		}
+		limits.AbsoluteLimits.TotalInstancesUsed++
+	}
+	limits.AbsoluteLimits.TotalFloatingIpsUsed += len(m.floatingIPs)
+	return limits
+}
+
+func (m *mockOpenStack) newID(prefix string) string {
+	m.nextID++
+	return fmt.Sprintf("%s-%d", prefix, m.nextID)
+}
+
+func (m *mockOpenStack) serveTokens(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Auth struct {
+			TenantName          string            `json:"tenantName"`
+			TenantID            string            `json:"tenantId"`
+			PasswordCredentials map[string]string `json:"passwordCredentials"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	credentials := req.Auth.PasswordCredentials
+	if credentials["username"] != mockUsername || credentials["password"] != mockPassword ||
+		(req.Auth.TenantName != mockTenant && req.Auth.TenantID != mockTenant) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	endpoint := func(url string, versionList string) map[string]string {
+		return map[string]string{"region": "", "publicURL": url, "versionList": versionList}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access": map[string]interface{}{
+			"token": map[string]interface{}{
+				"id":      mockToken,
+				"expires": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+				"tenant":  map[string]string{"id": mockTenant, "name": mockTenant},
+			},
+			"serviceCatalog": []map[string]interface{}{
+				{"name": "nova", "type": "compute", "endpoints": []map[string]string{endpoint(m.URL+"/compute", "")}},
+				{"name": "neutron", "type": "network", "endpoints": []map[string]string{endpoint(m.URL+"/network", "")}},
+				{"name": "glance", "type": "image", "endpoints": []map[string]string{endpoint(m.URL+"/image", m.URL+"/image")}},
+			},
+		},
+	})
+}
+
+func (m *mockOpenStack) serveImageVersions(w http.ResponseWriter, r *http.Request) {
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"versions": []map[string]interface{}{
+			{
+				"status": "CURRENT",
+				"id":     "v1.0",
+				"links":  []map[string]string{{"rel": "self", "href": m.URL + "/image/v1.0"}},
+			},
+		},
+	})
+}
+
+// service wraps a service handler with the token check, the request log
+// and failure injection. The handler gets the path relative to root.
+func (m *mockOpenStack) service(root string, handler func(w http.ResponseWriter, r *http.Request, path string)) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("X-Auth-Token") != mockToken {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, root)
+		request := r.Method + " " + path
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		m.requests = append(m.requests, request)
+
+		for k, status := range m.failures {
+			if strings.HasPrefix(request, k) {
+				http.Error(w, fmt.Sprintf("injected failure %d for %s", status, request), status)
+				return
+			}
+		}
+
+		handler(w, r, path)
+	}
+}
+
+func (m *mockOpenStack) serveCompute(w http.ResponseWriter, r *http.Request, path string) {
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == "GET" && path == "/servers/detail":
+		var result []compute.ServerDetail
+		for _, v := range m.servers {
+			result = append(result, v)
+		}
+		sort.Sort(serverByID(result))
+		start, end := page(r, len(result), func(i int) string { return result[i].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"servers": result[start:end]})
+
+	case r.Method == "POST" && path == "/servers":
+		m.createServer(w, r)
+
+	case len(parts) == 2 && parts[0] == "servers":
+		server, ok := m.servers[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			result := struct {
+				compute.ServerDetail
+				Fault map[string]interface{} `json:"fault,omitempty"`
+			}{ServerDetail: server}
+			if fault, ok := m.faults[server.ID]; ok {
+				result.Fault = map[string]interface{}{"code": 500, "message": fault}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"server": result})
+
+			if server.Status == "BUILD" && !m.stuck[server.Name] {
+				server.Status = "ACTIVE"
+				if failure := m.spawnFailures[server.Name]; failure.Times > 0 {
+					failure.Times--
+					m.spawnFailures[server.Name] = failure
+					server.Status = "ERROR"
+					m.faults[server.ID] = failure.Message
+				}
+				m.servers[server.ID] = server
+			}
+		case "DELETE":
+			m.deleteServer(server)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "servers" && parts[2] == "metadata":
+		server, ok := m.servers[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range req.Metadata {
+			server.MetaData[k] = v
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"metadata": server.MetaData})
+
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "servers" && parts[2] == "action":
+		m.serverAction(w, r, parts[1])
+
+	case r.Method == "GET" && path == "/flavors":
+		start, end := page(r, len(m.flavors), func(i int) string { return m.flavors[i].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flavors": m.flavors[start:end]})
+
+	case r.Method == "GET" && path == "/flavors/detail":
+		details := testFlavorsDetail(m.flavors)
+		start, end := page(r, len(details), func(i int) string { return details[i].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flavors": details[start:end]})
+
+	case r.Method == "GET" && path == "/limits":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"limits": m.usedLimits()})
+
+	case r.Method == "GET" && path == "/os-availability-zone":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"availabilityZoneInfo": m.zones})
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "os-keypairs":
+		keypair, ok := m.keypairs[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keypair": keypair})
+
+	case r.Method == "GET" && path == "/os-floating-ips":
+		result := []compute.FloatingIP{}
+		for _, v := range m.floatingIPs {
+			result = append(result, v)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ips": result})
+
+	case r.Method == "POST" && path == "/os-floating-ips":
+		var req struct {
+			Pool string `json:"pool"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Pool == "" {
+			req.Pool = "Ext-Net"
+		}
+		ip := net.IPv4(15, 125, 106, byte(100+len(m.floatingIPs))).String()
+		fip := compute.FloatingIP{ID: m.newID("fip"), IP: ip, Pool: req.Pool}
+		m.floatingIPs[fip.ID] = fip
+		writeJSON(w, http.StatusOK, map[string]interface{}{"floating_ip": fip})
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "os-floating-ips":
+		fip, ok := m.floatingIPs[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if server, ok := m.servers[fip.InstanceID]; ok {
+			m.removeAddress(server, fip.IP)
+		}
+		delete(m.floatingIPs, fip.ID)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockOpenStack) createServer(w http.ResponseWriter, r *http.Request) {
+
+	var req struct {
+		Server compute.ServerCreationParameters `json:"server"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parameters := req.Server
+
+	if status, ok := m.failServers[parameters.Name]; ok {
+		http.Error(w, fmt.Sprintf("injected failure %d for server %s", status, parameters.Name), status)
+		return
+	}
+
+	if !m.hasFlavor(parameters.FlavorRef) || !m.hasImage(parameters.ImageRef) {
+		http.Error(w, "invalid flavorRef or imageRef", http.StatusBadRequest)
+		return
+	}
+	if _, ok := m.keypairs[parameters.KeyPairName]; !ok {
+		http.Error(w, "invalid key_name", http.StatusBadRequest)
+		return
+	}
+
+	server := compute.ServerDetail{
+		ID:        m.newID("server"),
+		Name:      parameters.Name,
+		Status:    "BUILD",
+		Created:   time.Now().UTC(),
+		Flavor:    compute.Flavor{ID: parameters.FlavorRef},
+		Image:     compute.ImageWrapper{Image: &compute.Image{ID: parameters.ImageRef}},
+		Addresses: make(map[string][]compute.Address),
+		MetaData:  make(map[string]string),
+		KeyName:   parameters.KeyPairName,
+	}
+	if parameters.AvailabilityZone != nil {
+		server.AvailabilityZone = *parameters.AvailabilityZone
+	}
+	for k, v := range parameters.Metadata {
+		server.MetaData[k] = v
+	}
+
+	for _, n := range parameters.Networks {
+		port, ok := m.ports[n.Port]
+		if !ok {
+			http.Error(w, "port not found "+n.Port, http.StatusNotFound)
+			return
+		}
+		if port.DeviceID != "" {
+			http.Error(w, "port in use "+n.Port, http.StatusConflict)
+			return
+		}
+	}
+
+	for _, n := range parameters.Networks {
+		port := m.ports[n.Port]
+		port.DeviceID = server.ID
+		port.DeviceOwner = "compute:" + server.AvailabilityZone
+		port.Status = "ACTIVE"
+		m.ports[port.ID] = port
+
+		name := m.networkName(port.NetworkID)
+		for _, ip := range port.FixedIPs {
+			server.Addresses[name] = append(server.Addresses[name], compute.Address{Addr: ip.IPAddress, Version: 4, Type: "fixed"})
+		}
+	}
+
+	if parameters.UserData != nil {
+		b, err := base64.StdEncoding.DecodeString(*parameters.UserData)
+		if err != nil {
+			http.Error(w, "user_data is not base64", http.StatusBadRequest)
+			return
+		}
+		m.userData[server.ID] = string(b)
+	}
+
+	m.servers[server.ID] = server
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"server": compute.CreateServerResponse{ID: server.ID, AdminPass: "secret"},
+	})
+}
+
+// deleteServer removes the server, detaches its ports and disassociates
+// its floating IPs like Nova does.
+func (m *mockOpenStack) deleteServer(server compute.ServerDetail) {
+
+	delete(m.servers, server.ID)
+	delete(m.userData, server.ID)
+	delete(m.faults, server.ID)
+
+	for k, v := range m.ports {
+		if v.DeviceID == server.ID {
+			v.DeviceID = ""
+			v.DeviceOwner = ""
+			v.Status = "DOWN"
+			m.ports[k] = v
+		}
+	}
+
+	for k, v := range m.floatingIPs {
+		if v.InstanceID == server.ID {
+			v.InstanceID = ""
+			v.FixedIP = ""
+			m.floatingIPs[k] = v
+		}
+	}
+}
+
+func (m *mockOpenStack) serverAction(w http.ResponseWriter, r *http.Request, id string) {
+
+	server, ok := m.servers[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req map[string]map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if action, ok := req["addFloatingIp"]; ok {
+		address := action["address"]
+		for k, v := range m.floatingIPs {
+			if v.IP != address {
+				continue
+			}
+			if v.InstanceID != "" {
+				http.Error(w, "floating IP in use "+address, http.StatusBadRequest)
+				return
+			}
+			fixedIP, _ := serverAddresses(server)
+			v.InstanceID = id
+			v.FixedIP = fixedIP
+			m.floatingIPs[k] = v
+			for n := range server.Addresses {
+				server.Addresses[n] = append(server.Addresses[n], compute.Address{Addr: address, Version: 4, Type: "floating"})
+				break
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if action, ok := req["removeFloatingIp"]; ok {
+		address := action["address"]
+		for k, v := range m.floatingIPs {
+			if v.IP == address && v.InstanceID == id {
+				v.InstanceID = ""
+				v.FixedIP = ""
+				m.floatingIPs[k] = v
+			}
+		}
+		m.removeAddress(server, address)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	http.Error(w, "unsupported action", http.StatusBadRequest)
+}
+
+func (m *mockOpenStack) removeAddress(server compute.ServerDetail, address string) {
+
+	for n, addresses := range server.Addresses {
+		var kept []compute.Address
+		for _, a := range addresses {
+			if a.Addr != address {
+				kept = append(kept, a)
+			}
+		}
+		server.Addresses[n] = kept
+	}
+}
+
+func (m *mockOpenStack) serveNetwork(w http.ResponseWriter, r *http.Request, path string) {
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == "GET" && path == "/networks":
+		result := []network.Response{}
+		for _, v := range m.networks {
+			query := r.URL.Query()
+			if name := query.Get("name"); name != "" && v.Name != name {
+				continue
+			}
+			if query.Get("router:external") == "true" && !v.RouterExternal {
+				continue
+			}
+			result = append(result, v)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"networks": result})
+
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "networks":
+		for _, v := range m.networks {
+			if v.ID == parts[1] {
+				writeJSON(w, http.StatusOK, map[string]interface{}{"network": v})
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case r.Method == "POST" && path == "/networks":
+		var req struct {
+			Network map[string]interface{} `json:"network"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := req.Network["tenant_id"]; ok {
+			http.Error(w, "only admin can specify the tenant", http.StatusForbidden)
+			return
+		}
+		name, _ := req.Network["name"].(string)
+		n := network.Response{ID: m.newID("neutron-net"), Name: name, Status: "ACTIVE", AdminStateUp: true, TenantID: mockTenant}
+		m.networks = append(m.networks, n)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"network": n})
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "networks":
+		for _, v := range m.ports {
+			if v.NetworkID == parts[1] {
+				http.Error(w, "network in use", http.StatusConflict)
+				return
+			}
+		}
+		for i, v := range m.networks {
+			if v.ID == parts[1] {
+				m.networks = append(m.networks[:i], m.networks[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case r.Method == "GET" && path == "/subnets":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"subnets": m.subnets})
+
+	case r.Method == "POST" && path == "/subnets":
+		var req struct {
+			Subnet subnetParameters `json:"subnet"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, v := range m.networks {
+			if v.ID == req.Subnet.NetworkID {
+				s := newSubnet(m.newID("neutron-subnet"), req.Subnet)
+				m.subnets = append(m.subnets, s)
+				m.networks[i].Subnets = append(v.Subnets, s.ID)
+				writeJSON(w, http.StatusCreated, map[string]interface{}{"subnet": s})
+				return
+			}
+		}
+		http.Error(w, "network not found", http.StatusNotFound)
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "subnets":
+		if subnetInUse(parts[1], m.ports) {
+			http.Error(w, "subnet in use", http.StatusConflict)
+			return
+		}
+		for i, v := range m.subnets {
+			if v.ID == parts[1] {
+				m.subnets = append(m.subnets[:i], m.subnets[i+1:]...)
+				for j, n := range m.networks {
+					m.networks[j].Subnets = others(n.Subnets, parts[1])
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case r.Method == "POST" && path == "/routers":
+		var req struct {
+			Router struct {
+				GatewayInfo network.ExternalGatewayInfo `json:"external_gateway_info"`
+			} `json:"router"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, v := range m.networks {
+			if v.ID == req.Router.GatewayInfo.NetworkID && v.RouterExternal {
+				router := network.Router{ID: m.newID("router"), Status: "ACTIVE", AdminStateUp: true, TenantID: mockTenant, ExternalGatewayInfo: req.Router.GatewayInfo}
+				m.routers[router.ID] = router
+				writeJSON(w, http.StatusCreated, map[string]interface{}{"router": router})
+				return
+			}
+		}
+		http.Error(w, "external network not found", http.StatusNotFound)
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "routers":
+		if _, ok := m.routers[parts[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if routerInUse(parts[1], m.ports) {
+			http.Error(w, "router still has ports", http.StatusConflict)
+			return
+		}
+		delete(m.routers, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "PUT" && len(parts) == 3 && parts[0] == "routers":
+		m.routerInterface(w, r, parts[1], parts[2])
+
+	case r.Method == "GET" && path == "/ports":
+		result := []network.PortResponse{}
+		for _, v := range m.ports {
+			result = append(result, v)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ports": result})
+
+	case r.Method == "POST" && path == "/ports":
+		m.createPort(w, r)
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "ports":
+		if _, ok := m.ports[parts[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(m.ports, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" && path == "/security-groups":
+		result := []network.SecurityGroup{}
+		for _, v := range m.groups {
+			result = append(result, v)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"security_groups": result})
+
+	case r.Method == "POST" && path == "/security-groups":
+		var req struct {
+			Group network.CreateSecurityGroupParameters `json:"security_group"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group := network.SecurityGroup{ID: m.newID("secgroup"), TenantID: mockTenant, Name: req.Group.Name, Description: req.Group.Description}
+		m.groups[group.ID] = group
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"security_group": group})
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "security-groups":
+		if _, ok := m.groups[parts[1]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if securityGroupInUse(parts[1], m.ports) {
+			http.Error(w, "security group in use", http.StatusConflict)
+			return
+		}
+		delete(m.groups, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && path == "/security-group-rules":
+		var req struct {
+			Rule network.CreateSecurityGroupRuleParameters `json:"security_group_rule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group, ok := m.groups[req.Rule.SecurityGroupID]
+		if !ok {
+			http.Error(w, "security group not found", http.StatusNotFound)
+			return
+		}
+		rule := newSecurityGroupRule(m.newID("rule"), req.Rule)
+		group.SecurityGroupRules = append(group.SecurityGroupRules, rule)
+		m.groups[group.ID] = group
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"security_group_rule": rule})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockOpenStack) createPort(w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Neutron rejects an empty address instead of assigning one
+	if strings.Contains(string(body), `"ip_address":""`) {
+		http.Error(w, "Invalid input for ip_address", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Port portParameters `json:"port"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parameters := req.Port
+
+	if m.networkName(parameters.NetworkID) == "" {
+		http.Error(w, "network not found "+parameters.NetworkID, http.StatusNotFound)
+		return
+	}
+
+	for _, v := range parameters.SecurityGroups {
+		if _, ok := m.groups[v]; !ok {
+			http.Error(w, "security group not found "+v, http.StatusNotFound)
+			return
+		}
+	}
+
+	for _, v := range m.ports {
+		for _, ip := range v.FixedIPs {
+			for _, requested := range parameters.FixedIPs {
+				if ip.IPAddress == requested.IPAddress {
+					http.Error(w, "IP address in use "+ip.IPAddress, http.StatusConflict)
+					return
+				}
+			}
+		}
+	}
+
+	fixedIPs, ok := assignAddresses(parameters.FixedIPs, m.subnets, m.ports)
+	if !ok {
+		http.Error(w, "No more IP addresses available", http.StatusConflict)
+		return
+	}
+
+	port := network.PortResponse{
+		ID:             m.newID("port"),
+		Name:           parameters.Name,
+		Status:         "DOWN",
+		AdminStateUp:   parameters.AdminStateUp,
+		NetworkID:      parameters.NetworkID,
+		TenantID:       mockTenant,
+		FixedIPs:       fixedIPs,
+		SecurityGroups: parameters.SecurityGroups,
+	}
+	m.ports[port.ID] = port
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"port": port})
+}
+
+// routerInterface attaches a subnet to a router or detaches it, attaching
+// creates a port on the gateway address of the subnet
+func (m *mockOpenStack) routerInterface(w http.ResponseWriter, r *http.Request, routerID string, action string) {
+
+	var req struct {
+		SubnetID string `json:"subnet_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := m.routers[routerID]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "add_router_interface":
+		for _, v := range m.subnets {
+			if v.ID == req.SubnetID {
+				port := routerInterfacePort(m.newID("port"), routerID, v)
+				m.ports[port.ID] = port
+				writeJSON(w, http.StatusOK, map[string]interface{}{"id": routerID, "subnet_id": v.ID, "port_id": port.ID})
+				return
+			}
+		}
+		http.Error(w, "subnet not found", http.StatusNotFound)
+
+	case "remove_router_interface":
+		for k, v := range m.ports {
+			if v.DeviceID == routerID && len(v.FixedIPs) > 0 && v.FixedIPs[0].SubnetID == req.SubnetID {
+				delete(m.ports, k)
+				writeJSON(w, http.StatusOK, map[string]interface{}{"id": routerID, "subnet_id": req.SubnetID, "port_id": k})
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockOpenStack) serveImage(w http.ResponseWriter, r *http.Request, path string) {
+
+	if r.Method != "GET" || path != "/images" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var result []image.Response
+	for _, v := range m.images {
+		if name := r.URL.Query().Get("name"); name == "" || v.Name == name {
+			result = append(result, v)
+		}
+	}
+	start, end := page(r, len(result), func(i int) string { return result[i].ID })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"images": result[start:end]})
+}
+
+func (m *mockOpenStack) networkName(id string) string {
+
+	for _, v := range m.networks {
+		if v.ID == id {
+			return v.Name
+		}
+	}
+	return ""
+}
+
+func (m *mockOpenStack) hasFlavor(id string) bool {
+
+	for _, v := range m.flavors {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mockOpenStack) hasImage(id string) bool {
+
+	for _, v := range m.images {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// serversNamed returns the servers with the given name
+func (m *mockOpenStack) serversNamed(name string) []compute.ServerDetail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []compute.ServerDetail
+	for _, v := range m.servers {
+		if v.Name == name {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// requestLog returns the service requests received so far
+func (m *mockOpenStack) requestLog() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]string(nil), m.requests...)
+}
+
+// count returns the number of servers, ports, groups, networks, subnets,
+// routers or floatingIPs the mock holds
+func (m *mockOpenStack) count(kind string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch kind {
+	case "servers":
+		return len(m.servers)
+	case "ports":
+		return len(m.ports)
+	case "groups":
+		return len(m.groups)
+	case "networks":
+		return len(m.networks)
+	case "subnets":
+		return len(m.subnets)
+	case "routers":
+		return len(m.routers)
+	case "floatingIPs":
+		return len(m.floatingIPs)
+	}
+	panic("unknown kind " + kind)
+}
+
+// userDataOf returns the user data the server was created with
+func (m *mockOpenStack) userDataOf(id string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.userData[id]
+}
+
+// portList returns the ports of the mock
+func (m *mockOpenStack) portList() []network.PortResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result []network.PortResponse
+	for _, v := range m.ports {
+		result = append(result, v)
+	}
+	return result
+}
+
+// update changes the state of the mock while no request is served
+func (m *mockOpenStack) update(f func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	f()
+}
+
+// page applies the limit and marker query parameters the way Nova and
+// Glance paginate their listings.
+func page(r *http.Request, n int, id func(int) string) (int, int) {
+
+	start := 0
+	if marker := r.URL.Query().Get("marker"); marker != "" {
+		for i := 0; i < n; i++ {
+			if id(i) == marker {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	end := n
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && start+limit < end {
+		end = start + limit
+	}
+	return start, end
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type serverByID []compute.ServerDetail
+
+func (a serverByID) Len() int           { return len(a) }
+func (a serverByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a serverByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// clusterMutex guards config.Nodes, the state and the journal while nodes
+// are provisioned concurrently.
+var clusterMutex sync.Mutex
+
+// forEachNode runs fn for every node, at most parallelism at a time. After
+// the first failure no further nodes are started, the nodes already
+// running are waited for. The failures of all nodes are returned together.
+func forEachNode(names []string, parallelism int, fn func(name string) error) error {
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		failures nodeErrors
+	)
+
+	slots := make(chan struct{}, parallelism)
+
+	for _, name := range names {
+
+		slots <- struct{}{}
+
+		mutex.Lock()
+		failed := len(failures) > 0
+		mutex.Unlock()
+
+		if failed {
+			<-slots
+			log.Printf("%-20s - %s\n", "skip node", name)
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string) {
+
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			if err := fn(name); err != nil {
+				log.Printf("%-20s - %s %s\n", "node failed", name, err.Error())
+				mutex.Lock()
+				failures = append(failures, nodeError{Name: name, Err: err})
+				mutex.Unlock()
+			}
+		}(name)
+	}
+
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// nodeConfig returns the configuration of the named node
+func nodeConfig(name string) configNode {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	return config.Nodes[name]
+}
+
+func setNodeConfig(name string, node configNode) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	config.Nodes[name] = node
+}
+
+// nodeStateOf returns the recorded state of the named node
+func nodeStateOf(name string) nodeState {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	return state.Nodes[name]
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEachNodeLimitsParallelism(t *testing.T) {
+
+	var (
+		mutex   sync.Mutex
+		running int
+		maximum int
+		visited []string
+	)
+
+	names := []string{"kube-node-1", "kube-node-2", "kube-node-3", "kube-node-4", "kube-node-5"}
+
+	err := forEachNode(names, 2, func(name string) error {
+		mutex.Lock()
+		running++
+		if running > maximum {
+			maximum = running
+		}
+		visited = append(visited, name)
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maximum > 2 {
+		t.Errorf("expected at most 2 nodes at a time, got %d", maximum)
+	}
+	if len(visited) != len(names) {
+		t.Errorf("expected %d nodes, got %v", len(names), visited)
+	}
+}
+
+func TestForEachNodeCollectsFailures(t *testing.T) {
+
+	names := []string{"kube-node-1", "kube-node-2", "kube-node-3"}
+
+	err := forEachNode(names, 3, func(name string) error {
+		if name == "kube-node-1" {
+			return nil
+		}
+		return fmt.Errorf("quota exceeded")
+	})
+
+	failures, ok := err.(nodeErrors)
+	if !ok {
+		t.Fatalf("expected nodeErrors, got %v", err)
+	}
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 failures, got %v", failures)
+	}
+
+	msg := failures.Error()
+	for _, want := range []string{"2 nodes failed", "kube-node-2 quota exceeded", "kube-node-3 quota exceeded"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected %q in %q", want, msg)
+		}
+	}
+}
+
+func TestForEachNodeStopsAfterFailure(t *testing.T) {
+
+	var visited []string
+
+	err := forEachNode([]string{"kube-node-1", "kube-node-2", "kube-node-3"}, 1, func(name string) error {
+		visited = append(visited, name)
+		return fmt.Errorf("boom")
+	})
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(visited) != 1 {
+		t.Errorf("expected no node started after the failure, got %v", visited)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// Names of the key pairs of a cluster. The CA issues the certificate of
+// the API server and the client certificates of the kubelet, kube-proxy
+// and the admin user.
+const (
+	pkiCA        = "ca"
+	pkiAPIServer = "apiserver"
+	pkiKubelet   = "kubelet"
+	pkiKubeProxy = "kube-proxy"
+	pkiAdmin     = "admin"
+)
+
+// pkiKeyBits is the size of the RSA keys, pkiValidity how long the CA and
+// the certificates are valid
+var (
+	pkiKeyBits  = 2048
+	pkiValidity = 10 * 365 * 24 * time.Hour
+)
+
+// pkiDir is the directory the key pairs of the cluster are kept in
+var pkiDir string
+
+// keyPair is a certificate and its private key, parsed and as PEM
+type keyPair struct {
+	Cert    *x509.Certificate
+	Key     *rsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// pkiPath returns the directory the key pairs are kept in next to the
+// state file, for example .kubesetup-pki for kubesetup.yml.
+func pkiPath(configFile string) string {
+
+	base := filepath.Base(configFile)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return filepath.Join(filepath.Dir(configFile), "."+base+PKIDirSuffix)
+}
+
+// pkiTask creates the cluster CA and the client certificates unless they
+// exist. The certificate of the API server is issued when the master is
+// rendered, once its addresses are known.
+func pkiTask(c *cli.Context) error {
+
+	ca, err := readKeyPair(pkiCA)
+	if os.IsNotExist(err) {
+		ca, err = createKeyPair(pkiCA, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: config.Name + "-ca"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		}, nil)
+	}
+	if err != nil {
+		return newResourceError("create certificate", pkiCA, err)
+	}
+
+	clients := []struct {
+		name         string
+		organization string
+	}{
+		{pkiKubelet, ""},
+		{pkiKubeProxy, ""},
+		{pkiAdmin, "system:masters"},
+	}
+	for _, v := range clients {
+
+		kp, err := readKeyPair(v.name)
+		if os.IsNotExist(err) || (err == nil && kp.Cert.CheckSignatureFrom(ca.Cert) != nil) {
+			template := &x509.Certificate{
+				Subject:     pkix.Name{CommonName: v.name},
+				KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}
+			if v.organization != "" {
+				template.Subject.Organization = []string{v.organization}
+			}
+			_, err = createKeyPair(v.name, template, &ca)
+		}
+		if err != nil {
+			return newResourceError("create certificate", v.name, err)
+		}
+	}
+	return nil
+}
+
+// apiServerKeyPair returns the key pair of the API server. The certificate
+// is issued again when it does not cover every address the API server is
+// reached under: the fixed and floating IP of the master, the service IP
+// and localhost.
+func apiServerKeyPair(hostname string, fixedIP string, floatingIP string) (keyPair, error) {
+
+	ips := []net.IP{net.ParseIP("127.0.0.1"), serviceIP(), net.ParseIP(fixedIP)}
+	if floatingIP != "" {
+		ips = append(ips, net.ParseIP(floatingIP))
+	}
+	names := []string{hostname, "kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.cluster.local"}
+
+	ca, err := readKeyPair(pkiCA)
+	if err != nil {
+		return keyPair{}, newResourceError("read certificate", pkiCA, err)
+	}
+
+	kp, err := readKeyPair(pkiAPIServer)
+	if err == nil && coversIPs(kp.Cert, ips) && kp.Cert.CheckSignatureFrom(ca.Cert) == nil {
+		return kp, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return kp, newResourceError("read certificate", pkiAPIServer, err)
+	}
+
+	kp, err = createKeyPair(pkiAPIServer, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "kube-apiserver"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: ips,
+		DNSNames:    names,
+	}, &ca)
+	if err != nil {
+		return kp, newResourceError("create certificate", pkiAPIServer, err)
+	}
+	return kp, nil
+}
+
+// coversIPs tells whether the certificate is valid for every address
+func coversIPs(cert *x509.Certificate, ips []net.IP) bool {
+
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceIP returns the first address of the service range, the address
+// of the kubernetes service the pods reach the API server under
+func serviceIP() net.IP {
+
+	_, ipNet, _ := net.ParseCIDR(ServiceClusterIPRange)
+	ip := ipNet.IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]+1)
+}
+
+// createKeyPair creates a key and a certificate signed by the CA, or self
+// signed without one, and writes both to pkiDir
+func createKeyPair(name string, template *x509.Certificate, ca *keyPair) (keyPair, error) {
+
+	log.Printf("%-20s - %s\n", "create certificate", name)
+
+	key, err := rsa.GenerateKey(rand.Reader, pkiKeyBits)
+	if err != nil {
+		return keyPair{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return keyPair{}, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(pkiValidity)
+
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return keyPair{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return keyPair{}, err
+	}
+
+	kp := keyPair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+
+	if err := os.MkdirAll(pkiDir, 0700); err != nil {
+		return kp, err
+	}
+	if err := ioutil.WriteFile(keyPairFile(name, "-key.pem"), kp.KeyPEM, 0600); err != nil {
+		return kp, err
+	}
+	if err := ioutil.WriteFile(keyPairFile(name, ".pem"), kp.CertPEM, 0644); err != nil {
+		return kp, err
+	}
+
+	log.Printf("%-20s - %s %s\n", "create certificate", name, "COMPLETED")
+
+	return kp, nil
+}
+
+// readKeyPair reads a key pair from pkiDir, the error satisfies
+// os.IsNotExist when it was not created yet
+func readKeyPair(name string) (keyPair, error) {
+
+	var kp keyPair
+	var err error
+
+	if kp.CertPEM, err = ioutil.ReadFile(keyPairFile(name, ".pem")); err != nil {
+		return kp, err
+	}
+	if kp.KeyPEM, err = ioutil.ReadFile(keyPairFile(name, "-key.pem")); err != nil {
+		return kp, err
+	}
+
+	pair, err := tls.X509KeyPair(kp.CertPEM, kp.KeyPEM)
+	if err != nil {
+		return kp, fmt.Errorf("%s: %s", keyPairFile(name, ".pem"), err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return kp, fmt.Errorf("%s: not an RSA key", keyPairFile(name, "-key.pem"))
+	}
+	kp.Key = key
+	kp.Cert, err = x509.ParseCertificate(pair.Certificate[0])
+	return kp, err
+}
+
+// readKeyPairs reads the key pairs a host is given
+func readKeyPairs(names ...string) (map[string]keyPair, error) {
+
+	pairs := make(map[string]keyPair)
+	for _, v := range names {
+		kp, err := readKeyPair(v)
+		if os.IsNotExist(err) {
+			return nil, newResourceError("read certificate", v, fmt.Errorf("%s not found, run install to create it", keyPairFile(v, ".pem")))
+		}
+		if err != nil {
+			return nil, newResourceError("read certificate", v, err)
+		}
+		pairs[v] = kp
+	}
+	return pairs, nil
+}
+
+// cloudConfigPath returns the cloud-config rendered for a host. It holds
+// the keys of the host, so it is kept with the key pairs.
+func cloudConfigPath(name string) string {
+	return filepath.Join(pkiDir, name+".yml")
+}
+
+// removeCloudConfig deletes the cloud-config of a host that is gone
+func removeCloudConfig(name string) error {
+
+	if err := os.Remove(cloudConfigPath(name)); err != nil && !os.IsNotExist(err) {
+		return newResourceError("remove cloudconfig", cloudConfigPath(name), err)
+	}
+	return nil
+}
+
+func keyPairFile(name string, suffix string) string {
+	return filepath.Join(pkiDir, name+suffix)
+}
+
+// removePKI deletes the key pairs and the cloud-configs once the cluster is
+// gone
+func removePKI() error {
+
+	if err := os.RemoveAll(pkiDir); err != nil {
+		return newResourceError("remove certificates", pkiDir, err)
+	}
+	return nil
+}
+
+// adminTLSConfig returns the TLS configuration the API server is reached
+// with as the admin user
+func adminTLSConfig() (*tls.Config, error) {
+
+	pairs, err := readKeyPairs(pkiCA, pkiAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pairs[pkiCA].Cert)
+
+	admin, err := tls.X509KeyPair(pairs[pkiAdmin].CertPEM, pairs[pkiAdmin].KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{admin}}, nil
+}
+
+// indentPEM indents a PEM block for the content of a write_files entry
+func indentPEM(b []byte) string {
+
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	return "      " + strings.Join(lines, "\n      ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+// verifyKeyPair fails unless the certificate is issued by the CA for the
+// usage
+func verifyKeyPair(t *testing.T, ca keyPair, kp keyPair, usage x509.ExtKeyUsage) {
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	if _, err := kp.Cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+		t.Errorf("%s: %v", kp.Cert.Subject.CommonName, err)
+	}
+}
+
+func TestPKITask(t *testing.T) {
+
+	env := newTestEnv(t)
+	pkiDir = filepath.Join(env.dir, "pki")
+
+	if err := pkiTask(nil); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := readKeyPairs(pkiCA, pkiKubelet, pkiKubeProxy, pkiAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{pkiKubelet, pkiKubeProxy, pkiAdmin} {
+		verifyKeyPair(t, pairs[pkiCA], pairs[v], x509.ExtKeyUsageClientAuth)
+	}
+	if o := pairs[pkiAdmin].Cert.Subject.Organization; len(o) != 1 || o[0] != "system:masters" {
+		t.Errorf("expected the admin to be in system:masters, got %v", o)
+	}
+
+	// a second run keeps the key pairs
+	if err := pkiTask(nil); err != nil {
+		t.Fatal(err)
+	}
+	kubelet, err := readKeyPair(pkiKubelet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kubelet.Cert.SerialNumber.Cmp(pairs[pkiKubelet].Cert.SerialNumber) != 0 {
+		t.Errorf("expected the kubelet certificate to be kept")
+	}
+}
+
+func TestAPIServerKeyPair(t *testing.T) {
+
+	env := newTestEnv(t)
+	pkiDir = filepath.Join(env.dir, "pki")
+
+	if err := pkiTask(nil); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := readKeyPair(pkiCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kp, err := apiServerKeyPair("kube-master", "192.168.1.140", "15.125.106.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyKeyPair(t, ca, kp, x509.ExtKeyUsageServerAuth)
+	for _, v := range []string{"127.0.0.1", "10.100.0.1", "192.168.1.140", "15.125.106.100", "kube-master", "kubernetes.default"} {
+		if err := kp.Cert.VerifyHostname(v); err != nil {
+			t.Errorf("certificate does not cover %s: %v", v, err)
+		}
+	}
+
+	// the certificate is kept while it covers the addresses
+	kept, err := apiServerKeyPair("kube-master", "192.168.1.140", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.Cert.SerialNumber.Cmp(kp.Cert.SerialNumber) != 0 {
+		t.Errorf("expected the certificate to be kept")
+	}
+
+	// and issued again for a new floating IP
+	moved, err := apiServerKeyPair("kube-master", "192.168.1.140", "15.125.106.200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Cert.SerialNumber.Cmp(kp.Cert.SerialNumber) == 0 || moved.Cert.VerifyHostname("15.125.106.200") != nil {
+		t.Errorf("expected a certificate covering the new floating IP")
+	}
+}
+
+func TestReadKeyPairsMissing(t *testing.T) {
+
+	env := newTestEnv(t)
+	pkiDir = filepath.Join(env.dir, "pki")
+
+	if _, err := readKeyPairs(pkiCA); err == nil {
+		t.Errorf("expected an error for a missing CA")
+	}
+}
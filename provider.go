@@ -0,0 +1,317 @@
+package main
+
+import (
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+	common "git.openstack.org/stackforge/golang-client.git/identity/common"
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	misc "git.openstack.org/stackforge/golang-client.git/misc"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+)
+
+// Provider is the set of cloud operations the tasks depend on. The
+// OpenStack implementation wraps the golang-client services, tests use an
+// in-memory implementation instead.
+type Provider interface {
+	KeyPair(name string) (compute.KeyPairResponse, error)
+
+	QueryNetworks(q network.QueryParameters) ([]network.Response, error)
+	Network(id string) (network.Response, error)
+	Subnets() ([]network.SubnetResponse, error)
+	CreateNetwork(parameters networkParameters) (network.Response, error)
+	DeleteNetwork(id string) error
+	CreateSubnet(parameters subnetParameters) (network.SubnetResponse, error)
+	DeleteSubnet(id string) error
+
+	CreateRouter(externalNetworkID string) (network.Router, error)
+	DeleteRouter(id string) error
+	AddRouterInterface(routerID string, subnetID string) error
+	RemoveRouterInterface(routerID string, subnetID string) error
+
+	Ports() ([]network.PortResponse, error)
+	CreatePort(parameters portParameters) (network.PortResponse, error)
+	DeletePort(id string) error
+
+	SecurityGroups() ([]network.SecurityGroup, error)
+	CreateSecurityGroup(parameters network.CreateSecurityGroupParameters) (network.SecurityGroup, error)
+	DeleteSecurityGroup(id string) error
+	CreateSecurityGroupRule(parameters network.CreateSecurityGroupRuleParameters) (network.SecurityGroupRule, error)
+
+	ServerDetails() ([]compute.ServerDetail, error)
+	ServerDetail(id string) (compute.ServerDetail, error)
+	ServerFault(id string) (string, error)
+	CreateServer(parameters compute.ServerCreationParameters) (compute.CreateServerResponse, error)
+	DeleteServer(id string) error
+	SetServerMetadata(id string, metadata map[string]string) (map[string]string, error)
+	ServerAction(id string, action string, key string, value string) error
+
+	Flavors() ([]compute.Flavor, error)
+	FlavorsDetail() ([]compute.FlavorDetail, error)
+	Limits() (compute.Limits, error)
+	AvailabilityZones() ([]compute.AvailabilityZone, error)
+
+	FloatingIPs() ([]compute.FloatingIP, error)
+	CreateFloatingIP(pool string) (compute.FloatingIP, error)
+	DeleteFloatingIP(id string) error
+
+	Images() ([]image.Response, error)
+}
+
+// portParameters are the settings of a new port. A fixed IP without an
+// address gets one assigned by DHCP.
+type portParameters struct {
+	Name           string    `json:"name"`
+	AdminStateUp   bool      `json:"admin_state_up"`
+	NetworkID      string    `json:"network_id"`
+	FixedIPs       []fixedIP `json:"fixed_ips"`
+	SecurityGroups []string  `json:"security_groups,omitempty"`
+}
+
+type fixedIP struct {
+	SubnetID  string `json:"subnet_id,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// networkParameters are the settings of a new network
+type networkParameters struct {
+	Name         string `json:"name"`
+	AdminStateUp bool   `json:"admin_state_up"`
+}
+
+// subnetParameters are the settings of a new subnet. Without allocation
+// pools Neutron hands out the whole CIDR except the gateway.
+type subnetParameters struct {
+	Name            string                   `json:"name"`
+	NetworkID       string                   `json:"network_id"`
+	IPVersion       network.IPVersion        `json:"ip_version"`
+	CIDR            string                   `json:"cidr"`
+	AllocationPools []network.AllocationPool `json:"allocation_pools,omitempty"`
+}
+
+// openStackProvider implements Provider on top of the OpenStack compute,
+// network and image services.
+type openStackProvider struct {
+	authenticator  common.Authenticator
+	computeService compute.Service
+	networkService network.Service
+	imageService   image.Service
+}
+
+func newOpenStackProvider(authenticator common.Authenticator) Provider {
+	return openStackProvider{
+		authenticator:  authenticator,
+		computeService: compute.NewService(authenticator),
+		networkService: network.NewService(authenticator),
+		imageService:   image.NewService(authenticator),
+	}
+}
+
+func (p openStackProvider) KeyPair(name string) (compute.KeyPairResponse, error) {
+	return p.computeService.KeyPair(name)
+}
+
+func (p openStackProvider) QueryNetworks(q network.QueryParameters) ([]network.Response, error) {
+	return p.networkService.QueryNetworks(q)
+}
+
+func (p openStackProvider) Network(id string) (network.Response, error) {
+	return p.networkService.Network(id)
+}
+
+func (p openStackProvider) Subnets() ([]network.SubnetResponse, error) {
+	return p.networkService.Subnets()
+}
+
+// CreateNetwork posts the network itself, the golang-client
+// CreateNetworkParameters always sends a tenant_id, which Neutron only
+// accepts from an admin when it is empty.
+func (p openStackProvider) CreateNetwork(parameters networkParameters) (network.Response, error) {
+
+	c := struct {
+		Network networkParameters `json:"network"`
+	}{parameters}
+	r := struct {
+		Network network.Response `json:"network"`
+	}{}
+	err := p.postNetwork("/networks", c, &r)
+	return r.Network, err
+}
+
+func (p openStackProvider) DeleteNetwork(id string) error {
+	return p.networkService.DeleteNetwork(id)
+}
+
+// CreateSubnet posts the subnet itself, the golang-client
+// CreateSubnetParameters has no name and always sends allocation pools.
+func (p openStackProvider) CreateSubnet(parameters subnetParameters) (network.SubnetResponse, error) {
+
+	c := struct {
+		Subnet subnetParameters `json:"subnet"`
+	}{parameters}
+	r := struct {
+		Subnet network.SubnetResponse `json:"subnet"`
+	}{}
+	err := p.postNetwork("/subnets", c, &r)
+	return r.Subnet, err
+}
+
+func (p openStackProvider) DeleteSubnet(id string) error {
+	return p.networkService.DeleteSubnet(id)
+}
+
+func (p openStackProvider) CreateRouter(externalNetworkID string) (network.Router, error) {
+	return p.networkService.CreateRouter(externalNetworkID)
+}
+
+func (p openStackProvider) DeleteRouter(id string) error {
+	return p.networkService.DeleteRouter(id)
+}
+
+// AddRouterInterface attaches the subnet to the router, the golang-client
+// has no call for it.
+func (p openStackProvider) AddRouterInterface(routerID string, subnetID string) error {
+	return p.routerInterface(routerID, "add_router_interface", subnetID)
+}
+
+// RemoveRouterInterface detaches the subnet from the router
+func (p openStackProvider) RemoveRouterInterface(routerID string, subnetID string) error {
+	return p.routerInterface(routerID, "remove_router_interface", subnetID)
+}
+
+func (p openStackProvider) routerInterface(routerID string, action string, subnetID string) error {
+
+	serviceURL, err := p.authenticator.GetServiceURL(Network, "2.0")
+	if err != nil {
+		return err
+	}
+
+	c := struct {
+		SubnetID string `json:"subnet_id"`
+	}{subnetID}
+	r := struct{}{}
+	return misc.PutJSON(misc.Strcat(serviceURL, "/routers/", routerID, "/", action), p.authenticator, c, &r)
+}
+
+// postNetwork posts a request body to a path of the network service
+func (p openStackProvider) postNetwork(path string, body interface{}, result interface{}) error {
+
+	serviceURL, err := p.authenticator.GetServiceURL(Network, "2.0")
+	if err != nil {
+		return err
+	}
+	return misc.PostJSON(misc.Strcat(serviceURL, path), p.authenticator, body, result)
+}
+
+func (p openStackProvider) Ports() ([]network.PortResponse, error) {
+	return p.networkService.Ports()
+}
+
+// CreatePort posts the port itself, the golang-client
+// CreatePortParameters cannot leave out the address of a fixed IP and has
+// no security groups.
+func (p openStackProvider) CreatePort(parameters portParameters) (network.PortResponse, error) {
+
+	c := struct {
+		Port portParameters `json:"port"`
+	}{parameters}
+	r := struct {
+		Port network.PortResponse `json:"port"`
+	}{}
+	err := p.postNetwork("/ports", c, &r)
+	return r.Port, err
+}
+
+func (p openStackProvider) DeletePort(id string) error {
+	return p.networkService.DeletePort(id)
+}
+
+func (p openStackProvider) SecurityGroups() ([]network.SecurityGroup, error) {
+	return p.networkService.SecurityGroups()
+}
+
+func (p openStackProvider) CreateSecurityGroup(parameters network.CreateSecurityGroupParameters) (network.SecurityGroup, error) {
+	return p.networkService.CreateSecurityGroup(parameters)
+}
+
+func (p openStackProvider) DeleteSecurityGroup(id string) error {
+	return p.networkService.DeleteSecurityGroup(id)
+}
+
+func (p openStackProvider) CreateSecurityGroupRule(parameters network.CreateSecurityGroupRuleParameters) (network.SecurityGroupRule, error) {
+	return p.networkService.CreateSecurityGroupRule(parameters)
+}
+
+func (p openStackProvider) ServerDetails() ([]compute.ServerDetail, error) {
+	return p.computeService.ServerDetails()
+}
+
+func (p openStackProvider) ServerDetail(id string) (compute.ServerDetail, error) {
+	return p.computeService.ServerDetail(id)
+}
+
+// ServerFault returns the message of the fault Nova reports for a server in
+// ERROR, the golang-client ServerDetail does not carry it.
+func (p openStackProvider) ServerFault(id string) (string, error) {
+
+	serviceURL, err := p.authenticator.GetServiceURL(Compute, "2")
+	if err != nil {
+		return "", err
+	}
+
+	c := struct {
+		Server struct {
+			Fault struct {
+				Message string `json:"message"`
+			} `json:"fault"`
+		} `json:"server"`
+	}{}
+	err = misc.GetJSON(misc.Strcat(serviceURL, "/servers/", id), p.authenticator, &c)
+	return c.Server.Fault.Message, err
+}
+
+func (p openStackProvider) CreateServer(parameters compute.ServerCreationParameters) (compute.CreateServerResponse, error) {
+	return p.computeService.CreateServer(parameters)
+}
+
+func (p openStackProvider) DeleteServer(id string) error {
+	return p.computeService.DeleteServer(id)
+}
+
+func (p openStackProvider) SetServerMetadata(id string, metadata map[string]string) (map[string]string, error) {
+	return p.computeService.SetServerMetadata(id, metadata)
+}
+
+func (p openStackProvider) ServerAction(id string, action string, key string, value string) error {
+	return p.computeService.ServerAction(id, action, key, value)
+}
+
+func (p openStackProvider) Flavors() ([]compute.Flavor, error) {
+	return p.computeService.Flavors()
+}
+
+func (p openStackProvider) FlavorsDetail() ([]compute.FlavorDetail, error) {
+	return p.computeService.FlavorsDetail()
+}
+
+func (p openStackProvider) Limits() (compute.Limits, error) {
+	return p.computeService.Limits()
+}
+
+func (p openStackProvider) AvailabilityZones() ([]compute.AvailabilityZone, error) {
+	return p.computeService.AvailabilityZones()
+}
+
+func (p openStackProvider) FloatingIPs() ([]compute.FloatingIP, error) {
+	return p.computeService.FloatingIPs()
+}
+
+func (p openStackProvider) CreateFloatingIP(pool string) (compute.FloatingIP, error) {
+	return p.computeService.CreateFloatingIP(pool)
+}
+
+func (p openStackProvider) DeleteFloatingIP(id string) error {
+	return p.computeService.DeleteFloatingIP(id)
+}
+
+func (p openStackProvider) Images() ([]image.Response, error) {
+	return p.imageService.Images()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+// quotaUsage is the demand on a single tenant limit. A negative Limit means
+// unlimited.
+type quotaUsage struct {
+	Resource  string
+	Requested int
+	Used      int
+	Limit     int
+}
+
+func (q quotaUsage) available() int {
+	if q.Used > q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+func (q quotaUsage) exceeded() bool {
+	return q.Limit >= 0 && q.Requested > q.available()
+}
+
+func (q quotaUsage) availableString() string {
+	if q.Limit < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", q.available())
+}
+
+// quotaError lists every limit the request does not fit into, together with
+// the ones it does fit into so the whole breakdown is shown.
+type quotaError []quotaUsage
+
+func (e quotaError) Error() string {
+
+	msg := "not enough quota, nothing was created"
+	msg += fmt.Sprintf("\n%-20s - %-10s %9s %9s %9s %9s", "", "resource", "requested", "used", "limit", "available")
+	for _, v := range e {
+		mark := ""
+		if v.exceeded() {
+			mark = " exceeded"
+		}
+		msg += fmt.Sprintf("\n%-20s - %-10s %9d %9d %9s %9s%s", "", v.Resource, v.Requested, v.Used, limitString(v.Limit), v.availableString(), mark)
+	}
+	return msg
+}
+
+func limitString(limit int) string {
+
+	if limit < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", limit)
+}
+
+// quotaTask checks, before install creates anything, that the servers and
+// the floating IPs still missing fit into the absolute limits of the tenant.
+func quotaTask(c *cli.Context) error {
+
+	var missing []configNode
+	for _, k := range config.OrderedNodeKeys {
+		if _, ok := findServer(k); !ok {
+			missing = append(missing, config.Nodes[k])
+		}
+	}
+
+	floatingIPs, err := floatingIPsNeeded()
+	if err != nil {
+		return err
+	}
+
+	return checkQuota(missing, floatingIPs, quotaRelease{})
+}
+
+// recreateQuotaTask checks, before install --recreate deletes the cluster,
+// that the whole cluster fits into the limits once uninstall has freed the
+// servers and the floating IPs it releases. The addresses uninstall keeps
+// are reused instead.
+func recreateQuotaTask(c *cli.Context) error {
+
+	var nodes []configNode
+	needed := 0
+	for _, k := range config.OrderedNodeKeys {
+		node := config.Nodes[k]
+		nodes = append(nodes, node)
+		if needsFloatingIP(node) && !(node.IsMaster && config.floatingIP().Address != "") {
+			needed++
+		}
+	}
+
+	allocated := 0
+	for _, v := range state.Nodes {
+		if v.FloatingIPID != "" && v.FloatingIPAllocated {
+			allocated++
+		}
+	}
+
+	freed := quotaRelease{servers: servers}
+	if config.floatingIP().Release {
+		freed.floatingIPs = allocated
+	} else {
+		unassigned, err := unassignedFloatingIPs()
+		if err != nil {
+			return err
+		}
+		needed -= allocated + keptFloatingIPs(unassigned)
+		if needed < 0 {
+			needed = 0
+		}
+	}
+
+	return checkQuota(nodes, needed, freed)
+}
+
+// floatingIPsNeeded returns the number of floating IPs assignIPAddressTask
+// has to allocate, one for every node that gets a public address and has
+// neither one nor an address to reuse, its own or one kept by the cluster
+func floatingIPsNeeded() (int, error) {
+
+	unassigned, err := unassignedFloatingIPs()
+	if err != nil {
+		return 0, err
+	}
+	kept := keptFloatingIPs(unassigned)
+
+	needed := 0
+	for _, k := range config.OrderedNodeKeys {
+
+		node := config.Nodes[k]
+		if !needsFloatingIP(node) {
+			continue
+		}
+		if server, ok := findServer(k); ok {
+			if _, floatingIP := serverAddresses(server); floatingIP != "" {
+				continue
+			}
+		}
+		if node.IsMaster && config.floatingIP().Address != "" {
+			continue
+		}
+		if unassigned[state.Nodes[k].FloatingIPID] {
+			continue
+		}
+		if kept > 0 {
+			kept--
+			continue
+		}
+		needed++
+	}
+	return needed, nil
+}
+
+// unassignedFloatingIPs returns the IDs of the floating IPs of the tenant
+// no server uses
+func unassignedFloatingIPs() (map[string]bool, error) {
+
+	floatingIPs, err := provider.FloatingIPs()
+	if err != nil {
+		return nil, newResourceError("get floating IPs", "", err)
+	}
+
+	unassigned := make(map[string]bool)
+	for _, v := range floatingIPs {
+		if v.InstanceID == "" {
+			unassigned[v.ID] = true
+		}
+	}
+	return unassigned, nil
+}
+
+// keptFloatingIPs counts the addresses kept by the cluster that can still
+// be reused
+func keptFloatingIPs(unassigned map[string]bool) int {
+
+	kept := 0
+	for _, v := range state.KeptFloatingIPs {
+		if unassigned[v.ID] {
+			kept++
+		}
+	}
+	return kept
+}
+
+// quotaRelease is what install --recreate frees before it creates the
+// cluster again
+type quotaRelease struct {
+	servers     []compute.ServerDetail
+	floatingIPs int
+}
+
+// checkQuota compares the vCPUs, RAM and instances of the nodes and the
+// floating IPs with the absolute limits of the tenant, less what is freed
+// before they are created
+func checkQuota(nodes []configNode, floatingIPs int, freed quotaRelease) error {
+
+	if len(nodes) == 0 && floatingIPs == 0 {
+		return nil
+	}
+
+	flavors, err := provider.FlavorsDetail()
+	if err != nil {
+		return newResourceError("get flavors", "", err)
+	}
+
+	byID := make(map[string]compute.FlavorDetail)
+	for _, v := range flavors {
+		byID[v.ID] = v
+	}
+
+	var cores, ram int
+	for _, v := range nodes {
+		flavorID, err := nodeFlavorID(v)
+		if err != nil {
+			return err
+		}
+		flavor, ok := byID[flavorID]
+		if !ok {
+			return newResourceError("get flavor", flavorID, &notFoundError{Kind: "flavor"})
+		}
+		cores += int(flavor.VCPUs.Int64)
+		ram += int(flavor.RAM.Int64)
+	}
+
+	limits, err := provider.Limits()
+	if err != nil {
+		return newResourceError("get limits", "", err)
+	}
+	absolute := limits.AbsoluteLimits
+
+	absolute.TotalInstancesUsed -= len(freed.servers)
+	for _, v := range freed.servers {
+		if flavor, ok := byID[v.Flavor.ID]; ok {
+			absolute.TotalCoresUsed -= int(flavor.VCPUs.Int64)
+			absolute.TotalRAMUsed -= int(flavor.RAM.Int64)
+		}
+	}
+	absolute.TotalFloatingIpsUsed -= freed.floatingIPs
+
+	usage := quotaError{
+		{Resource: "instances", Requested: len(nodes), Used: absolute.TotalInstancesUsed, Limit: absolute.MaxTotalInstances},
+		{Resource: "vCPUs", Requested: cores, Used: absolute.TotalCoresUsed, Limit: absolute.MaxTotalCores},
+		{Resource: "RAM (MB)", Requested: ram, Used: absolute.TotalRAMUsed, Limit: absolute.MaxTotalRAMSize},
+		{Resource: "floatingIPs", Requested: floatingIPs, Used: absolute.TotalFloatingIpsUsed, Limit: absolute.MaxTotalFloatingIps},
+	}
+
+	exceeded := false
+	for _, v := range usage {
+		log.Printf("%-20s - %s %d of %s available\n", "quota", v.Resource, v.Requested, v.availableString())
+		if v.exceeded() {
+			exceeded = true
+		}
+	}
+
+	if exceeded {
+		return usage
+	}
+	return nil
+}
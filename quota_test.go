@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotaRefusesInstall(t *testing.T) {
+
+	env := newTestEnv(t)
+	// master 2 vCPUs, two nodes 1 vCPU each
+	env.provider.limits.AbsoluteLimits.MaxTotalCores = 3
+
+	c := env.context(env.command(Install))
+	err := runTasks(c, initTask, quotaTask)
+
+	quota, ok := err.(quotaError)
+	if !ok {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+
+	var exceeded []string
+	for _, v := range quota {
+		if v.exceeded() {
+			exceeded = append(exceeded, v.Resource)
+		}
+	}
+	if len(exceeded) != 1 || exceeded[0] != "vCPUs" {
+		t.Errorf("expected only vCPUs to be exceeded, got %v", exceeded)
+	}
+	if !strings.Contains(err.Error(), "vCPUs") || !strings.Contains(err.Error(), "RAM (MB)") {
+		t.Errorf("expected the whole breakdown:\n%s", err.Error())
+	}
+	if len(env.provider.servers) != 0 || len(env.provider.ports) != 0 {
+		t.Errorf("expected nothing to be created")
+	}
+}
+
+func TestQuotaCountsMissingNodesOnly(t *testing.T) {
+
+	env := newTestEnv(t)
+	installAction(env.context(env.command(Install)))
+
+	// the installed cluster uses 3 of the 3 instances
+	env.provider.limits.AbsoluteLimits.MaxTotalInstances = 3
+
+	c := env.context(env.command(Install))
+	if err := runTasks(c, initTask, quotaTask); err != nil {
+		t.Errorf("expected the installed cluster to fit, got %v", err)
+	}
+}
+
+func TestQuotaUnlimited(t *testing.T) {
+
+	q := quotaUsage{Resource: "vCPUs", Requested: 100, Used: 50, Limit: -1}
+	if q.exceeded() {
+		t.Errorf("a negative limit is unlimited")
+	}
+	if q.availableString() != "unlimited" {
+		t.Errorf("expected unlimited, got %s", q.availableString())
+	}
+
+	q = quotaUsage{Resource: "vCPUs", Requested: 1, Used: 12, Limit: 10}
+	if !q.exceeded() || q.available() != 0 {
+		t.Errorf("expected an over-used limit to have nothing available")
+	}
+}
+
+func TestQuotaCountsFloatingIPs(t *testing.T) {
+
+	env := newTestEnv(t)
+	reserved, _ := env.provider.CreateFloatingIP("")
+
+	for section, want := range map[string]int{
+		"    pool: public\n":  1,
+		"    workers: true\n": 3,
+		"    workers: true\n    address: " + reserved.IP + "\n": 2,
+	} {
+		env.writeConfig(floatingIPConfig(section))
+		if err := initTask(env.context(env.command(Install))); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := floatingIPsNeeded(); err != nil || got != want {
+			t.Errorf("%q: expected %d floating IPs, got %d %v", section, want, got, err)
+		}
+	}
+}
+
+func TestQuotaRecreate(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(floatingIPConfig("    workers: true\n"))
+	installAction(env.context(env.command(Install)))
+
+	// the installed cluster uses every instance and floating IP
+	env.provider.limits.AbsoluteLimits.MaxTotalInstances = 3
+	env.provider.limits.AbsoluteLimits.MaxTotalFloatingIps = 3
+
+	c := env.context(env.command(Install), "--"+Recreate)
+	if err := runTasks(c, initTask, recreateQuotaTask); err != nil {
+		t.Errorf("expected the recreated cluster to fit into what it frees, got %v", err)
+	}
+
+	// released addresses are freed, so allocating them again fits as well
+	env.writeConfig(floatingIPConfig("    workers: true\n    release: true\n"))
+	if err := runTasks(c, initTask, recreateQuotaTask); err != nil {
+		t.Errorf("expected the released floating IPs to be counted as freed, got %v", err)
+	}
+
+	// a larger cluster does not fit and nothing is deleted
+	env.writeConfig(strings.Replace(floatingIPConfig("    workers: true\n"), "count: 2", "count: 3", 1))
+	if err := runTasks(c, initTask, recreateQuotaTask); err == nil {
+		t.Errorf("expected a quota error for the larger cluster")
+	}
+	if got := len(env.clusterServers()); got != 3 {
+		t.Errorf("expected the cluster to be left alone, got %d servers", got)
+	}
+}
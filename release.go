@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/codegangsta/cli"
+)
+
+// kubeReleaseLines maps the release lines the templates work with to the
+// newest release of each line, which a configured line stands for
+var kubeReleaseLines = map[string]string{
+	"v1.0": "v1.0.7",
+	"v1.1": "v1.1.8",
+	"v1.2": "v1.2.7",
+	"v1.3": "v1.3.10",
+	"v1.4": "v1.4.12",
+	"v1.5": "v1.5.8",
+	"v1.6": "v1.6.13",
+	"v1.7": "v1.7.16",
+}
+
+// kubeFlag is a flag the templates pass to a Kubernetes binary. Since is
+// the first release accepting it, Removed the first one rejecting it or
+// empty when it is still accepted.
+type kubeFlag struct {
+	Binary  string
+	Flag    string
+	Since   string
+	Removed string
+}
+
+// kubeFlags are the flags the templates use, a release that does not
+// accept one of them is refused
+var kubeFlags = []kubeFlag{
+	{"kube-apiserver", "--insecure-bind-address", "v1.0.0", "v1.20.0"},
+	{"kube-apiserver", "--insecure-port", "v1.0.0", "v1.20.0"},
+	{"kube-apiserver", "--bind-address", "v1.0.0", ""},
+	{"kube-apiserver", "--secure-port", "v1.0.0", ""},
+	{"kube-apiserver", "--tls-cert-file", "v1.0.0", ""},
+	{"kube-apiserver", "--tls-private-key-file", "v1.0.0", ""},
+	{"kube-apiserver", "--client-ca-file", "v1.0.0", ""},
+	{"kube-apiserver", "--service-cluster-ip-range", "v1.0.0", ""},
+	{"kube-apiserver", "--etcd-servers", "v1.0.0", ""},
+	{"kube-controller-manager", "--master", "v1.0.0", ""},
+	{"kube-scheduler", "--master", "v1.0.0", ""},
+	{"kubelet", "--api-servers", "v1.0.0", "v1.8.0"},
+	{"kubelet", "--kubeconfig", "v1.0.0", ""},
+	{"kubelet", "--hostname-override", "v1.0.0", ""},
+	{"kube-proxy", "--master", "v1.0.0", ""},
+	{"kube-proxy", "--kubeconfig", "v1.0.0", ""},
+}
+
+var (
+	releasePattern     = regexp.MustCompile(`^v(\d+)\.(\d+)\.(\d+)(-[0-9A-Za-z.]+)?$`)
+	releaseLinePattern = regexp.MustCompile(`^v\d+\.\d+$`)
+)
+
+// kubeVersion returns the Kubernetes release to install. A release line
+// is replaced by its newest known release, a release the templates are
+// known not to work with is refused.
+func kubeVersion(s kubernetesSection) (string, error) {
+
+	version := s.Version
+	if releaseLinePattern.MatchString(version) {
+		latest, ok := kubeReleaseLines[version]
+		if !ok {
+			return "", fmt.Errorf("release line %s is not known, configure a release like %s.0", version, version)
+		}
+		version = latest
+	}
+
+	if _, err := parseRelease(version); err != nil {
+		return "", err
+	}
+
+	for _, v := range kubeFlags {
+		if compareReleases(version, v.Since) < 0 {
+			return "", fmt.Errorf("%s %s is not supported before %s, version %s cannot be installed", v.Binary, v.Flag, v.Since, version)
+		}
+		if v.Removed != "" && compareReleases(version, v.Removed) >= 0 {
+			return "", fmt.Errorf("%s %s was removed in %s, version %s cannot be installed", v.Binary, v.Flag, v.Removed, version)
+		}
+	}
+	return version, nil
+}
+
+// checkKubeBaseURL checks that binaries can be downloaded from the base URL
+func checkKubeBaseURL(baseURL string) error {
+
+	if !isHTTPURL(baseURL) {
+		return fmt.Errorf("base-url %q is not an http(s) URL", baseURL)
+	}
+	return nil
+}
+
+// checkKubernetes checks the Kubernetes release settings before anything
+// is rendered
+func checkKubernetes(s kubernetesSection) error {
+
+	if _, err := kubeVersion(s); err != nil {
+		return err
+	}
+	if err := checkKubeBaseURL(s.BaseURL); err != nil {
+		return err
+	}
+	if err := checkDigests(s); err != nil {
+		return err
+	}
+	version, _ := kubeVersion(s)
+	return checkVerified(s, version)
+}
+
+// kubernetesTask refuses a Kubernetes release the templates do not work
+// with before install touches the cluster
+func kubernetesTask(c *cli.Context) error {
+
+	s := config.kubernetes()
+	if err := checkKubernetes(s); err != nil {
+		return newResourceError("configure kubernetes", config.Name, err)
+	}
+
+	version, _ := kubeVersion(s)
+	log.Printf("%-20s - %s %s\n", "kubernetes", version, s.BaseURL)
+	logUnverified(s, version)
+
+	return nil
+}
+
+// parseRelease returns the major, minor and patch number of a release
+// like v1.2.3, a pre-release suffix is ignored
+func parseRelease(version string) ([3]int, error) {
+
+	var r [3]int
+
+	m := releasePattern.FindStringSubmatch(version)
+	if m == nil {
+		return r, fmt.Errorf("version %q is not a release like v1.2.3 or a release line like v1.2", version)
+	}
+	for i := range r {
+		r[i], _ = strconv.Atoi(m[i+1])
+	}
+	return r, nil
+}
+
+// compareReleases returns -1, 0 or 1 when release a is older, the same or
+// newer than b, both have to be valid
+func compareReleases(a string, b string) int {
+
+	ra, _ := parseRelease(a)
+	rb, _ := parseRelease(b)
+
+	for i := range ra {
+		switch {
+		case ra[i] < rb[i]:
+			return -1
+		case ra[i] > rb[i]:
+			return 1
+		}
+	}
+	return 0
+}
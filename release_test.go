@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKubeVersion(t *testing.T) {
+
+	for version, want := range map[string]string{
+		"v1.0.1":        "v1.0.1",
+		"v1.2":          "v1.2.7",
+		"v1.5.3":        "v1.5.3",
+		"v1.7.0-beta.1": "v1.7.0-beta.1",
+	} {
+		if got, err := kubeVersion(kubernetesSection{Version: version}); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s %v", version, want, got, err)
+		}
+	}
+
+	for version, want := range map[string]string{
+		"v1.8.0":  "kubelet --api-servers was removed in v1.8.0",
+		"v0.21.0": "not supported before v1.0.0",
+		"v1.9":    "release line v1.9 is not known",
+		"1.2.3":   "is not a release",
+	} {
+		if _, err := kubeVersion(kubernetesSection{Version: version}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", version, want, err)
+		}
+	}
+}
+
+func TestCompareReleases(t *testing.T) {
+
+	for _, v := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.0.1", "v1.0.1", 0},
+		{"v1.0.10", "v1.0.9", 1},
+		{"v1.2.0", "v1.10.0", -1},
+	} {
+		if got := compareReleases(v.a, v.b); got != v.want {
+			t.Errorf("%s %s: expected %d, got %d", v.a, v.b, v.want, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+)
+
+// candidate is a resource a reference in the configuration may point at
+type candidate struct {
+	ID   string
+	Name string
+}
+
+// notFoundError is returned when no resource matches a reference
+type notFoundError struct {
+	Kind string
+}
+
+func (e *notFoundError) Error() string {
+	return e.Kind + " not found"
+}
+
+// ambiguousError is returned when a name matches several resources, the
+// reference has to be replaced by the id of one of the candidates.
+type ambiguousError struct {
+	Candidates []candidate
+}
+
+func (e *ambiguousError) Error() string {
+
+	var list []string
+	for _, v := range e.Candidates {
+		list = append(list, fmt.Sprintf("%s (%s)", v.ID, v.Name))
+	}
+	return "ambiguous, use the ID: " + strings.Join(list, ", ")
+}
+
+// resolve returns the id of the resource ref refers to. An id always wins,
+// otherwise ref has to be the name of exactly one resource. Keypairs are
+// not resolved, Nova identifies them by their name.
+func resolve(kind string, ref string, candidates []candidate) (string, error) {
+
+	var named []candidate
+	for _, v := range candidates {
+		if v.ID == ref {
+			return v.ID, nil
+		}
+		if v.Name == ref {
+			named = append(named, v)
+		}
+	}
+
+	switch len(named) {
+	case 0:
+		return "", &notFoundError{Kind: kind}
+	case 1:
+		return named[0].ID, nil
+	}
+
+	sort.Slice(named, func(i, j int) bool { return named[i].ID < named[j].ID })
+	return "", &ambiguousError{Candidates: named}
+}
+
+// resolveNetwork returns the network with the given id or name
+func resolveNetwork(ref string, networks []network.Response) (network.Response, error) {
+
+	var candidates []candidate
+	for _, v := range networks {
+		candidates = append(candidates, candidate{ID: v.ID, Name: v.Name})
+	}
+
+	id, err := resolve("network", ref, candidates)
+	if err != nil {
+		return network.Response{}, err
+	}
+	for _, v := range networks {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+	return network.Response{}, &notFoundError{Kind: "network"}
+}
+
+// resolveSubnet returns the subnet of the network with the given id or
+// name. Without a reference the first subnet of the network is used.
+func resolveSubnet(ref string, netwrk network.Response, all []network.SubnetResponse) (network.SubnetResponse, error) {
+
+	if ref == "" {
+		if len(netwrk.Subnets) == 0 {
+			return network.SubnetResponse{}, fmt.Errorf("network has no subnet")
+		}
+		ref = netwrk.Subnets[0]
+	}
+
+	own := make(map[string]bool)
+	for _, v := range netwrk.Subnets {
+		own[v] = true
+	}
+
+	var candidates []candidate
+	for _, v := range all {
+		if own[v.ID] {
+			candidates = append(candidates, candidate{ID: v.ID, Name: v.Name})
+		}
+	}
+
+	id, err := resolve("subnet", ref, candidates)
+	if err != nil {
+		return network.SubnetResponse{}, err
+	}
+	for _, v := range all {
+		if v.ID == id {
+			return v, nil
+		}
+	}
+	return network.SubnetResponse{}, &notFoundError{Kind: "subnet"}
+}
+
+// resolveImage returns the id of the image with the given id or name
+func resolveImage(ref string, images []image.Response) (string, error) {
+
+	var candidates []candidate
+	for _, v := range images {
+		candidates = append(candidates, candidate{ID: v.ID, Name: v.Name})
+	}
+	return resolve("image", ref, candidates)
+}
+
+// resolveFlavor returns the id of the flavor with the given id or name
+func resolveFlavor(ref string, flavors []compute.Flavor) (string, error) {
+
+	var candidates []candidate
+	for _, v := range flavors {
+		candidates = append(candidates, candidate{ID: v.ID, Name: v.Name})
+	}
+	return resolve("flavor", ref, candidates)
+}
+
+// resolveZone returns the availability zone with the given name. Zones
+// only have names, they are matched ignoring case unless that matches
+// several zones.
+func resolveZone(ref string, zones []compute.AvailabilityZone) (string, error) {
+
+	var candidates []candidate
+	for _, v := range zones {
+		if strings.EqualFold(v.ZoneName, ref) {
+			candidates = append(candidates, candidate{ID: v.ZoneName, Name: v.ZoneName})
+		}
+	}
+
+	for _, v := range candidates {
+		if v.ID == ref {
+			return v.ID, nil
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", &notFoundError{Kind: "availabilityZone"}
+	case 1:
+		return candidates[0].ID, nil
+	}
+	return "", &ambiguousError{Candidates: candidates}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	compute "git.openstack.org/stackforge/golang-client.git/compute/v2"
+)
+
+func TestResolve(t *testing.T) {
+
+	candidates := []candidate{
+		{ID: "image-1", Name: "CoreOS"},
+		{ID: "image-3", Name: "Ubuntu"},
+		{ID: "image-2", Name: "Ubuntu"},
+		{ID: "image-4", Name: "image-1"},
+	}
+
+	for ref, want := range map[string]string{
+		"CoreOS":  "image-1",
+		"image-2": "image-2",
+		"image-1": "image-1", // the id wins over the name of image-4
+	} {
+		if got, err := resolve("image", ref, candidates); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s %v", ref, want, got, err)
+		}
+	}
+
+	_, err := resolve("image", "Ubuntu", candidates)
+	ambiguous, ok := err.(*ambiguousError)
+	if !ok {
+		t.Fatalf("expected an ambiguous error, got %v", err)
+	}
+	if want := []candidate{{ID: "image-2", Name: "Ubuntu"}, {ID: "image-3", Name: "Ubuntu"}}; !reflect.DeepEqual(ambiguous.Candidates, want) {
+		t.Errorf("expected candidates %v, got %v", want, ambiguous.Candidates)
+	}
+	if want := "ambiguous, use the ID: image-2 (Ubuntu), image-3 (Ubuntu)"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+
+	if _, err := resolve("image", "Debian", candidates); err == nil || err.Error() != "image not found" {
+		t.Errorf("expected image not found, got %v", err)
+	}
+}
+
+func TestResolveZone(t *testing.T) {
+
+	zones := []compute.AvailabilityZone{{ZoneName: "az1"}, {ZoneName: "AZ2"}, {ZoneName: "az2"}}
+
+	if got, err := resolveZone("AZ1", zones); err != nil || got != "az1" {
+		t.Errorf("expected the case to be ignored, got %s %v", got, err)
+	}
+	if got, err := resolveZone("az2", zones); err != nil || got != "az2" {
+		t.Errorf("expected the exact match, got %s %v", got, err)
+	}
+	if _, err := resolveZone("Az2", zones); err == nil {
+		t.Errorf("expected Az2 to be ambiguous")
+	}
+}
@@ -0,0 +1,24 @@
+#!/bin/bash
+
+# prints the kubeManifest entries of manifest.go for the given Kubernetes
+# releases, paste them into the map and run gofmt, for example:
+# scripts/kube-digests.sh v1.0.1 v1.2.7
+set -eo pipefail
+
+BASE_URL=${BASE_URL:-https://storage.googleapis.com/kubernetes-release/release}
+BINARIES="kubectl kube-apiserver kube-controller-manager kube-scheduler kubelet kube-proxy"
+KUBE_REGISTER_URL=$(sed -n 's/^[[:space:]]*KubeRegisterURL *= *"\(.*\)"/\1/p' "$(dirname "$0")/../constants.go")
+
+sha256() {
+  wget -q -O - "$1" | sha256sum | cut -d' ' -f1
+}
+
+register=$(sha256 "$KUBE_REGISTER_URL")
+for version in "$@"; do
+  echo "\"$version\": {"
+  for binary in $BINARIES; do
+    echo "\"$binary\": \"$(sha256 "$BASE_URL/$version/bin/linux/amd64/$binary")\","
+  done
+  echo "\"kube-register\": \"$register\","
+  echo "},"
+done
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+// securityGroupRule is an ingress rule of a cluster security group
+type securityGroupRule struct {
+	Protocol network.IPProtocol
+	Min      int
+	Max      int
+}
+
+// internalRules open the ports the members talk to each other on: etcd
+// client and peer, flannel VXLAN, the kubelet, its read-only port and
+// cAdvisor, and on the master the API server and the registry mirror.
+var internalRules = []securityGroupRule{
+	{network.TCP, 2379, 2380},
+	{network.UDP, 8472, 8472},
+	{network.TCP, 10250, 10250},
+	{network.TCP, 10255, 10255},
+	{network.TCP, 4194, 4194},
+	{network.TCP, KubeAPISecurePort, KubeAPISecurePort},
+	{network.TCP, 5000, 5000},
+}
+
+// externalRules open SSH and, with expose-api, the API server to the
+// external CIDR
+func externalRules() []securityGroupRule {
+
+	rules := []securityGroupRule{{network.TCP, 22, 22}}
+	if config.ExposeAPI {
+		rules = append(rules, securityGroupRule{network.TCP, KubeAPISecurePort, KubeAPISecurePort})
+	}
+	return rules
+}
+
+// clusterSecurityGroups are the ids of the groups the ports of the nodes
+// are created with
+var clusterSecurityGroups []string
+
+// securityGroupTask makes sure the internal and external security groups
+// of the cluster exist with their rules before any port is created.
+func securityGroupTask(c *cli.Context) error {
+	return ensureSecurityGroups()
+}
+
+// ensureSecurityGroups creates the security groups of the cluster unless
+// they exist and adds the rules they are missing. Groups are owned by the
+// cluster when their description carries its id, groups of the same name
+// owned by someone else are left alone.
+func ensureSecurityGroups() error {
+
+	all, err := provider.SecurityGroups()
+	if err != nil {
+		return newResourceError("get security groups", "", err)
+	}
+
+	internal, err := ensureSecurityGroup(all, SecurityGroupInternal)
+	if err != nil {
+		return err
+	}
+	external, err := ensureSecurityGroup(all, SecurityGroupExternal)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range internalRules {
+		if err := ensureSecurityGroupRule(internal, v, internal.ID, ""); err != nil {
+			return err
+		}
+	}
+	for _, v := range externalRules() {
+		if err := ensureSecurityGroupRule(external, v, "", config.externalCIDR()); err != nil {
+			return err
+		}
+	}
+
+	clusterSecurityGroups = []string{internal.ID, external.ID}
+	return nil
+}
+
+// securityGroupName returns the name of the internal or external group,
+// for example kubernetes-internal
+func securityGroupName(suffix string) string {
+	return config.Name + "-" + suffix
+}
+
+// securityGroupDescription marks a security group as owned by the cluster
+func securityGroupDescription() string {
+	return fmt.Sprintf("kubesetup cluster %s %s", config.Name, clusterID)
+}
+
+// ownedSecurityGroups returns the groups of the cluster, those recorded in
+// the state and those carrying the cluster id in their description
+func ownedSecurityGroups(all []network.SecurityGroup) []network.SecurityGroup {
+
+	recorded := make(map[string]bool)
+	for _, v := range state.SecurityGroups {
+		recorded[v] = true
+	}
+
+	var owned []network.SecurityGroup
+	for _, v := range all {
+		if recorded[v.ID] || v.Description == securityGroupDescription() {
+			owned = append(owned, v)
+		}
+	}
+	return owned
+}
+
+func ensureSecurityGroup(all []network.SecurityGroup, suffix string) (network.SecurityGroup, error) {
+
+	name := securityGroupName(suffix)
+
+	for _, v := range ownedSecurityGroups(all) {
+		if v.Name == name {
+			log.Printf("%-20s - %s %s\n", "secgroup exists", name, v.ID)
+			return v, nil
+		}
+	}
+
+	log.Printf("%-20s - %s\n", "create secgroup", name)
+
+	group, err := provider.CreateSecurityGroup(network.CreateSecurityGroupParameters{
+		Name:        name,
+		Description: securityGroupDescription(),
+	})
+	if err != nil {
+		return group, newResourceError("create security group", name, err)
+	}
+	created.record(journalSecurityGroup, group.ID, name)
+
+	clusterMutex.Lock()
+	state.SecurityGroups = append(state.SecurityGroups, group.ID)
+	err = writeState()
+	clusterMutex.Unlock()
+	if err != nil {
+		return group, err
+	}
+
+	log.Printf("%-20s - %s %s %s\n", "create secgroup", name, group.ID, "COMPLETED")
+
+	return group, nil
+}
+
+// ensureSecurityGroupRule adds an ingress rule from the remote group or
+// CIDR unless the group has it. Rules added by hand are kept.
+func ensureSecurityGroupRule(group network.SecurityGroup, rule securityGroupRule, remoteGroupID string, remoteIPPrefix string) error {
+
+	for _, v := range group.SecurityGroupRules {
+		if v.Direction == "ingress" && v.IPProtocol != nil && *v.IPProtocol == rule.Protocol &&
+			v.PortRangeMin != nil && *v.PortRangeMin == rule.Min &&
+			v.PortRangeMax != nil && *v.PortRangeMax == rule.Max &&
+			stringValue(v.RemoteGroupID) == remoteGroupID && stringValue(v.RemoteIPPrefix) == remoteIPPrefix {
+			return nil
+		}
+	}
+
+	description := fmt.Sprintf("%s %d-%d/%s", group.Name, rule.Min, rule.Max, rule.Protocol)
+	log.Printf("%-20s - %s\n", "create secgroup rule", description)
+
+	parameters := network.CreateSecurityGroupRuleParameters{
+		Direction:       "ingress",
+		PortRangeMin:    &rule.Min,
+		PortRangeMax:    &rule.Max,
+		IPProtocol:      &rule.Protocol,
+		SecurityGroupID: group.ID,
+	}
+	if remoteGroupID != "" {
+		parameters.RemoteGroupID = &remoteGroupID
+	}
+	if remoteIPPrefix != "" {
+		parameters.RemoteIPPrefix = &remoteIPPrefix
+	}
+
+	if _, err := provider.CreateSecurityGroupRule(parameters); err != nil {
+		return newResourceError("create security group rule", description, err)
+	}
+
+	log.Printf("%-20s - %s %s\n", "create secgroup rule", description, "COMPLETED")
+
+	return nil
+}
+
+// deleteSecurityGroups deletes the groups owned by the cluster. It is
+// called once the ports using them are gone.
+func deleteSecurityGroups() error {
+
+	all, err := provider.SecurityGroups()
+	if err != nil {
+		return newResourceError("get security groups", "", err)
+	}
+
+	for _, v := range ownedSecurityGroups(all) {
+
+		log.Printf("%-20s - %s\n", "delete secgroup", v.Name)
+
+		if err := noErrorOn404(provider.DeleteSecurityGroup(v.ID)); err != nil {
+			return newResourceError("delete security group", v.Name, err)
+		}
+
+		log.Printf("%-20s - %s %s\n", "delete secgroup", v.Name, "COMPLETED")
+	}
+
+	clusterSecurityGroups = nil
+	return nil
+}
+
+func stringValue(s *string) string {
+
+	if s == nil {
+		return ""
+	}
+	return *s
+}
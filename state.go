@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// clusterState records what the tool created for a cluster. It is kept
+// next to the configuration file, so later commands find the resources
+// by id instead of rediscovering them by name.
+type clusterState struct {
+	Name            string               `json:"name"`
+	ClusterID       string               `json:"cluster_id,omitempty"`
+	DiscoveryURL    string               `json:"discovery_url,omitempty"`
+	EtcdMembers     []etcdMember         `json:"etcd_members,omitempty"`
+	SecurityGroups  []string             `json:"security_groups,omitempty"`
+	Network         networkState         `json:"network"`
+	Nodes           map[string]nodeState `json:"nodes"`
+	KeptFloatingIPs []keptFloatingIP     `json:"kept_floating_ips,omitempty"`
+}
+
+// keptFloatingIP is an address the tool allocated and kept when its node
+// was removed, the next node that needs one reuses it
+type keptFloatingIP struct {
+	ID string `json:"id"`
+	IP string `json:"ip"`
+}
+
+// networkState holds the network, subnet and router install created, they
+// stay empty when the cluster uses an existing network. RouterInterface
+// tells whether the subnet was attached to the router.
+type networkState struct {
+	NetworkID       string `json:"network_id,omitempty"`
+	SubnetID        string `json:"subnet_id,omitempty"`
+	RouterID        string `json:"router_id,omitempty"`
+	RouterInterface bool   `json:"router_interface,omitempty"`
+}
+
+// nodeState holds the OpenStack resources of a single node and the hash of
+// the cloud-config it was booted with. FloatingIPAllocated is set when the
+// tool allocated the floating IP, only those addresses are ever released.
+type nodeState struct {
+	ServerID            string `json:"server_id,omitempty"`
+	PortID              string `json:"port_id,omitempty"`
+	FloatingIPID        string `json:"floating_ip_id,omitempty"`
+	FloatingIP          string `json:"floating_ip,omitempty"`
+	FloatingIPAllocated bool   `json:"floating_ip_allocated,omitempty"`
+	CloudConfigHash     string `json:"cloud_config_sha256,omitempty"`
+}
+
+var (
+	state     clusterState
+	stateFile string
+)
+
+// statePath returns the state file for a configuration file, for example
+// .kubesetup-state.json for kubesetup.yml.
+func statePath(configFile string) string {
+
+	base := filepath.Base(configFile)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	return filepath.Join(filepath.Dir(configFile), "."+base+StateFileSuffix)
+}
+
+// readStateFile returns the state in filename, or an empty state when the
+// file does not exist yet.
+func readStateFile(filename string) (clusterState, error) {
+
+	s := clusterState{Nodes: make(map[string]nodeState)}
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, err
+	}
+	if s.Nodes == nil {
+		s.Nodes = make(map[string]nodeState)
+	}
+	return s, nil
+}
+
+// writeStateFile replaces filename atomically, so an interrupted run never
+// leaves a truncated state file behind.
+func writeStateFile(filename string, s clusterState) error {
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// saveState writes the state of the running command
+func saveState() error {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	return writeState()
+}
+
+func writeState() error {
+
+	if err := writeStateFile(stateFile, state); err != nil {
+		return newResourceError("write state", stateFile, err)
+	}
+	return nil
+}
+
+// updateNode applies update to the state of the named node and saves it
+func updateNode(name string, update func(*nodeState)) error {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+
+	n := state.Nodes[name]
+	update(&n)
+	state.Nodes[name] = n
+	return writeState()
+}
+
+// forget clears every reference to the resource id, or floating IP
+// address, from the state
+func (s *clusterState) forget(id string) {
+
+	for k, v := range s.Nodes {
+		if v.ServerID == id {
+			v.ServerID = ""
+		}
+		if v.PortID == id {
+			v.PortID = ""
+		}
+		if v.FloatingIPID == id || v.FloatingIP == id {
+			v.FloatingIPID = ""
+			v.FloatingIP = ""
+			v.FloatingIPAllocated = false
+		}
+		s.Nodes[k] = v
+	}
+
+	var groups []string
+	for _, v := range s.SecurityGroups {
+		if v != id {
+			groups = append(groups, v)
+		}
+	}
+	s.SecurityGroups = groups
+
+	switch id {
+	case s.Network.NetworkID:
+		s.Network.NetworkID = ""
+	case s.Network.SubnetID:
+		s.Network.SubnetID = ""
+	case s.Network.RouterID:
+		s.Network.RouterID = ""
+		s.Network.RouterInterface = false
+	}
+}
+
+// removeStateFile deletes the state once the cluster is gone
+func removeStateFile() error {
+
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return newResourceError("remove state", stateFile, err)
+	}
+	return nil
+}
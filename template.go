@@ -4,15 +4,82 @@ import (
 	"text/template"
 )
 
+// fetchFile is the write_files entry of /opt/bin/fetch, which downloads a
+// binary, retrying, and checks its SHA-256 digest. It refuses a binary
+// without a digest unless it is passed FetchUnverified instead. A unit
+// whose binary does not match fails in ExecStartPre and never starts.
+const fetchFile = `  - path: /opt/bin/fetch
+    owner: root
+    permissions: 0755
+    content: |
+      #!/bin/bash
+      # fetch <url> <file> <sha256|unverified>
+      url=$1 file=$2 sum=$3
+      if [ -z "$sum" ]; then
+        echo "fetch: no sha256 for $url, refusing to run it unverified" >&2
+        exit 1
+      fi
+      verify() { [ -s "$file" ] && { [ "$sum" = unverified ] || echo "$sum  $file" | sha256sum -c --status; }; }
+      [ "$sum" != unverified ] && verify && exit 0
+      for i in $(seq ${FETCH_TRIES:-5}); do
+        [ $i -gt 1 ] && sleep $((i * 5))
+        if /usr/bin/wget -q -O "$file.part" "$url" && mv -f "$file.part" "$file" && verify; then
+          exec chmod +x "$file"
+        fi
+        rm -f "$file.part"
+      done
+      [ "$sum" != unverified ] && rm -f "$file"
+      echo "fetch: $url failed or does not match sha256 $sum" >&2
+      exit 1
+`
+
+// sslFiles defines the write_files entries of a certificate and its key
+// under /etc/kubernetes/ssl, kubeconfigFile the kubeconfig a client on a
+// worker reaches the API server with. Both are called with the name of the
+// key pair.
+const sslFiles = `{{define "cert"}}  - path: /etc/kubernetes/ssl/{{.}}.pem
+    owner: root
+    permissions: 0644
+    content: |
+{{end}}{{define "key"}}  - path: /etc/kubernetes/ssl/{{.}}-key.pem
+    owner: root
+    permissions: 0600
+    content: |
+{{end}}{{define "kubeconfig"}}  - path: /etc/kubernetes/{{.}}-kubeconfig.yaml
+    owner: root
+    permissions: 0644
+    content: |
+      apiVersion: v1
+      kind: Config
+      clusters:
+      - name: local
+        cluster:
+          certificate-authority: /etc/kubernetes/ssl/ca.pem
+      users:
+      - name: {{.}}
+        user:
+          client-certificate: /etc/kubernetes/ssl/{{.}}.pem
+          client-key: /etc/kubernetes/ssl/{{.}}-key.pem
+      contexts:
+      - name: {{.}}
+        context:
+          cluster: local
+          user: {{.}}
+      current-context: {{.}}
+{{end}}`
+
 /*
   Adopted from https://github.com/kelseyhightower/kubeconfig/template.go
   License: https://github.com/kelseyhightower/kubeconfig/blob/master/LICENSE
 
   Copyright (c) 2014 Kelsey Hightower
 */
-var masterTmpl = template.Must(template.New("node").Parse(`#cloud-config
+var masterTmpl = template.Must(template.New("node").Parse(sslFiles + `#cloud-config
 
 write_files:
+` + fetchFile + `{{template "cert" "ca"}}{{index . "ca.pem"}}
+{{template "cert" "apiserver"}}{{index . "apiserver.pem"}}
+{{template "key" "apiserver"}}{{index . "apiserver-key.pem"}}
   - path: /opt/bin/waiter.sh
     owner: root
     permissions: 0755
@@ -23,8 +90,12 @@ write_files:
 coreos:
   etcd2:
     name: master
+{{- if .discovery}}
+    discovery: {{.discovery}}
+{{- else}}
     initial-cluster-token: k8s_etcd
-    initial-cluster: master=http://{{.ip}}:2380
+    initial-cluster: {{.initialcluster}}
+{{- end}}
     listen-peer-urls: http://{{.ip}}:2380,http://localhost:2380
     initial-advertise-peer-urls: http://{{.ip}}:2380
     listen-client-urls: http://{{.ip}}:2379,http://localhost:2379
@@ -80,7 +151,11 @@ coreos:
         Environment=DOCKER_HOST=unix:///var/run/early-docker.sock
         ExecStartPre=-/usr/bin/docker kill docker-registry
         ExecStartPre=-/usr/bin/docker rm docker-registry
-        ExecStartPre=/usr/bin/docker pull quay.io/devops/docker-registry:latest
+{{- if .registryarchive}}
+        ExecStartPre=/usr/bin/bash -c '/usr/bin/wget -q -O - {{.registryarchive}} | /usr/bin/docker load'
+{{- else}}
+        ExecStartPre=/usr/bin/docker pull {{.registryimage}}
+{{- end}}
         # GUNICORN_OPTS is an workaround for
         # https://github.com/docker/docker-registry/issues/892
         ExecStart=/usr/bin/docker run --rm --net host --name docker-registry \
@@ -89,7 +164,7 @@ coreos:
             -e MIRROR_SOURCE=https://registry-1.docker.io \
             -e MIRROR_SOURCE_INDEX=https://index.docker.io \
             -e MIRROR_TAGS_CACHE_TTL=1800 \
-            quay.io/devops/docker-registry:latest
+            {{.registryimage}}
     - name: docker.service
       drop-ins:
         - name: 51-docker-mirror.conf
@@ -112,8 +187,7 @@ coreos:
         After=network-online.target
 
         [Service]
-        ExecStart=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kubectl
-        ExecStart=/usr/bin/chmod +x /opt/bin/kubectl
+        ExecStart=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kubectl /opt/bin/kubectl{{with index . "kubectl.sha256"}} {{.}}{{end}}
         Type=oneshot
         RemainAfterExit=true
     - name: kube-apiserver.service
@@ -126,11 +200,16 @@ coreos:
         After=etcd2-waiter.service
 
         [Service]
-        ExecStartPre=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kube-apiserver
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kube-apiserver
+        ExecStartPre=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kube-apiserver /opt/bin/kube-apiserver{{with index . "kube-apiserver.sha256"}} {{.}}{{end}}
         ExecStart=/opt/bin/kube-apiserver \
-        --insecure-bind-address=0.0.0.0 \
-        --service-cluster-ip-range=10.100.0.0/16 \
+        --insecure-bind-address=127.0.0.1 \
+        --insecure-port={{.insecureapiport}} \
+        --bind-address=0.0.0.0 \
+        --secure-port={{.apiport}} \
+        --tls-cert-file=/etc/kubernetes/ssl/apiserver.pem \
+        --tls-private-key-file=/etc/kubernetes/ssl/apiserver-key.pem \
+        --client-ca-file=/etc/kubernetes/ssl/ca.pem \
+        --service-cluster-ip-range={{.serviceiprange}} \
         --etcd-servers=http://localhost:2379
         Restart=always
         RestartSec=10
@@ -144,10 +223,9 @@ coreos:
         After=kube-apiserver.service
 
         [Service]
-        ExecStartPre=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kube-controller-manager
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kube-controller-manager
+        ExecStartPre=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kube-controller-manager /opt/bin/kube-controller-manager{{with index . "kube-controller-manager.sha256"}} {{.}}{{end}}
         ExecStart=/opt/bin/kube-controller-manager \
-        --master=127.0.0.1:8080
+        --master=127.0.0.1:{{.insecureapiport}}
         Restart=always
         RestartSec=10
     - name: kube-scheduler.service
@@ -160,10 +238,9 @@ coreos:
         After=kube-apiserver.service
 
         [Service]
-        ExecStartPre=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kube-scheduler
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kube-scheduler
+        ExecStartPre=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kube-scheduler /opt/bin/kube-scheduler{{with index . "kube-scheduler.sha256"}} {{.}}{{end}}
         ExecStart=/opt/bin/kube-scheduler \
-        --master=127.0.0.1:8080
+        --master=127.0.0.1:{{.insecureapiport}}
         Restart=always
         RestartSec=10
     - name: kube-register.service
@@ -176,12 +253,11 @@ coreos:
         After=kube-apiserver.service fleet.service
 
         [Service]
-        ExecStartPre=-/usr/bin/wget -nc -O /opt/bin/kube-register https://github.com/kelseyhightower/kube-register/releases/download/v0.0.3/kube-register-0.0.3-linux-amd64
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kube-register
+        ExecStartPre=/opt/bin/fetch {{.kuberegister}} /opt/bin/kube-register{{with index . "kube-register.sha256"}} {{.}}{{end}}
         ExecStart=/opt/bin/kube-register \
         --metadata=k8srole=node \
         --fleet-endpoint=unix:///var/run/fleet.sock \
-        --api-endpoint=http://127.0.0.1:8080
+        --api-endpoint=http://127.0.0.1:{{.insecureapiport}}
         Restart=always
         RestartSec=10
   update:
@@ -191,26 +267,45 @@ coreos:
 ssh_authorized_keys:
     - {{.sshkey}}`))
 
-var nodeTmpl = template.Must(template.New("node").Parse(`#cloud-config
+var nodeTmpl = template.Must(template.New("node").Parse(sslFiles + `#cloud-config
 
 write_files:
-  - path: /opt/bin/wupiao
+` + fetchFile + `{{template "cert" "ca"}}{{index . "ca.pem"}}
+{{template "cert" "kubelet"}}{{index . "kubelet.pem"}}
+{{template "key" "kubelet"}}{{index . "kubelet-key.pem"}}
+{{template "cert" "kube-proxy"}}{{index . "kube-proxy.pem"}}
+{{template "key" "kube-proxy"}}{{index . "kube-proxy-key.pem"}}
+{{template "kubeconfig" "kubelet"}}{{template "kubeconfig" "kube-proxy"}}  - path: /opt/bin/wupiao
     owner: root
     permissions: 0755
     content: |
       #!/bin/bash
       # [w]ait [u]ntil [p]ort [i]s [a]ctually [o]pen
       [ -n "$1" ] && [ -n "$2" ] && while ! curl --output /dev/null \
-        --silent --head --fail \
-        http://${1}:${2}; do sleep 1 && echo -n .; done;
+        --silent --cacert /etc/kubernetes/ssl/ca.pem \
+        https://${1}:${2}; do sleep 1 && echo -n .; done;
       exit $?
 
 coreos:
   etcd2:
+{{- if .member}}
+    name: {{.hostname}}
+    initial-cluster-token: k8s_etcd
+    initial-cluster: {{.initialcluster}}
+    listen-peer-urls: http://{{.ip}}:2380,http://localhost:2380
+    initial-advertise-peer-urls: http://{{.ip}}:2380
+    listen-client-urls: http://{{.ip}}:2379,http://localhost:2379
+    advertise-client-urls: http://{{.ip}}:2379
+{{- else}}
     listen-client-urls: http://localhost:2379
     advertise-client-urls: http://0.0.0.0:2379
-    initial-cluster: master=http://{{.master}}:2380
+{{- if .discovery}}
+    discovery: {{.discovery}}
+{{- else}}
+    initial-cluster: {{.initialcluster}}
+{{- end}}
     proxy: on
+{{- end}}
   fleet:
     etcd_servers: http://localhost:2379
     metadata: k8srole=node
@@ -242,12 +337,12 @@ coreos:
         After=network-online.target
 
         [Service]
-        ExecStartPre=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kubelet
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kubelet
+        ExecStartPre=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kubelet /opt/bin/kubelet{{with index . "kubelet.sha256"}} {{.}}{{end}}
         # wait for kubernetes master to be up and ready
-        ExecStartPre=/opt/bin/wupiao {{.master}} 8080
+        ExecStartPre=/opt/bin/wupiao {{.master}} {{.apiport}}
         ExecStart=/opt/bin/kubelet \
-        --api-servers={{.master}}:8080 \
+        --api-servers=https://{{.master}}:{{.apiport}} \
+        --kubeconfig=/etc/kubernetes/kubelet-kubeconfig.yaml \
         --hostname-override={{.ip}}
         Restart=always
         RestartSec=10
@@ -261,12 +356,12 @@ coreos:
         After=network-online.target
 
         [Service]
-        ExecStartPre=/usr/bin/wget -N -P /opt/bin https://storage.googleapis.com/kubernetes-release/release/v1.0.1/bin/linux/amd64/kube-proxy
-        ExecStartPre=/usr/bin/chmod +x /opt/bin/kube-proxy
+        ExecStartPre=/opt/bin/fetch {{.kubebaseurl}}/{{.kubeversion}}/bin/linux/amd64/kube-proxy /opt/bin/kube-proxy{{with index . "kube-proxy.sha256"}} {{.}}{{end}}
         # wait for kubernetes master to be up and ready
-        ExecStartPre=/opt/bin/wupiao {{.master}} 8080
+        ExecStartPre=/opt/bin/wupiao {{.master}} {{.apiport}}
         ExecStart=/opt/bin/kube-proxy \
-        --master=http://{{.master}}:8080
+        --master=https://{{.master}}:{{.apiport}} \
+        --kubeconfig=/etc/kubernetes/kube-proxy-kubeconfig.yaml
         Restart=always
         RestartSec=10
 
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+
+	"github.com/codegangsta/cli"
+)
+
+// configProblem is a single finding of validateTask. Path is the setting
+// in the configuration file, Line its line number or zero when unknown.
+type configProblem struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+// configValidator collects the problems of a configuration file
+type configValidator struct {
+	filename string
+	config   configContainer
+	lines    map[string]int
+	problems []configProblem
+}
+
+// validateTask checks the configuration file and the OpenStack resources it
+// refers to in one pass and prints every problem with its line number.
+func validateTask(c *cli.Context) error {
+
+	filename := c.GlobalString(Config)
+
+	problems, err := validateConfig(c)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Fprintf(os.Stdout, "%s:%d: %s: %s\n", filename, p.Line, p.Path, p.Message)
+		} else {
+			fmt.Fprintf(os.Stdout, "%s: %s: %s\n", filename, p.Path, p.Message)
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		fmt.Fprintf(os.Stdout, "%s: OK\n", filename)
+		return nil
+	case 1:
+		return fmt.Errorf("1 problem found in %s", filename)
+	}
+	return fmt.Errorf("%d problems found in %s", len(problems), filename)
+}
+
+// validateConfig returns the problems of the configuration file ordered by
+// line. The error is set when the file cannot be read or OpenStack cannot
+// be reached, not for problems of the configuration.
+func validateConfig(c *cli.Context) ([]configProblem, error) {
+
+	filename := c.GlobalString(Config)
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, newResourceError("read config", filename, err)
+	}
+
+	v := &configValidator{filename: filename, lines: yamlLines(b)}
+
+	// problems of the templates are reported like the others, the hosts
+	// they still allow are checked as well
+	v.config, err = readConfigFile(filename)
+	if problems, ok := err.(templateError); ok {
+		for _, p := range problems {
+			v.report(p.Path, "%s", p.Message)
+		}
+	} else if err != nil {
+		return nil, newResourceError("read config", filename, err)
+	}
+
+	v.checkMaster()
+	v.checkAddresses()
+	v.checkExternalCIDR()
+	v.checkEtcd()
+	v.checkKubernetes()
+	v.checkMirror()
+
+	provider, err = newProvider(c)
+	if err != nil {
+		return nil, err
+	}
+
+	v.checkKeyPair()
+	v.checkNetwork()
+	v.checkImages()
+	v.checkFlavors()
+	v.checkExternalNetwork()
+	v.checkFloatingIP()
+
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].Line < v.problems[j].Line })
+	return v.problems, nil
+}
+
+// report adds a problem for the setting at path
+func (v *configValidator) report(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, configProblem{Path: path, Line: yamlLine(v.lines, path), Message: fmt.Sprintf(format, args...)})
+}
+
+// reportReference reports a reference to a resource that could not be
+// resolved, listing the candidates when a name is ambiguous
+func (v *configValidator) reportReference(path string, kind string, ref string, err error) {
+
+	switch err.(type) {
+	case *notFoundError:
+		v.report(path, "%s %s not found", kind, ref)
+	case *ambiguousError:
+		v.report(path, "%s %s is %s", kind, ref, err.Error())
+	default:
+		v.report(path, "get %s %s: %s", kind, ref, err.Error())
+	}
+}
+
+// path returns the setting a field of a host comes from
+func (v *configValidator) path(name string, field string) string {
+	return v.config.Paths[name+"."+field]
+}
+
+func (v *configValidator) names() []string {
+
+	var names []string
+	for k := range v.config.Nodes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (v *configValidator) checkMaster() {
+
+	var masters []string
+	for _, k := range v.names() {
+		if v.config.Nodes[k].IsMaster {
+			masters = append(masters, k)
+		}
+	}
+
+	switch {
+	case len(masters) == 0 && v.config.Legacy:
+		v.report("hosts", "no master, exactly one host needs ismaster: true")
+	case len(masters) == 0:
+		v.report("templates.master", "no master")
+	case len(masters) > 1:
+		for _, k := range masters {
+			v.report(v.path(k, "role"), "%s is one of %d masters, exactly one is allowed", k, len(masters))
+		}
+	}
+}
+
+func (v *configValidator) checkAddresses() {
+
+	owners := make(map[string][]string)
+	for _, k := range v.names() {
+
+		ip := v.config.Nodes[k].IP
+		if ip == "" {
+			continue
+		}
+		if net.ParseIP(ip).To4() == nil {
+			v.report(v.path(k, "ip"), "%s has no valid IPv4 address %q", k, ip)
+			continue
+		}
+		owners[ip] = append(owners[ip], k)
+	}
+
+	for _, k := range v.names() {
+		ip := v.config.Nodes[k].IP
+		if ip != "" && len(owners[ip]) > 1 {
+			v.report(v.path(k, "ip"), "address %s of %s is also used by %s", ip, k, strings.Join(others(owners[ip], k), ", "))
+		}
+	}
+}
+
+func (v *configValidator) checkExternalCIDR() {
+
+	if v.config.ExternalCIDR == "" {
+		return
+	}
+	if _, _, err := net.ParseCIDR(v.config.ExternalCIDR); err != nil {
+		v.report(v.config.Paths["external-cidr"], "%q is not a CIDR", v.config.ExternalCIDR)
+	}
+}
+
+// checkEtcd checks the discovery mode and the static members
+func (v *configValidator) checkEtcd() {
+
+	s := v.config.etcd()
+	if _, err := etcdDiscoveryService(s); err != nil {
+		v.report(v.config.Paths["etcd.discovery"], "%s", err.Error())
+		return
+	}
+	if err := checkEtcdSection(s, v.config.Nodes); err != nil {
+		v.report(v.config.Paths["etcd.members"], "%s", err.Error())
+	}
+}
+
+// checkKubernetes checks the Kubernetes release and where it is
+// downloaded from
+func (v *configValidator) checkKubernetes() {
+
+	s := v.config.kubernetes()
+	if _, err := kubeVersion(s); err != nil {
+		v.report(v.config.Paths["kubernetes.version"], "%s", err.Error())
+	}
+	if err := checkKubeBaseURL(s.BaseURL); err != nil {
+		v.report(v.config.Paths["kubernetes.base-url"], "%s", err.Error())
+	}
+	if err := checkDigests(s); err != nil {
+		v.report(v.config.Paths["kubernetes.sha256"], "%s", err.Error())
+	}
+	if version, err := kubeVersion(s); err == nil {
+		if err := checkVerified(s, version); err != nil {
+			v.report(v.config.Paths["kubernetes.sha256"], "%s", err.Error())
+		}
+	}
+}
+
+// checkMirror checks that the mirror the hosts download from is a URL
+func (v *configValidator) checkMirror() {
+
+	if v.config.Mirror == "" {
+		return
+	}
+	if !isHTTPURL(v.config.Mirror) {
+		v.report(v.config.Paths["mirror"], "mirror %q is not an http(s) URL", v.config.Mirror)
+	}
+}
+
+func others(names []string, name string) []string {
+
+	var result []string
+	for _, v := range names {
+		if v != name {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (v *configValidator) checkKeyPair() {
+
+	if _, err := provider.KeyPair(v.config.SSHKey); err != nil {
+		if httpStatusCode(err) == 404 {
+			v.report(v.config.Paths["sshkey"], "keypair %s not found", v.config.SSHKey)
+		} else {
+			v.report(v.config.Paths["sshkey"], "get keypair %s: %s", v.config.SSHKey, err.Error())
+		}
+	}
+}
+
+// checkNetwork checks that the network and subnet references are unique
+// and every address lies in the subnet and is not taken by a port outside
+// the cluster
+func (v *configValidator) checkNetwork() {
+
+	path := v.config.Paths["network"]
+
+	networks, err := provider.QueryNetworks(network.QueryParameters{})
+	if err != nil {
+		v.report(path, "get networks: %s", err.Error())
+		return
+	}
+	found, err := resolveNetwork(v.config.Network, networks)
+	if _, missing := err.(*notFoundError); missing && v.config.CreateNetwork != nil {
+		v.checkCreateNetwork()
+		return
+	}
+	if err != nil {
+		v.reportReference(path, "network", v.config.Network, err)
+		return
+	}
+	if len(found.Subnets) == 0 {
+		v.report(path, "network %s has no subnet", v.config.Network)
+		return
+	}
+
+	allSubnets, err := provider.Subnets()
+	if err != nil {
+		v.report(path, "get subnets: %s", err.Error())
+		return
+	}
+
+	if v.config.Subnet != "" {
+		path = v.config.Paths["subnet"]
+	}
+	s, err := resolveSubnet(v.config.Subnet, found, allSubnets)
+	if err != nil {
+		v.reportReference(path, "subnet", v.config.Subnet, err)
+		return
+	}
+	_, cidr, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		v.report(path, "subnet %s has an invalid CIDR %s", s.ID, s.CIDR)
+		return
+	}
+
+	allPorts, err := provider.Ports()
+	if err != nil {
+		v.report(path, "get ports: %s", err.Error())
+		return
+	}
+	own, err := v.clusterPorts(allPorts)
+	if err != nil {
+		v.report(path, "get cluster servers: %s", err.Error())
+		return
+	}
+
+	used := make(map[string]network.PortResponse)
+	for _, p := range allPorts {
+		if p.NetworkID != found.ID || own[p.ID] {
+			continue
+		}
+		for _, ip := range p.FixedIPs {
+			used[ip.IPAddress] = p
+		}
+	}
+
+	for _, k := range v.names() {
+
+		ip := net.ParseIP(v.config.Nodes[k].IP)
+		if ip == nil {
+			continue
+		}
+		if !cidr.Contains(ip) {
+			v.report(v.path(k, "ip"), "address %s of %s is outside subnet %s", ip, k, cidr)
+			continue
+		}
+		if p, ok := used[ip.String()]; ok {
+			v.report(v.path(k, "ip"), "address %s of %s is already used by port %s %s", ip, k, p.ID, p.Name)
+		}
+	}
+}
+
+// checkCreateNetwork checks the network install creates and that every
+// address lies in its CIDR
+func (v *configValidator) checkCreateNetwork() {
+
+	section := *v.config.CreateNetwork
+	if err := checkNetworkSection(section); err != nil {
+		v.report(v.config.Paths["create-network"], "%s", err.Error())
+		return
+	}
+
+	_, cidr, _ := net.ParseCIDR(section.CIDR)
+	for _, k := range v.names() {
+		ip := net.ParseIP(v.config.Nodes[k].IP)
+		if ip != nil && !cidr.Contains(ip) {
+			v.report(v.path(k, "ip"), "address %s of %s is outside subnet %s", ip, k, cidr)
+		}
+	}
+}
+
+// clusterPorts returns the ids of the ports that belong to the cluster, the
+// ports of its servers and the ports recorded in the state
+func (v *configValidator) clusterPorts(allPorts []network.PortResponse) (map[string]bool, error) {
+
+	own := make(map[string]bool)
+
+	s, err := readStateFile(statePath(v.filename))
+	if err == nil {
+		for _, n := range s.Nodes {
+			if n.PortID != "" {
+				own[n.PortID] = true
+			}
+		}
+	}
+
+	allServers, err := provider.ServerDetails()
+	if err != nil {
+		return nil, err
+	}
+	members, _, err := clusterServers(allServers, v.config.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	memberIDs := make(map[string]bool)
+	for _, m := range members {
+		memberIDs[m.ID] = true
+	}
+
+	for _, p := range allPorts {
+		if memberIDs[p.DeviceID] {
+			own[p.ID] = true
+		}
+	}
+	return own, nil
+}
+
+// checkImages checks that every image exists and its name is unique
+func (v *configValidator) checkImages() {
+
+	all, err := provider.Images()
+	if err != nil {
+		v.reportHosts("image", "get images: %s", err.Error())
+		return
+	}
+
+	checked := make(map[string]bool)
+	for _, k := range v.names() {
+
+		node := v.config.Nodes[k]
+		path := v.path(k, "image")
+		if checked[path] {
+			continue
+		}
+		checked[path] = true
+
+		if node.ImageID != "" {
+			if !hasImage(all, node.ImageID) {
+				v.report(path, "image %s not found", node.ImageID)
+			}
+			continue
+		}
+
+		if _, err := resolveImage(node.VMImage, all); err != nil {
+			v.reportReference(path, "image", node.VMImage, err)
+		}
+	}
+}
+
+func hasImage(images []image.Response, id string) bool {
+
+	for _, v := range images {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFlavors checks the flavors and availability zones of the hosts
+func (v *configValidator) checkFlavors() {
+
+	flavors, flavorsErr := provider.Flavors()
+	if flavorsErr != nil {
+		v.reportHosts("flavor", "get flavors: %s", flavorsErr.Error())
+	}
+	ids := make(map[string]bool)
+	for _, f := range flavors {
+		ids[f.ID] = true
+	}
+
+	zones, zonesErr := provider.AvailabilityZones()
+	if zonesErr != nil {
+		v.reportHosts("availabilityZone", "get availability zones: %s", zonesErr.Error())
+	}
+
+	checked := make(map[string]bool)
+	for _, k := range v.names() {
+
+		node := v.config.Nodes[k]
+
+		path := v.path(k, "flavor")
+		if !checked[path] && flavorsErr == nil {
+			checked[path] = true
+			if node.FlavorID != "" && !ids[node.FlavorID] {
+				v.report(path, "flavor %s not found", node.FlavorID)
+			}
+			if node.FlavorID == "" {
+				if _, err := resolveFlavor(node.VMSize, flavors); err != nil {
+					v.reportReference(path, "flavor", node.VMSize, err)
+				}
+			}
+		}
+
+		path = v.path(k, "availabilityZone")
+		if !checked[path] && node.AvailabilityZone != "" && zonesErr == nil {
+			checked[path] = true
+			if _, err := resolveZone(node.AvailabilityZone, zones); err != nil {
+				v.reportReference(path, "availability zone", node.AvailabilityZone, err)
+			}
+		}
+	}
+}
+
+// reportHosts reports a problem once at every setting a field of the hosts
+// comes from, for lookups that failed for all of them. Only the hosts that
+// set an availability zone are reported for it.
+func (v *configValidator) reportHosts(field string, format string, args ...interface{}) {
+
+	reported := make(map[string]bool)
+	for _, k := range v.names() {
+
+		node := v.config.Nodes[k]
+		if field == "availabilityZone" && node.AvailabilityZone == "" {
+			continue
+		}
+		path := v.path(k, field)
+		if !reported[path] {
+			reported[path] = true
+			v.report(path, format, args...)
+		}
+	}
+}
+
+// checkExternalNetwork checks that a floating IP can be allocated for the
+// master, which needs an external network that is up and has a subnet
+func (v *configValidator) checkExternalNetwork() {
+
+	if v.config.CreateNetwork != nil && v.config.CreateNetwork.ExternalNetwork != "" {
+		ref := v.config.CreateNetwork.ExternalNetwork
+		if _, err := externalNetwork(ref); err != nil {
+			v.reportReference(v.config.Paths["create-network.external-network"], "external network", ref, err)
+		}
+	}
+
+	_, err := externalNetwork("")
+	switch err.(type) {
+	case nil:
+	case *notFoundError:
+		v.report(v.config.Paths["network"], "no usable external network found for the floating IP of the master")
+	default:
+		v.report(v.config.Paths["network"], "get external networks: %s", err.Error())
+	}
+}
+
+// checkFloatingIP checks that the configured address of the master is a
+// floating IP of the tenant no server outside the cluster uses
+func (v *configValidator) checkFloatingIP() {
+
+	address := v.config.floatingIP().Address
+	if address == "" {
+		return
+	}
+	path := v.config.Paths["floating-ip.address"]
+
+	floatingIPs, err := provider.FloatingIPs()
+	if err != nil {
+		v.report(path, "get floating IPs: %s", err.Error())
+		return
+	}
+	for _, fp := range floatingIPs {
+		if fp.IP == address && fp.InstanceID != "" && !v.isMember(fp.InstanceID) {
+			v.report(path, "floating IP %s is associated with server %s", address, fp.InstanceID)
+		}
+		if fp.IP == address {
+			return
+		}
+	}
+	v.report(path, "floating IP %s is not allocated to the tenant", address)
+}
+
+// isMember tells whether the server belongs to the cluster
+func (v *configValidator) isMember(serverID string) bool {
+
+	allServers, err := provider.ServerDetails()
+	if err != nil {
+		return false
+	}
+	members, _, err := clusterServers(allServers, v.config.Name)
+	if err != nil {
+		return false
+	}
+	for _, m := range members {
+		if m.ID == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlLines maps the settings of a block style YAML document, as dotted
+// paths like templates.node.ips[0], to their line numbers. Flow sequences
+// are mapped item by item to the line they are on.
+func yamlLines(b []byte) map[string]int {
+
+	type level struct {
+		indent int
+		path   string
+	}
+
+	lines := make(map[string]int)
+	items := make(map[string]int)
+	var stack []level
+
+	for n, line := range strings.Split(string(b), "\n") {
+
+		content := strings.TrimSpace(line)
+		if i := strings.Index(content, " #"); i >= 0 {
+			content = strings.TrimSpace(content[:i])
+		}
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		// sequence items may be indented as far as their key
+		item := strings.HasPrefix(content, "- ") || content == "-"
+		for len(stack) > 0 && (stack[len(stack)-1].indent > indent || stack[len(stack)-1].indent == indent && !item) {
+			stack = stack[:len(stack)-1]
+		}
+		parent := ""
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].path
+		}
+
+		if item {
+			path := parent + "[" + strconv.Itoa(items[parent]) + "]"
+			items[parent]++
+			lines[path] = n + 1
+			continue
+		}
+
+		i := strings.Index(content, ":")
+		if i <= 0 {
+			continue
+		}
+		key := strings.Trim(strings.TrimSpace(content[:i]), `"'`)
+		path := key
+		if parent != "" {
+			path = parent + "." + key
+		}
+		lines[path] = n + 1
+		stack = append(stack, level{indent: indent, path: path})
+
+		value := strings.TrimSpace(content[i+1:])
+		if strings.HasPrefix(value, "[") {
+			for j := range strings.Split(strings.Trim(value, "[]"), ",") {
+				lines[path+"["+strconv.Itoa(j)+"]"] = n + 1
+			}
+		}
+	}
+	return lines
+}
+
+// yamlLine returns the line of path, or of its closest parent that is in
+// the document, zero when none is
+func yamlLine(lines map[string]int, path string) int {
+
+	for path != "" {
+		if n, ok := lines[path]; ok {
+			return n
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	image "git.openstack.org/stackforge/golang-client.git/image/v1"
+	network "git.openstack.org/stackforge/golang-client.git/network/v2"
+)
+
+func TestYAMLLines(t *testing.T) {
+
+	lines := yamlLines([]byte(`# comment
+cluster:
+  name: test   # trailing comment
+  master-ip: 10.0.0.10
+
+templates:
+  node:
+    ips:
+    - 10.0.0.11
+    - 10.0.0.12
+  master:
+    ips: [10.0.0.20, 10.0.0.21]
+`))
+
+	for path, want := range map[string]int{
+		"cluster":                 2,
+		"cluster.name":            3,
+		"cluster.master-ip":       4,
+		"templates.node.ips":      8,
+		"templates.node.ips[0]":   9,
+		"templates.node.ips[1]":   10,
+		"templates.master":        11,
+		"templates.master.ips[1]": 12,
+	} {
+		if got := lines[path]; got != want {
+			t.Errorf("%s: expected line %d, got %d", path, want, got)
+		}
+	}
+
+	if got := yamlLine(lines, "templates.node.ips[5]"); got != 8 {
+		t.Errorf("expected the line of the parent, got %d", got)
+	}
+	if got := yamlLine(lines, "unknown.path"); got != 0 {
+		t.Errorf("expected no line, got %d", got)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(`cluster:
+  name: test-cluster
+  sshkey: missing-key
+  network: kube-net
+  master-ip: 192.168.1.140
+  external-cidr: 10.1.0.0
+
+templates:
+  master:
+    hostname: kube-master
+    image-name: Ubuntu
+    flavor-name: standard.medium
+  node:
+    hostname: kube-node
+    count: 3
+    ips:
+    - 192.168.1.150
+    - 10.0.0.5
+    - 192.168.1.140
+    image-name: CoreOS
+    flavor-name: standard.huge
+`)
+
+	env.provider.images = append(env.provider.images, image.Response{ID: "image-2", Name: "Ubuntu"}, image.Response{ID: "image-3", Name: "Ubuntu"})
+	env.provider.ports["foreign"] = network.PortResponse{ID: "foreign", Name: "other", NetworkID: "net-1", FixedIPs: []network.FixedIP{{IPAddress: "192.168.1.150"}}}
+	env.provider.networks = env.provider.networks[:1]
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%d %s", p.Line, strings.SplitN(p.Message, " ", 2)[0]))
+	}
+
+	want := []string{
+		"3 keypair",      // missing
+		"4 no",           // external network, reported at the network
+		"5 address",      // master shares its address with kube-node-3
+		"6 \"10.1.0.0\"", // not a CIDR
+		"11 image",       // ambiguous image
+		"17 address",     // used by a foreign port
+		"18 address",     // outside the subnet
+		"19 address",     // shares the master address
+		"21 flavor",      // missing
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, p := range problems {
+			t.Logf("%d %s: %s", p.Line, p.Path, p.Message)
+		}
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+
+	env := newTestEnv(t)
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+
+	// the ports of a running cluster do not count as used
+	installAction(env.context(env.command(Install)))
+	problems, err = validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no problems for the installed cluster, got %v", problems)
+	}
+}
+
+func TestValidateCreateNetwork(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(createNetworkConfig)
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected the missing network to be accepted, got %v", problems)
+	}
+
+	config := strings.Replace(createNetworkConfig, "pool-end: 10.10.0.200", "pool-end: 10.20.0.200", 1)
+	config = strings.Replace(config, "    pool-start", "    external-network: missing\n    pool-start", 1)
+	env.writeConfig(config)
+
+	problems, err = validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Path+": "+p.Message)
+	}
+	want := []string{
+		"cluster.create-network: allocation pool address \"10.20.0.200\" is not in 10.10.0.0/24",
+		"cluster.create-network.external-network: external network missing not found",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateFloatingIPAddress(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(floatingIPConfig("    address: 15.125.106.200\n"))
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Path != "cluster.floating-ip.address" || problems[0].Line != 7 {
+		t.Fatalf("expected the unknown address to be reported, got %v", problems)
+	}
+
+	reserved, _ := env.provider.CreateFloatingIP("")
+	env.writeConfig(floatingIPConfig("    address: " + reserved.IP + "\n"))
+	installAction(env.context(env.command(Install)))
+
+	problems, err = validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected the address of the installed master to be accepted, got %v", problems)
+	}
+}
+
+func TestValidateEtcd(t *testing.T) {
+
+	for _, c := range []struct {
+		section string
+		path    string
+	}{
+		{"    discovery: ftp://discovery.local/new\n", "cluster.etcd.discovery"},
+		{"    discovery: public\n    members: [kube-node-1]\n", "cluster.etcd.members"},
+		{"    members: [kube-master]\n", "cluster.etcd.members"},
+		{"    members: [kube-node-3]\n", "cluster.etcd.members"},
+	} {
+		env := newTestEnv(t)
+		env.writeConfig(etcdConfig(c.section))
+
+		problems, err := validateConfig(env.context(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != 1 || problems[0].Path != c.path || problems[0].Line == 0 {
+			t.Errorf("%q: expected a problem at %s, got %v", c.section, c.path, problems)
+		}
+	}
+}
+
+func TestValidateKubernetes(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(testConfig, "  master-ip: 192.168.1.140\n", "  master-ip: 192.168.1.140\n  kubernetes:\n    version: v1.8.2\n    base-url: mirror.local\n", 1))
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%d %s", p.Line, p.Path))
+	}
+	if want := []string{"7 cluster.kubernetes.version", "8 cluster.kubernetes.base-url"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateLegacyMasters(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(strings.Replace(legacyTestConfig, "ismaster: false", "ismaster: true", 1))
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []int
+	for _, p := range problems {
+		lines = append(lines, p.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{6, 11}) {
+		t.Errorf("expected both masters to be reported, got %v", problems)
+	}
+}
+
+func TestValidateTemplateProblems(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.writeConfig(`cluster:
+  name: test-cluster
+  sshkey: missing-key
+  network: kube-net
+  master-ip: 192.168.1.400
+
+templates:
+  master:
+    hostname: kube-master
+    count: 2
+    image-name: CoreOS
+    flavor-name: standard.medium
+  node:
+    hostname: kube-node
+    count: 1
+    ips: [192.168.1.150, 192.168.1.151]
+    image-name: CoreOS
+    flavor-name: standard.small
+`)
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%d %s", p.Line, p.Path))
+	}
+
+	// the other settings are still checked
+	want := []string{
+		"3 cluster.sshkey",
+		"5 cluster.master-ip",
+		"10 templates.master.count",
+		"16 templates.node.ips",
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, p := range problems {
+			t.Logf("%d %s: %s", p.Line, p.Path, p.Message)
+		}
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateLookupErrors(t *testing.T) {
+
+	env := newTestEnv(t)
+	env.provider.lookupErr = fmt.Errorf("service unavailable")
+
+	problems, err := validateConfig(env.context(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, fmt.Sprintf("%d %s", p.Line, p.Path))
+	}
+
+	// each failed lookup is reported at the settings it was needed for
+	want := []string{
+		"10 templates.master.image-name",
+		"11 templates.master.flavor-name",
+		"12 templates.master.availabilityZone",
+		"16 templates.node.image-name",
+		"17 templates.node.flavor-name",
+		"18 templates.node.availabilityZone",
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, p := range problems {
+			t.Logf("%d %s: %s", p.Line, p.Path, p.Message)
+		}
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// pollInterval is the delay between the first two server status requests
+var pollInterval = 1 * time.Second
+
+// maxPollInterval caps the delay between two server status requests
+var maxPollInterval = 30 * time.Second
+
+// waitPolicy bounds the wait for servers to become ACTIVE. Deadline is
+// shared by all nodes of a command, NodeTimeout applies to every server on
+// its own. With RetryFailed a server that goes to ERROR is deleted and
+// created once more.
+type waitPolicy struct {
+	Deadline    time.Time
+	NodeTimeout time.Duration
+	RetryFailed bool
+}
+
+// newWaitPolicy reads --timeout, --node-timeout and --retry-failed, the
+// overall deadline starts counting now.
+func newWaitPolicy(c *cli.Context) (waitPolicy, error) {
+
+	timeout := c.Duration(Timeout)
+	if timeout <= 0 {
+		return waitPolicy{}, fmt.Errorf("--%s must be positive", Timeout)
+	}
+	nodeTimeout := c.Duration(NodeTimeout)
+	if nodeTimeout <= 0 {
+		return waitPolicy{}, fmt.Errorf("--%s must be positive", NodeTimeout)
+	}
+
+	return waitPolicy{
+		Deadline:    time.Now().Add(timeout),
+		NodeTimeout: nodeTimeout,
+		RetryFailed: c.Bool(RetryFailed),
+	}, nil
+}
+
+// serverFailedError is returned when a server goes to ERROR while it is
+// waited for. Fault is the message Nova reports for the failure.
+type serverFailedError struct {
+	Fault string
+}
+
+func (e *serverFailedError) Error() string {
+	if e.Fault == "" {
+		return "server in ERROR state"
+	}
+	return "server in ERROR state: " + e.Fault
+}
+
+// waitForServer polls the server until it is ACTIVE. It fails as soon as
+// the server goes to ERROR, and when the node timeout or the overall
+// deadline passes first.
+func (w waitPolicy) waitForServer(serverID string) error {
+
+	start := time.Now()
+	deadline := w.nodeDeadline(start)
+
+	prevStatus := ""
+	for attempt := 0; ; attempt++ {
+		server, err := provider.ServerDetail(serverID)
+
+		if err != nil {
+			return err
+		}
+
+		if prevStatus != server.Status {
+			log.Printf("%-20s - %s %s\n", "server status", server.Name, server.Status)
+			prevStatus = server.Status
+		}
+
+		switch server.Status {
+		case "ACTIVE":
+			return nil
+		case "ERROR":
+			fault, err := provider.ServerFault(serverID)
+			if err != nil {
+				log.Printf("%-20s - %s %s\n", "server fault", server.Name, err.Error())
+			}
+			return &serverFailedError{Fault: fault}
+		}
+
+		if !sleepUntil(deadline, attempt) {
+			return fmt.Errorf("still %s after %s", server.Status, time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// waitForServerDeletion polls the server until Nova no longer knows it
+func (w waitPolicy) waitForServerDeletion(serverID string) error {
+
+	start := time.Now()
+	deadline := w.nodeDeadline(start)
+
+	for attempt := 0; ; attempt++ {
+		server, err := provider.ServerDetail(serverID)
+		if httpStatusCode(err) == 404 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !sleepUntil(deadline, attempt) {
+			return fmt.Errorf("still %s after %s", server.Status, time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+// nodeDeadline returns the earlier of the node timeout and the deadline
+func (w waitPolicy) nodeDeadline(start time.Time) time.Time {
+
+	deadline := start.Add(w.NodeTimeout)
+	if !w.Deadline.IsZero() && w.Deadline.Before(deadline) {
+		deadline = w.Deadline
+	}
+	return deadline
+}
+
+// sleepUntil sleeps for the backoff of the given attempt, but not past the
+// deadline. It returns false once the deadline has passed.
+func sleepUntil(deadline time.Time, attempt int) bool {
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+
+	delay := backoff(attempt)
+	if delay > remaining {
+		delay = remaining
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// backoff returns the delay before status request attempt+1. It doubles
+// from pollInterval up to maxPollInterval and is randomly shortened by up
+// to half, so nodes waited for concurrently do not poll in lockstep.
+func backoff(attempt int) time.Duration {
+
+	delay := pollInterval
+	for i := 0; i < attempt && delay < maxPollInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxPollInterval {
+		delay = maxPollInterval
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	savedPoll, savedMaxPoll := pollInterval, maxPollInterval
+	defer func() {
+		pollInterval, maxPollInterval = savedPoll, savedMaxPoll
+	}()
+	pollInterval, maxPollInterval = time.Second, 30*time.Second
+
+	for attempt, want := range []time.Duration{1, 2, 4, 8, 16, 30, 30} {
+		want *= time.Second
+		for i := 0; i < 20; i++ {
+			if got := backoff(attempt); got < want/2 || got > want {
+				t.Fatalf("attempt %d: expected a delay between %s and %s, got %s", attempt, want/2, want, got)
+			}
+		}
+	}
+}
+
+func TestNodeDeadline(t *testing.T) {
+
+	start := time.Now()
+
+	w := waitPolicy{Deadline: start.Add(time.Minute), NodeTimeout: time.Hour}
+	if got := w.nodeDeadline(start); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the overall deadline, got %s", got.Sub(start))
+	}
+
+	w = waitPolicy{Deadline: start.Add(time.Hour), NodeTimeout: time.Minute}
+	if got := w.nodeDeadline(start); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the node timeout, got %s", got.Sub(start))
+	}
+
+	w = waitPolicy{NodeTimeout: time.Minute}
+	if got := w.nodeDeadline(start); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the node timeout without a deadline, got %s", got.Sub(start))
+	}
+}